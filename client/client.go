@@ -0,0 +1,301 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/datacratic/goship/ship"
+)
+
+// Client talks to a build server. Requests have no side effects other than
+// the ones of the server and errors reported by the server are *ship.Error.
+type Client struct {
+	URL   string
+	HTTP  *http.Client
+	Token string
+}
+
+// New returns a client for the server at the given address, which uses plain
+// HTTP unless it has a scheme.
+func New(address string) *Client {
+	return &Client{
+		URL:  ship.URL(address),
+		HTTP: http.DefaultClient,
+	}
+}
+
+// Build asks the server to build the versions of the dependencies given by
+// the request.
+func (c *Client) Build(b *ship.Build) (result *ship.BuildResult, err error) {
+	result = new(ship.BuildResult)
+	if err = c.post("/request/build", b, result); err != nil {
+		result = nil
+	}
+
+	return
+}
+
+// BuildLock asks the server to build from a lock file.
+func (c *Client) BuildLock(l *ship.Lock) (result *ship.BuildResult, err error) {
+	result = new(ship.BuildResult)
+	if err = c.post("/request/lock", l, result); err != nil {
+		result = nil
+	}
+
+	return
+}
+
+// BuildRemote asks the server to resolve the dependencies from its mirrors
+// and build them.
+func (c *Client) BuildRemote(r *ship.Remote) (result *ship.BuildResult, err error) {
+	result = new(ship.BuildResult)
+	if err = c.post("/request/remote", r, result); err != nil {
+		result = nil
+	}
+
+	return
+}
+
+// Deploy updates the matching instances to the version of the request, or
+// to the previous version when it is empty.
+func (c *Client) Deploy(d *ship.Deploy) (result *ship.DeployResult, err error) {
+	result = new(ship.DeployResult)
+	if err = c.post("/request/deploy", d, result); err != nil {
+		result = nil
+	}
+
+	return
+}
+
+// Cancel stops a running build.
+func (c *Client) Cancel(id string) (err error) {
+	err = c.post("/request/cancel", &ship.Cancel{ID: id}, new(ship.Cancel))
+	return
+}
+
+// Builds returns a page of the builds matching the query, starting with the
+// most recent.
+func (c *Client) Builds(q *ship.Query) (result *ship.BuildPage, err error) {
+	result = new(ship.BuildPage)
+	if err = c.get("/api/v1/builds?"+q.Values().Encode(), result); err != nil {
+		result = nil
+	}
+
+	return
+}
+
+// BuildInfo returns a build with its log.
+func (c *Client) BuildInfo(id string) (result *ship.BuildInfo, err error) {
+	result = new(ship.BuildInfo)
+	if err = c.get("/api/v1/builds/"+url.PathEscape(id), result); err != nil {
+		result = nil
+	}
+
+	return
+}
+
+// Deploys returns a page of the deployments matching the query, starting
+// with the most recent.
+func (c *Client) Deploys(q *ship.Query) (result *ship.DeployPage, err error) {
+	result = new(ship.DeployPage)
+	if err = c.get("/api/v1/deploys?"+q.Values().Encode(), result); err != nil {
+		result = nil
+	}
+
+	return
+}
+
+// Apps returns a page of the instances registered with the server.
+func (c *Client) Apps(q *ship.Query) (result *ship.AppPage, err error) {
+	result = new(ship.AppPage)
+	if err = c.get("/api/v1/apps?"+q.Values().Encode(), result); err != nil {
+		result = nil
+	}
+
+	return
+}
+
+// Approve lets a build enter a stage of a pipeline requiring approval.
+func (c *Client) Approve(a *ship.Approval) (result *ship.Promotion, err error) {
+	result = new(ship.Promotion)
+	if err = c.post("/request/approve", a, result); err != nil {
+		result = nil
+	}
+
+	return
+}
+
+// Pipelines returns where the builds of every pipeline stand.
+func (c *Client) Pipelines() (result []*ship.PipelineStatus, err error) {
+	err = c.get("/api/v1/pipelines", &result)
+	return
+}
+
+// Workers returns the workers running builds for the server.
+func (c *Client) Workers() (result []*ship.WorkerInfo, err error) {
+	err = c.get("/api/v1/workers", &result)
+	return
+}
+
+// Promotions returns a page of the promotions of the pipelines, starting with
+// the most recent.
+func (c *Client) Promotions(q *ship.Query) (result *ship.PromotionPage, err error) {
+	result = new(ship.PromotionPage)
+	if err = c.get("/api/v1/promotions?"+q.Values().Encode(), result); err != nil {
+		result = nil
+	}
+
+	return
+}
+
+// Vulnerabilities returns the running instances affected by known
+// vulnerabilities.
+func (c *Client) Vulnerabilities() (result []*ship.Exposure, err error) {
+	err = c.get("/api/v1/vulnerabilities", &result)
+	return
+}
+
+// Status returns the version running on every instance of an application.
+func (c *Client) Status(app string) (result []*ship.InstanceStatus, err error) {
+	err = c.get("/app/status?"+url.Values{"app": {app}}.Encode(), &result)
+	return
+}
+
+// Diff compares two builds.
+func (c *Client) Diff(from, to string) (result *ship.Diff, err error) {
+	q := url.Values{}
+	q.Set("from", from)
+	q.Set("to", to)
+
+	result = new(ship.Diff)
+	if err = c.get("/diff?"+q.Encode(), result); err != nil {
+		result = nil
+	}
+
+	return
+}
+
+// SBOM returns the bill of materials of a build.
+func (c *Client) SBOM(id string) (result *ship.SBOM, err error) {
+	result = new(ship.SBOM)
+	if err = c.get("/builds/"+url.PathEscape(id)+".sbom.json", result); err != nil {
+		result = nil
+	}
+
+	return
+}
+
+// Load reports how busy the server is.
+func (c *Client) Load() (result *ship.Load, err error) {
+	result = new(ship.Load)
+	if err = c.get("/api/v1/load", result); err != nil {
+		result = nil
+	}
+
+	return
+}
+
+// Log copies the log of a build to the writer, including the log of a build
+// that is still running.
+func (c *Client) Log(id string, w io.Writer) (err error) {
+	err = c.copy("/api/v1/logs/"+url.PathEscape(id), w)
+	return
+}
+
+// Download copies the compressed executable of a build to the writer.
+func (c *Client) Download(id string, w io.Writer) (err error) {
+	err = c.copy("/builds/"+url.PathEscape(id)+".gz", w)
+	return
+}
+
+func (c *Client) post(path string, item, result interface{}) (err error) {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequest("POST", c.URL+path, bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	err = c.do(req, result)
+	return
+}
+
+func (c *Client) get(path string, result interface{}) (err error) {
+	req, err := http.NewRequest("GET", c.URL+path, nil)
+	if err != nil {
+		return
+	}
+
+	err = c.do(req, result)
+	return
+}
+
+// do sends a request and decodes the structured result.
+func (c *Client) do(req *http.Request, result interface{}) (err error) {
+	req.Header.Set("Accept", "application/json")
+
+	r, err := c.send(req)
+	if err != nil {
+		return
+	}
+
+	defer r.Body.Close()
+
+	if err = json.NewDecoder(r.Body).Decode(result); err != nil {
+		err = fmt.Errorf("invalid response from %s: %s", req.URL.Host, err.Error())
+	}
+
+	return
+}
+
+func (c *Client) copy(path string, w io.Writer) (err error) {
+	req, err := http.NewRequest("GET", c.URL+path, nil)
+	if err != nil {
+		return
+	}
+
+	r, err := c.send(req)
+	if err != nil {
+		return
+	}
+
+	defer r.Body.Close()
+
+	_, err = io.Copy(w, r.Body)
+	return
+}
+
+// send authorizes the request and returns successful responses.
+func (c *Client) send(req *http.Request) (r *http.Response, err error) {
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	client := c.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	if r, err = client.Do(req); err != nil {
+		return
+	}
+
+	if r.StatusCode != http.StatusOK {
+		text, _ := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+
+		err = ship.ReadError(r, text)
+		r = nil
+	}
+
+	return
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/datacratic/goship/ship"
+)
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		want        *ship.Error
+	}{
+		{
+			"json", http.StatusUnprocessableEntity, "application/json",
+			`{"status":422,"code":"build_failed","message":"exit status 2","stage":"compile","log":"/builds/x-1.build"}`,
+			&ship.Error{Status: 422, Code: ship.CodeBuildFailed, Message: "exit status 2", Stage: "compile", Log: "/builds/x-1.build"},
+		},
+		{
+			"status of the response", http.StatusNotFound, "application/json",
+			`{"status":400,"code":"not_found","message":"unknown build"}`,
+			&ship.Error{Status: 404, Code: ship.CodeNotFound, Message: "unknown build"},
+		},
+		{
+			"text", http.StatusBadGateway, "text/plain",
+			"bad gateway\n",
+			&ship.Error{Status: 502, Code: ship.CodeInternal, Message: "bad gateway"},
+		},
+		{
+			"json without a code", http.StatusServiceUnavailable, "application/json",
+			`{"error":"draining"}`,
+			&ship.Error{Status: 503, Code: ship.CodeInternal, Message: `{"error":"draining"}`},
+		},
+	}
+
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+				t.Errorf("%s: authorization is %q", test.name, got)
+			}
+
+			w.Header().Set("Content-Type", test.contentType)
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.body))
+		}))
+
+		c := New(server.URL)
+		c.Token = "secret"
+
+		// structured responses and copies report the same errors
+		_, err := c.BuildInfo("x-1")
+		if e, ok := err.(*ship.Error); !ok || !reflect.DeepEqual(e, test.want) {
+			t.Errorf("%s: BuildInfo returned %#v, want %#v", test.name, err, test.want)
+		}
+
+		err = c.Log("x-1", new(bytes.Buffer))
+		if e, ok := err.(*ship.Error); !ok || !reflect.DeepEqual(e, test.want) {
+			t.Errorf("%s: Log returned %#v, want %#v", test.name, err, test.want)
+		}
+
+		server.Close()
+	}
+}
+
+func TestResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/load" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"running":2,"builds":5}`))
+	}))
+
+	defer server.Close()
+
+	load, err := New(server.URL).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if load.Running != 2 || load.Builds != 5 {
+		t.Errorf("load is %+v", load)
+	}
+}
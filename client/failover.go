@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/datacratic/goship/ship"
+)
+
+// HealthTimeout bounds the time given to a server to report its load.
+var HealthTimeout = 2 * time.Second
+
+// Healthy returns the servers that can be reached, the least loaded first.
+// Servers that reply without reporting their load come last. Every server is
+// returned when none of them can be reached so that the errors can surface.
+func Healthy(clients []*Client) (result []*Client) {
+	if len(clients) < 2 {
+		return clients
+	}
+
+	type health struct {
+		rank int
+		load *ship.Load
+		err  error
+	}
+
+	results := make(chan *health)
+	for i, c := range clients {
+		go func(i int, c *Client) {
+			h := &health{rank: i}
+			h.load, h.err = c.ping()
+			results <- h
+		}(i, c)
+	}
+
+	list := []*health{}
+	for range clients {
+		h := <-results
+		if _, ok := h.err.(*ship.Error); h.err == nil || ok && !Unavailable(h.err) {
+			list = append(list, h)
+		}
+	}
+
+	if len(list) == 0 {
+		return clients
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if (a.err == nil) != (b.err == nil) {
+			return a.err == nil
+		}
+
+		if a.err == nil && a.load.Running != b.load.Running {
+			return a.load.Running < b.load.Running
+		}
+
+		return a.rank < b.rank
+	})
+
+	for _, h := range list {
+		result = append(result, clients[h.rank])
+	}
+
+	return
+}
+
+// ping asks for the load of the server without waiting for too long.
+func (c *Client) ping() (result *ship.Load, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), HealthTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", c.URL+"/api/v1/load", nil)
+	if err != nil {
+		return
+	}
+
+	result = new(ship.Load)
+	err = c.do(req.WithContext(ctx), result)
+	return
+}
+
+// Failover calls f with each server in turn until one of them handles the
+// request. It moves on when a server can't be reached or fails internally
+// and, for lookups, when it doesn't know about what was asked for.
+func Failover(clients []*Client, lookup bool, f func(c *Client) error) (err error) {
+	if len(clients) == 0 {
+		err = fmt.Errorf("no build server")
+		return
+	}
+
+	for _, c := range clients {
+		if err = f(c); err == nil || !Unavailable(err) && !(lookup && missing(err)) {
+			return
+		}
+	}
+
+	return
+}
+
+// Unavailable reports whether the error comes from a server that couldn't be
+// reached, failed to handle the request or is shutting down.
+func Unavailable(err error) bool {
+	e, ok := err.(*ship.Error)
+	return !ok || e.Code == ship.CodeInternal && e.Status >= 500 || e.Code == ship.CodeUnavailable
+}
+
+func missing(err error) bool {
+	e, ok := err.(*ship.Error)
+	return ok && e.Code == ship.CodeNotFound
+}
@@ -0,0 +1,1026 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/datacratic/goship/client"
+	"github.com/datacratic/goship/ship"
+)
+
+type command struct {
+	name        string
+	usage       string
+	description string
+	project     bool
+	setup       func(o *options)
+	run         func(o *options)
+}
+
+type options struct {
+	*flag.FlagSet
+
+	set     map[string]bool
+	config  *ship.Config
+	wd      string
+	address string
+
+	server string
+	ca     string
+	cert   string
+	key    string
+	token  string
+	http   *http.Client
+
+	command  string
+	tags     string
+	flags    ship.Flags
+	nocache  bool
+	lockfile string
+	ref      string
+
+	version  string
+	rollback bool
+
+	query ship.Query
+	since string
+	until string
+	limit int
+
+	stage string
+}
+
+var commands = make(map[string]*command)
+
+func init() {
+	list := []*command{
+		{
+			name:        "build",
+			usage:       "build [flags]",
+			description: "Build the command package and print the ID of the build.",
+			project:     true,
+			run: func(o *options) {
+				o.args(0, 0)
+				o.ship(nil)
+			},
+		},
+		{
+			name:        "deploy",
+			usage:       "deploy [flags] target...",
+			description: "Build the command package and deploy it to the targets.\n\nThe build is skipped when --version is given. Targets are substrings of\ninstance addresses or names of environments.",
+			project:     true,
+			setup: func(o *options) {
+				o.StringVar(&o.version, "version", "", "deploy the specified build instead of building")
+			},
+			run: func(o *options) {
+				o.args(1, -1)
+				o.ship(o.Args())
+			},
+		},
+		{
+			name:        "rollback",
+			usage:       "rollback [flags] target...",
+			description: "Deploy the version that was deployed before the current one.",
+			project:     true,
+			setup: func(o *options) {
+				o.rollback = true
+			},
+			run: func(o *options) {
+				o.args(1, -1)
+				o.ship(o.Args())
+			},
+		},
+		{
+			name:        "builds",
+			usage:       "builds [flags]",
+			description: "List the builds, starting with the most recent ones.",
+			setup: func(o *options) {
+				o.filters("builds")
+				o.StringVar(&o.query.Package, "package", "", "only list builds of the package")
+				o.StringVar(&o.query.Commit, "commit", "", "only list builds using a dependency at the commit, or a prefix of it")
+			},
+			run: func(o *options) {
+				o.args(0, 0)
+				list := []*ship.BuildInfo{}
+				o.collect(func(c *client.Client) error {
+					return o.pages(func(q *ship.Query) (next string, n int, err error) {
+						page, err := c.Builds(q)
+						if err == nil {
+							list = append(list, page.Builds...)
+							next, n = page.Next, len(page.Builds)
+						}
+
+						return
+					})
+				})
+
+				sort.SliceStable(list, func(i, j int) bool {
+					return list[i].When.After(list[j].When)
+				})
+
+				if o.limit > 0 && len(list) > o.limit {
+					list = list[:o.limit]
+				}
+
+				if output(&report{Builds: list}) {
+					return
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				for _, item := range list {
+					state := ""
+					if item.Running {
+						state = "running"
+					}
+
+					if item.Interrupted != "" {
+						state = "interrupted"
+					}
+
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", item.ID, item.When.Local().Format(time.Stamp), item.User, item.Package, state)
+				}
+
+				w.Flush()
+			},
+		},
+		{
+			name:        "deploys",
+			usage:       "deploys [flags]",
+			description: "List the deployments, starting with the most recent ones.",
+			setup: func(o *options) {
+				o.filters("deployments")
+				o.StringVar(&o.query.Version, "build", "", "only list deployments of the build")
+			},
+			run: func(o *options) {
+				o.args(0, 0)
+				list := []*ship.DeployInfo{}
+				o.collect(func(c *client.Client) error {
+					return o.pages(func(q *ship.Query) (next string, n int, err error) {
+						page, err := c.Deploys(q)
+						if err == nil {
+							list = append(list, page.Deploys...)
+							next, n = page.Next, len(page.Deploys)
+						}
+
+						return
+					})
+				})
+
+				sort.SliceStable(list, func(i, j int) bool {
+					return list[i].When.After(list[j].When)
+				})
+
+				if o.limit > 0 && len(list) > o.limit {
+					list = list[:o.limit]
+				}
+
+				if output(&report{Deploys: list}) {
+					return
+				}
+
+				for _, item := range list {
+					state := "ok"
+					if !item.OK {
+						state = "failed"
+					}
+
+					fmt.Println(item.When.Local().Format(time.Stamp), item.User, item.Filename, item.Version, state)
+					for _, line := range item.Logs {
+						fmt.Println("   ", line)
+					}
+				}
+			},
+		},
+		{
+			name:        "apps",
+			usage:       "apps [flags]",
+			description: "List the registered instances of every application.",
+			setup: func(o *options) {
+				o.StringVar(&o.query.App, "app", "", "only list instances of the application")
+			},
+			run: func(o *options) {
+				o.args(0, 0)
+				var list []*ship.AppInfo
+				err := client.Failover(o.servers(), false, func(c *client.Client) error {
+					list = nil
+					return o.pages(func(q *ship.Query) (next string, n int, err error) {
+						page, err := c.Apps(q)
+						if err == nil {
+							list = append(list, page.Apps...)
+							next, n = page.Next, len(page.Apps)
+						}
+
+						return
+					})
+				})
+
+				if err != nil {
+					fail(code(exitFailure, err), err)
+				}
+
+				if output(&report{Apps: list}) {
+					return
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				for _, item := range list {
+					fmt.Fprintf(w, "%s\t%s\t%s\n", item.Name, item.URL, item.Version)
+				}
+
+				w.Flush()
+			},
+		},
+		{
+			name:        "vulns",
+			usage:       "vulns [flags]",
+			description: "List the running instances affected by known vulnerabilities.",
+			run: func(o *options) {
+				o.args(0, 0)
+
+				list := []*ship.Exposure{}
+				o.collect(func(c *client.Client) error {
+					items, err := c.Vulnerabilities()
+					list = append(list, items...)
+					return err
+				})
+
+				if output(&report{Exposed: list}) {
+					return
+				}
+
+				for _, item := range list {
+					fmt.Println(item.App, item.URL, item.Build)
+					for _, f := range item.Findings {
+						fmt.Println("   ", f)
+					}
+				}
+			},
+		},
+		{
+			name:        "pipelines",
+			usage:       "pipelines [flags]",
+			description: "Report the build deployed on every stage of the pipelines and the next one.",
+			setup: func(o *options) {
+				o.StringVar(&o.query.App, "app", "", "only report the pipeline of the application")
+			},
+			run: func(o *options) {
+				o.args(0, 0)
+				var list []*ship.PipelineStatus
+				err := client.Failover(o.servers(), true, func(c *client.Client) (err error) {
+					list, err = c.Pipelines()
+					return
+				})
+
+				if err != nil {
+					fail(code(exitFailure, err), err)
+				}
+
+				if output(&report{Pipelines: list}) {
+					return
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				for _, p := range list {
+					if o.query.App != "" && p.App != o.query.App {
+						continue
+					}
+
+					fmt.Fprintf(w, "%s (%s)\n", p.App, p.Package)
+					for _, item := range p.Stages {
+						current := "-"
+						if item.Current != nil {
+							current = item.Current.Build
+						}
+
+						next := ""
+						if item.Failed != nil {
+							next = fmt.Sprintf("%s failed: %s", item.Failed.Build, item.Failed.Message)
+						}
+
+						if item.Next != "" {
+							next = "next " + item.Next
+							if item.Waiting != "" {
+								next += ": " + item.Waiting
+							}
+						}
+
+						fmt.Fprintf(w, "  %s\t%s\t%s\n", item.Name, current, next)
+					}
+				}
+
+				w.Flush()
+			},
+		},
+		{
+			name:        "promotions",
+			usage:       "promotions [flags]",
+			description: "List the builds promoted through the stages of the pipelines, starting with\nthe most recent ones.",
+			setup: func(o *options) {
+				o.filters("promotions")
+			},
+			run: func(o *options) {
+				o.args(0, 0)
+				var list []*ship.Promotion
+				err := client.Failover(o.servers(), true, func(c *client.Client) error {
+					list = nil
+					return o.pages(func(q *ship.Query) (next string, n int, err error) {
+						page, err := c.Promotions(q)
+						if err == nil {
+							list = append(list, page.Promotions...)
+							next, n = page.Next, len(page.Promotions)
+						}
+
+						return
+					})
+				})
+
+				if err != nil {
+					fail(code(exitFailure, err), err)
+				}
+
+				if o.limit > 0 && len(list) > o.limit {
+					list = list[:o.limit]
+				}
+
+				if output(&report{Promotions: list}) {
+					return
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				for _, item := range list {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", item.When.Local().Format(time.Stamp), item.User, item.App, item.Stage, item.Build, item.State, item.Message)
+				}
+
+				w.Flush()
+			},
+		},
+		{
+			name:        "approve",
+			usage:       "approve [flags] build",
+			description: "Let a build enter a stage of a pipeline requiring approval.\n\nThe build must have been deployed on the previous stage.",
+			setup: func(o *options) {
+				o.StringVar(&o.query.App, "app", "", "application of the pipeline")
+				o.StringVar(&o.stage, "stage", "", "stage the build enters")
+			},
+			run: func(o *options) {
+				o.args(1, 1)
+				if o.query.App == "" || o.stage == "" {
+					fail(exitFailure, fmt.Errorf("both --app and --stage are required"))
+				}
+
+				a := &ship.Approval{
+					App:   o.query.App,
+					Stage: o.stage,
+					Build: o.Arg(0),
+					User:  username(),
+				}
+
+				var p *ship.Promotion
+				err := client.Failover(o.servers(), true, func(c *client.Client) (err error) {
+					p, err = c.Approve(a)
+					return
+				})
+
+				if err != nil {
+					fail(code(exitFailure, err), err)
+				}
+
+				if !output(&report{Promotions: []*ship.Promotion{p}}) {
+					fmt.Println("approved", p.Build, "for", p.Stage, "of", p.App)
+				}
+			},
+		},
+		{
+			name:        "workers",
+			usage:       "workers [flags]",
+			description: "List the workers running builds for the server with the builds they run.",
+			run: func(o *options) {
+				o.args(0, 0)
+				var list []*ship.WorkerInfo
+				err := client.Failover(o.servers(), true, func(c *client.Client) (err error) {
+					list, err = c.Workers()
+					return
+				})
+
+				if err != nil {
+					fail(code(exitFailure, err), err)
+				}
+
+				if output(&report{Workers: list}) {
+					return
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				for _, item := range list {
+					fmt.Fprintf(w, "%s\t%s/%s\t%s\t%d/%d\t%s\n", item.Name, item.GOOS, item.GOARCH, strings.Join(item.Go, " "), len(item.Running), item.Slots, strings.Join(item.Running, " "))
+				}
+
+				w.Flush()
+			},
+		},
+		{
+			name:        "status",
+			usage:       "status [flags]",
+			description: "Report the version running on every instance of the command package.",
+			project:     true,
+			run: func(o *options) {
+				o.args(0, 0)
+				o.status()
+			},
+		},
+		{
+			name:        "logs",
+			usage:       "logs [flags] build",
+			description: "Print the log of a build, including running and failed ones.",
+			run: func(o *options) {
+				o.args(1, 1)
+				err := client.Failover(o.servers(), true, func(c *client.Client) error {
+					return c.Log(o.Arg(0), os.Stdout)
+				})
+
+				if err != nil {
+					fail(code(exitFailure, err), err)
+				}
+			},
+		},
+		{
+			name:        "cancel",
+			usage:       "cancel [flags] build",
+			description: "Stop a running build.",
+			run: func(o *options) {
+				o.args(1, 1)
+				err := client.Failover(o.servers(), true, func(c *client.Client) error {
+					return c.Cancel(o.Arg(0))
+				})
+
+				if err != nil {
+					fail(code(exitFailure, err), err)
+				}
+			},
+		},
+		{
+			name:        "diff",
+			usage:       "diff [flags] build-a build-b",
+			description: "Compare the dependencies, toolchain and flags of two builds.",
+			run: func(o *options) {
+				o.args(2, 2)
+				var d *ship.Diff
+				err := client.Failover(o.servers(), true, func(c *client.Client) (err error) {
+					d, err = c.Diff(o.Arg(0), o.Arg(1))
+					return
+				})
+
+				if err != nil {
+					fail(code(exitFailure, err), err)
+				}
+
+				if !output(&report{Diff: d}) {
+					d.Print(os.Stdout)
+				}
+			},
+		},
+		{
+			name:        "sbom",
+			usage:       "sbom [flags] build",
+			description: "Print the CycloneDX bill of materials of a build.",
+			run: func(o *options) {
+				o.args(1, 1)
+
+				var bom *ship.SBOM
+				err := client.Failover(o.servers(), true, func(c *client.Client) (err error) {
+					bom, err = c.SBOM(o.Arg(0))
+					return
+				})
+
+				if err != nil {
+					fail(code(exitFailure, err), err)
+				}
+
+				e := json.NewEncoder(os.Stdout)
+				e.SetIndent("", "  ")
+				if err := e.Encode(bom); err != nil {
+					fail(exitFailure, err)
+				}
+			},
+		},
+		{
+			name:        "lock",
+			usage:       "lock [flags] [filename]",
+			description: "Write the resolved dependencies and build flags to a lock file.\n\nThe lock file is goship.lock unless a filename is given.",
+			project:     true,
+			run: func(o *options) {
+				o.args(0, 1)
+
+				filename := "goship.lock"
+				if o.NArg() == 1 {
+					filename = o.Arg(0)
+				}
+
+				l, err := ship.NewLock(o.command, o.wd, o.flags)
+				if err != nil {
+					fail(exitFailure, err)
+				}
+
+				if err := l.Write(filename); err != nil {
+					fail(exitFailure, err)
+				}
+			},
+		},
+		{
+			name:        "help",
+			usage:       "help [command]",
+			description: "Describe a command.",
+			run: func(o *options) {
+				o.args(0, 1)
+				if o.NArg() == 0 {
+					usage()
+					return
+				}
+
+				c, ok := commands[o.Arg(0)]
+				if !ok {
+					fail(exitFailure, fmt.Errorf("unknown command '%s'", o.Arg(0)))
+				}
+
+				c.options([]string{"-h"})
+			},
+		},
+		{
+			usage:       "[flags] [target...]",
+			description: "Build the command package and deploy it to the targets, if any.",
+			project:     true,
+			setup: func(o *options) {
+				o.StringVar(&o.version, "version", "", "use specified version for deployment")
+				o.BoolVar(&o.rollback, "rollback", false, "rollback deployment")
+			},
+			run: func(o *options) {
+				if o.rollback && o.version != "" {
+					fail(exitFailure, fmt.Errorf("version is implicit when using --rollback"))
+				}
+
+				o.ship(o.Args())
+			},
+		},
+	}
+
+	for _, c := range list {
+		commands[c.name] = c
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: ship command [flags] [arguments]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+
+	names := []string{}
+	for name := range commands {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		text := strings.SplitN(commands[name].description, "\n", 2)[0]
+		fmt.Fprintf(w, "  %s\t%s\n", name, text)
+	}
+
+	w.Flush()
+
+	fmt.Fprintln(os.Stderr, "\nship [flags] [target...] builds and deploys in one step.")
+	fmt.Fprintln(os.Stderr, "Use \"ship help command\" for more information about a command.")
+}
+
+// options parses the flags of the command and applies the configuration.
+func (c *command) options(args []string) (o *options) {
+	o = &options{
+		FlagSet: flag.NewFlagSet("ship "+c.name, flag.ExitOnError),
+		set:     make(map[string]bool),
+		flags:   ship.Flags{Env: make(env)},
+	}
+
+	o.Usage = func() {
+		if c.name == "" {
+			usage()
+			fmt.Fprintln(os.Stderr)
+		}
+
+		fmt.Fprintln(os.Stderr, "usage: ship", c.usage)
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, c.description)
+		fmt.Fprintln(os.Stderr, "\nflags:")
+		o.PrintDefaults()
+	}
+
+	o.StringVar(&o.server, "server", "$GOBUILDSERVER", "comma-separated addresses of the build servers")
+	o.StringVar(&o.ca, "ca", "", "CA file used to verify the build server")
+	o.StringVar(&o.cert, "cert", "", "client certificate file used to authenticate")
+	o.StringVar(&o.key, "key", "", "private key file of the client certificate")
+	o.BoolVar(&asJSON, "json", false, "print structured results in JSON")
+
+	if c.project {
+		o.StringVar(&o.command, "command", ".", "location of the command package to build")
+		o.StringVar(&o.tags, "tags", "", "space-separated list of build tags")
+		o.StringVar(&o.flags.GCFlags, "gcflags", "", "arguments to pass on each go tool compile invocation")
+		o.StringVar(&o.flags.LDFlags, "ldflags", "", "arguments to pass on each go tool link invocation")
+		o.StringVar(&o.flags.Mode, "buildmode", "", "build mode to use")
+		o.BoolVar(&o.flags.Race, "race", false, "enable data race detection")
+		o.Var(env(o.flags.Env), "env", "environment override as KEY=VALUE (repeatable)")
+		o.BoolVar(&o.nocache, "no-cache", false, "check every repository even if known to be clean")
+		o.StringVar(&o.lockfile, "lock", "", "build from the specified lock file instead of the local repositories")
+		o.StringVar(&o.ref, "ref", "", "let the server build the command package from a branch, tag or commit")
+	}
+
+	if c.setup != nil {
+		c.setup(o)
+	}
+
+	o.Parse(args)
+
+	var err error
+	if o.wd, err = os.Getwd(); err != nil {
+		fail(exitFailure, err)
+	}
+
+	o.config, err = ship.ReadConfig(o.wd)
+	if err != nil {
+		fail(exitFailure, err)
+	}
+
+	// command line flags have precedence over the configuration
+	o.Visit(func(f *flag.Flag) {
+		o.set[f.Name] = true
+	})
+
+	if o.token = os.Getenv("GOSHIP_TOKEN"); o.token == "" {
+		o.token = o.config.Token
+	}
+
+	if !o.set["ca"] {
+		o.ca = o.config.CA
+	}
+
+	if !o.set["cert"] && !o.set["key"] {
+		o.cert, o.key = o.config.Cert, o.config.Key
+	}
+
+	if o.ca != "" || o.cert != "" || o.key != "" {
+		tls, err := ship.NewTLSConfig(o.ca, o.cert, o.key)
+		if err != nil {
+			fail(exitFailure, err)
+		}
+
+		o.http = ship.NewHTTPClient(tls)
+	}
+
+	if !c.project {
+		return
+	}
+
+	if !o.set["command"] && o.config.Command != "" {
+		o.command = o.config.Command
+	}
+
+	if o.command == "" {
+		fail(exitFailure, fmt.Errorf("missing command package"))
+	}
+
+	if o.nocache {
+		ship.DependencyCache = ""
+	}
+
+	o.flags.Tags = strings.Fields(strings.Replace(o.tags, ",", " ", -1))
+	if o.config.Flags != nil {
+		o.flags = merge(*o.config.Flags, o.flags, o.set)
+	}
+
+	if len(o.flags.Env) == 0 {
+		o.flags.Env = nil
+	}
+
+	if (o.lockfile != "" || o.ref != "") && (o.rollback || o.version != "") {
+		fail(exitFailure, fmt.Errorf("--lock and --ref can't be used with --rollback or --version"))
+	}
+
+	if o.ref != "" && strings.HasPrefix(o.command, ".") {
+		fail(exitFailure, fmt.Errorf("--ref requires the import path of the command package"))
+	}
+
+	return
+}
+
+// args checks the number of arguments, max being negative when unbounded.
+func (o *options) args(min, max int) {
+	if n := o.NArg(); n < min || max >= 0 && n > max {
+		o.Usage()
+		os.Exit(exitFailure)
+	}
+}
+
+// servers returns the addresses of the build servers that can be reached,
+// the least loaded first.
+func (o *options) servers() (result []*client.Client) {
+	list := strings.Split(os.ExpandEnv(o.server), ",")
+	switch {
+	case o.set["server"]:
+	case o.address != "":
+		list = []string{o.address}
+	case list[0] == "":
+		list = o.config.Servers
+	}
+
+	for _, item := range list {
+		if item = strings.TrimSpace(item); item != "" {
+			c := client.New(item)
+			c.Token = o.token
+			if o.http != nil {
+				c.HTTP = o.http
+			}
+
+			result = append(result, c)
+		}
+	}
+
+	if len(result) == 0 {
+		fail(exitFailure, fmt.Errorf("missing build server HTTP address"))
+	}
+
+	return client.Healthy(result)
+}
+
+// filters adds the flags selecting the items of a listing.
+func (o *options) filters(items string) {
+	o.StringVar(&o.query.App, "app", "", "only list "+items+" of the application")
+	o.StringVar(&o.query.User, "user", "", "only list "+items+" by the user")
+	o.StringVar(&o.since, "since", "", "only list "+items+" since the time, either RFC 3339 or a duration ago")
+	o.StringVar(&o.until, "until", "", "only list "+items+" before the time, either RFC 3339 or a duration ago")
+	o.IntVar(&o.limit, "limit", 0, "list at most this number of "+items)
+}
+
+// pages calls f with the query of the flags and the cursor of each page
+// until the last page or until enough items were read.
+func (o *options) pages(f func(q *ship.Query) (next string, n int, err error)) (err error) {
+	q := o.query
+	q.Since = o.parseTime("since", o.since)
+	q.Until = o.parseTime("until", o.until)
+	if o.limit > 0 && o.limit <= ship.MaxLimit {
+		q.Limit = o.limit
+	}
+
+	for total := 0; ; {
+		next, n, err := f(&q)
+		if err != nil {
+			return err
+		}
+
+		if total += n; next == "" || o.limit > 0 && total >= o.limit {
+			return nil
+		}
+
+		q.After = next
+	}
+}
+
+func (o *options) parseTime(name, text string) (result time.Time) {
+	if text == "" {
+		return
+	}
+
+	if d, err := time.ParseDuration(text); err == nil {
+		return time.Now().Add(-d)
+	}
+
+	result, err := time.Parse(time.RFC3339, text)
+	if err != nil {
+		fail(exitFailure, fmt.Errorf("--%s expects an RFC 3339 time or a duration instead of '%s'", name, text))
+	}
+
+	return
+}
+
+// collect calls f with every server, skipping the ones that can't be reached
+// as long as one of them replies.
+func (o *options) collect(f func(c *client.Client) error) {
+	var last error
+
+	replied := false
+	for _, c := range o.servers() {
+		err := f(c)
+		if err == nil {
+			replied = true
+			continue
+		}
+
+		if code(exitFailure, err) != exitTransport {
+			fail(code(exitFailure, err), err)
+		}
+
+		last = err
+	}
+
+	if !replied {
+		fail(exitTransport, last)
+	}
+}
+
+// targets replaces environments by their targets, which may also select the
+// build server.
+func (o *options) targets(args []string) (result []string) {
+	result, address, err := o.config.Targets(args)
+	if err != nil {
+		fail(exitFailure, err)
+	}
+
+	o.address = address
+	return
+}
+
+// source returns the functions requesting a build and creating a deployment
+// depending on where the build comes from.
+func (o *options) source(targets []string) (build func(c *client.Client) (*ship.BuildResult, error), deploy func() (*ship.Deploy, error)) {
+	switch {
+	case o.ref != "":
+		r := &ship.Remote{
+			Name:  o.command,
+			Ref:   o.ref,
+			Flags: o.flags,
+		}
+
+		// pin dependencies using the lock file
+		if o.lockfile != "" {
+			l, err := ship.ReadLock(o.lockfile)
+			if err != nil {
+				fail(exitFailure, err)
+			}
+
+			r.Pins = l.Versions
+		}
+
+		build = func(c *client.Client) (*ship.BuildResult, error) {
+			r.User = username()
+			return c.BuildRemote(r)
+		}
+
+		deploy = func() (*ship.Deploy, error) {
+			return r.Deploy(targets)
+		}
+
+	case o.lockfile != "":
+		l, err := ship.ReadLock(o.lockfile)
+		if err != nil {
+			fail(exitFailure, err)
+		}
+
+		build = func(c *client.Client) (*ship.BuildResult, error) {
+			l.User = username()
+			return c.BuildLock(l)
+		}
+
+		deploy = func() (*ship.Deploy, error) {
+			return l.Deploy(targets)
+		}
+
+	default:
+		var b *ship.Build
+
+		// scan the dependencies once even when failing over
+		build = func(c *client.Client) (*ship.BuildResult, error) {
+			if b == nil {
+				var err error
+				if b, err = ship.NewBuild(o.command, o.wd, o.flags); err != nil {
+					fail(exitFailure, err)
+				}
+			}
+
+			return c.Build(b)
+		}
+
+		deploy = func() (*ship.Deploy, error) {
+			return ship.NewDeploy(o.command, o.wd, targets)
+		}
+	}
+
+	return
+}
+
+func (o *options) status() {
+	_, deploy := o.source(nil)
+
+	d, err := deploy()
+	if err != nil {
+		fail(exitFailure, err)
+	}
+
+	var result []*ship.InstanceStatus
+	err = client.Failover(o.servers(), true, func(c *client.Client) (err error) {
+		result, err = c.Status(d.Filename)
+		return
+	})
+
+	if err != nil {
+		fail(code(exitFailure, err), err)
+	}
+
+	if output(&report{Status: result}) {
+		return
+	}
+
+	for _, item := range result {
+		if item.OK {
+			fmt.Println(item.Host, item.Version)
+		} else {
+			fmt.Println(item.Host, "FAILED", item.Message)
+		}
+	}
+}
+
+// ship builds unless a version is given or a rollback is requested and then
+// deploys to the targets, if any.
+func (o *options) ship(args []string) {
+	targets := o.targets(args)
+	build, deploy := o.source(targets)
+	servers := o.servers()
+
+	r := &report{}
+
+	// handle new build requests when needed
+	h := o.version
+	if h == "" && !o.rollback {
+		err := client.Failover(servers, false, func(c *client.Client) (err error) {
+			result, err := build(c)
+			if err == nil {
+				r.Build, servers = result, []*client.Client{c}
+			}
+
+			return
+		})
+
+		if err != nil {
+			r.fail(code(exitBuild, err), err)
+		}
+
+		h = r.Build.ID
+
+		if !asJSON {
+			fmt.Println(h)
+			for _, f := range r.Build.Findings {
+				log.Println("vulnerable:", f)
+			}
+		}
+	}
+
+	// deploy?
+	if len(targets) == 0 {
+		if o.rollback {
+			r.fail(exitFailure, fmt.Errorf("no targets to roll back"))
+		}
+
+		output(r)
+		return
+	}
+
+	// an empty version asks for a rollback
+	d, err := deploy()
+	if err != nil {
+		r.fail(exitFailure, err)
+	}
+
+	d.Version = h
+
+	// only the server holding the artifact can deploy it
+	err = client.Failover(servers, true, func(c *client.Client) (err error) {
+		result, err := c.Deploy(d)
+		if err == nil {
+			r.Deploy = result
+		}
+
+		return
+	})
+
+	if err != nil {
+		r.fail(code(exitDeploy, err), err)
+	}
+
+	result := r.Deploy
+	if !asJSON {
+		for _, item := range result.Hosts {
+			fmt.Println(item)
+		}
+	}
+
+	if n := result.Failed(); n != 0 || len(result.Hosts) == 0 {
+		r.fail(exitDeploy, fmt.Errorf("%d of %d hosts failed to deploy %s", n, len(result.Hosts), result.Version))
+	}
+
+	output(r)
+}
@@ -1,78 +1,172 @@
 package main
 
 import (
-	"flag"
+	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"os/user"
+	"strings"
 
 	"github.com/datacratic/goship/ship"
 )
 
-func main() {
-	log.SetFlags(0)
+const (
+	exitFailure   = 1 // local errors and bad usage
+	exitBuild     = 2 // the server was unable to build
+	exitDeploy    = 3 // some or all hosts were not updated
+	exitTransport = 4 // the server was unreachable or replied nonsense
+	exitRejected  = 5 // the server refused the request
+)
+
+var asJSON bool
+
+type env map[string]string
+
+func (e env) String() string {
+	return fmt.Sprint(map[string]string(e))
+}
+
+func (e env) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected KEY=VALUE instead of '%s'", value)
+	}
+
+	e[value[:i]] = value[i+1:]
+	return nil
+}
 
-	command := flag.String("command", ".", "location of the command package to build")
-	version := flag.String("version", "", "use specified version for deployment")
-	rollback := flag.Bool("rollback", false, "rollback deployment")
-	server := flag.String("server", "$GOBUILDSERVER", "address of the build server")
+type report struct {
+	Build      *ship.BuildResult      `json:"build,omitempty"`
+	Deploy     *ship.DeployResult     `json:"deploy,omitempty"`
+	Status     []*ship.InstanceStatus `json:"status,omitempty"`
+	Builds     []*ship.BuildInfo      `json:"builds,omitempty"`
+	Deploys    []*ship.DeployInfo     `json:"deploys,omitempty"`
+	Apps       []*ship.AppInfo        `json:"apps,omitempty"`
+	Exposed    []*ship.Exposure       `json:"exposed,omitempty"`
+	Diff       *ship.Diff             `json:"diff,omitempty"`
+	Pipelines  []*ship.PipelineStatus `json:"pipelines,omitempty"`
+	Promotions []*ship.Promotion      `json:"promotions,omitempty"`
+	Workers    []*ship.WorkerInfo     `json:"workers,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+	Details    *ship.Error            `json:"details,omitempty"`
+	Code       int                    `json:"code"`
+}
 
-	flag.Parse()
+// output prints the report in JSON when asked to and reports whether it did.
+func output(r *report) bool {
+	if !asJSON {
+		return false
+	}
 
-	if *command == "" {
-		log.Fatal("usage: gd options [deploy-list]")
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	if err := e.Encode(r); err != nil {
+		log.Fatal(err)
 	}
 
-	url := os.ExpandEnv(*server)
-	if url == "" {
-		log.Fatal("missing build server HTTP address")
+	return true
+}
+
+func (r *report) fail(code int, err error) {
+	r.Code = code
+	r.Error = err.Error()
+	r.Details, _ = err.(*ship.Error)
+
+	if !output(r) {
+		log.Println(err)
+		if r.Details != nil && r.Details.Log != "" {
+			log.Println("see", r.Details.Log)
+		}
 	}
 
-	url = "http://" + url
+	os.Exit(code)
+}
 
-	if *rollback && *version != "" {
-		log.Fatal("version is implicit when using --rollback")
+func fail(code int, err error) {
+	r := &report{}
+	r.fail(code, err)
+}
+
+// code returns the exit code of an error depending on whether the server
+// rejected the request, failed to process it or couldn't be reached.
+func code(failed int, err error) int {
+	e, ok := err.(*ship.Error)
+	if !ok {
+		return exitTransport
 	}
 
-	wd, err := os.Getwd()
+	switch e.Code {
+	case ship.CodeInvalid, ship.CodeUnauthorized, ship.CodeForbidden, ship.CodeNotFound, ship.CodeMethod:
+		return exitRejected
+	case ship.CodeInternal:
+		if e.Status >= 500 {
+			return exitTransport
+		}
+	}
+
+	return failed
+}
+
+func username() string {
+	u, err := user.Current()
 	if err != nil {
-		return
+		fail(exitFailure, err)
 	}
 
-	// create a list of targets from args
-	targets := []string{}
-	for i, n := 0, flag.NArg(); i < n; i++ {
-		arg := flag.Arg(i)
-		targets = append(targets, arg)
+	return u.Username
+}
+
+// merge returns the flags of the configuration overridden by the ones given
+// on the command line.
+func merge(config, args ship.Flags, set map[string]bool) (result ship.Flags) {
+	result = config
+
+	if set["tags"] {
+		result.Tags = args.Tags
 	}
 
-	// handle rollbacks
-	if *rollback {
-		if err := ship.RequestRollback(url, *command, wd, targets); err != nil {
-			log.Fatal(err)
-		}
+	if set["gcflags"] {
+		result.GCFlags = args.GCFlags
+	}
 
-		return
+	if set["ldflags"] {
+		result.LDFlags = args.LDFlags
 	}
 
-	h := *version
+	if set["buildmode"] {
+		result.Mode = args.Mode
+	}
 
-	// handle new build requests when needed
-	if h == "" {
-		result, err := ship.RequestBuild(url, *command, wd)
-		if err != nil {
-			log.Fatal(err)
-		}
+	if set["race"] {
+		result.Race = args.Race
+	}
 
-		h = result
+	result.Env = make(map[string]string)
+	for key, value := range config.Env {
+		result.Env[key] = value
 	}
 
-	// deploy?
-	if len(targets) == 0 {
-		return
+	for key, value := range args.Env {
+		result.Env[key] = value
 	}
 
-	// send deploy requests
-	if err := ship.RequestDeploy(url, *command, wd, h, targets); err != nil {
-		log.Fatal(err)
+	return
+}
+
+func main() {
+	log.SetFlags(0)
+
+	args := os.Args[1:]
+
+	// the one-shot form builds and deploys to the hosts given as arguments
+	c := commands[""]
+	if len(args) != 0 {
+		if item, found := commands[args[0]]; found && args[0] != "" {
+			c, args = item, args[1:]
+		}
 	}
+
+	c.run(c.options(args))
 }
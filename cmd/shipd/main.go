@@ -1,26 +1,58 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/datacratic/goship/ship"
 )
 
 func main() {
+	// shipd fsck checks and repairs the directory of a stopped server
+	fsck := len(os.Args) > 1 && os.Args[1] == "fsck"
+	if fsck {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	address := flag.String("address", ":8080", "address of the web server")
 	directory := flag.String("directory", "", "directory location")
 	hostname := flag.String("hostname", "", "URL used by clients to reach the server")
+	allowlist := flag.String("allowlist", "", "JSON file with the allowed build flags")
+	auth := flag.String("auth", "", "JSON file with the user tokens and the instance secret")
+	cert := flag.String("cert", "", "certificate file used to serve HTTPS, reloaded when changed")
+	key := flag.String("key", "", "private key file used to serve HTTPS, reloaded when changed")
+	clientCA := flag.String("client-ca", "", "CA file used to verify client certificates")
+	instanceCA := flag.String("instance-ca", "", "CA file used to verify instances served over HTTPS")
+	vulndb := flag.String("vulndb", "", "OSV database file (JSON or zip) to scan dependencies with, reloaded when changed")
+	vulnfail := flag.Bool("vuln-fail", false, "fail builds with known vulnerabilities instead of reporting them")
+	watch := flag.String("watch", "", "JSON file with the commands to build when code is pushed to /hooks/push")
+	webhooks := flag.String("webhooks", "", "JSON file with the webhooks to send build and deploy events to")
+	pipelines := flag.String("pipelines", "", "JSON file with the pipelines promoting builds through environments")
+	worker := flag.Bool("worker", false, "run the builds of a coordinator instead of serving clients")
+	coordinator := flag.String("coordinator", "", "URL of the server whose builds are run in worker mode")
+	coordinatorCA := flag.String("coordinator-ca", "", "CA file used to verify the coordinator served over HTTPS")
+	slots := flag.Int("slots", 1, "number of builds run at once in worker mode")
+	name := flag.String("name", "", "name of the worker when the coordinator doesn't authenticate workers, the hostname by default")
+	token := flag.String("token", "", "token authenticating the worker to the coordinator, which names the worker")
+	goversion := flag.String("go", "", "version of Go workers must build with, such as go1.22.1, the version of the local go command by default")
+	timeout := flag.Duration("shutdown-timeout", 5*time.Minute, "time given to running builds and deployments to complete when stopping")
 
 	flag.Parse()
 
 	s := &ship.Server{
 		Root: *directory,
 		Host: *hostname,
+		Go:   *goversion,
 	}
 
 	if s.Root == "" {
@@ -32,13 +64,175 @@ func main() {
 		s.Root = wd
 	}
 
+	if fsck {
+		problems, err := ship.Fsck(s.Root)
+		for _, problem := range problems {
+			log.Println(problem)
+		}
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if len(problems) != 0 {
+			os.Exit(1)
+		}
+
+		log.Println("no problems found in", s.Root)
+		return
+	}
+
+	if *worker {
+		w := &ship.Worker{
+			Coordinator: *coordinator,
+			Root:        s.Root,
+			Name:        *name,
+			Slots:       *slots,
+			Token:       *token,
+		}
+
+		if w.Coordinator == "" {
+			log.Fatal("--coordinator is required in worker mode")
+		}
+
+		if w.Name == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			w.Name = hostname
+		}
+
+		if *coordinatorCA != "" {
+			config, err := ship.NewTLSConfig(*coordinatorCA, "", "")
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			w.Client = ship.NewHTTPClient(config)
+		}
+
+		if *vulndb != "" {
+			w.Scanner = &ship.Scanner{
+				Filename: *vulndb,
+				Fail:     *vulnfail,
+			}
+
+			if _, err := w.Scanner.Reload(); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		log.Fatal(w.Run())
+	}
+
+	if *allowlist != "" {
+		file, err := os.Open(*allowlist)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		s.Allow = new(ship.Allowlist)
+		if err := json.NewDecoder(file).Decode(s.Allow); err != nil {
+			log.Fatal(err)
+		}
+
+		file.Close()
+	}
+
+	if *auth != "" {
+		file, err := os.Open(*auth)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		s.Auth = new(ship.Auth)
+		if err := json.NewDecoder(file).Decode(s.Auth); err != nil {
+			log.Fatal(err)
+		}
+
+		file.Close()
+	} else {
+		log.Println("warning: authentication is disabled")
+	}
+
+	if *webhooks != "" {
+		file, err := os.Open(*webhooks)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := json.NewDecoder(file).Decode(&s.Webhooks); err != nil {
+			log.Fatal(err)
+		}
+
+		file.Close()
+	}
+
+	if *watch != "" {
+		file, err := os.Open(*watch)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		s.Watch = new(ship.Watch)
+		if err := json.NewDecoder(file).Decode(s.Watch); err != nil {
+			log.Fatal(err)
+		}
+
+		file.Close()
+	}
+
+	if *pipelines != "" {
+		file, err := os.Open(*pipelines)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := json.NewDecoder(file).Decode(&s.Pipelines); err != nil {
+			log.Fatal(err)
+		}
+
+		file.Close()
+	}
+
+	if *instanceCA != "" {
+		config, err := ship.NewTLSConfig(*instanceCA, "", "")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		s.Client = ship.NewHTTPClient(config)
+	}
+
+	if *vulndb != "" {
+		s.Scanner = &ship.Scanner{
+			Filename: *vulndb,
+			Fail:     *vulnfail,
+		}
+
+		if _, err := s.Scanner.Reload(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if (*cert == "") != (*key == "") {
+		log.Fatal("both --cert and --key are required to serve HTTPS")
+	}
+
+	scheme := "http://"
+	if *cert != "" {
+		scheme = "https://"
+	}
+
 	if s.Host == "" {
 		result, err := exec.Command("hostname", "-f").Output()
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		s.Host = "http://" + strings.TrimSpace(string(result)) + *address
+		s.Host = scheme + strings.TrimSpace(string(result)) + *address
 	}
 
 	if err := s.Start(); err != nil {
@@ -47,8 +241,62 @@ func main() {
 
 	log.Println("installing server at", s.Host)
 
-	err := http.ListenAndServe(*address, nil)
-	if err != nil {
+	server := &http.Server{
+		Addr: *address,
+	}
+
+	if *cert != "" {
+		server.TLSConfig = &tls.Config{
+			GetCertificate: (&ship.Certificate{Cert: *cert, Key: *key}).GetCertificate,
+		}
+
+		if *clientCA != "" {
+			pool, err := ship.LoadCertPool(*clientCA)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			// tokens remain valid for clients without certificate
+			server.TLSConfig.ClientCAs = pool
+			server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	go func() {
+		var err error
+		if *cert == "" {
+			err = server.ListenAndServe()
+		} else {
+			err = server.ListenAndServeTLS("", "")
+		}
+
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// a second signal stops the server right away
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	log.Println("received", <-signals, "waiting for running builds and deployments")
+	signal.Stop(signals)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != nil {
+		log.Println("stopped waiting:", err)
+	}
+
+	// let the handlers reply before closing the connections
+	ctx, cancel = context.WithTimeout(context.Background(), ship.ShutdownGrace)
+	defer cancel()
+
+	server.Shutdown(ctx)
+
+	if err := s.Close(); err != nil {
 		log.Fatal(err)
 	}
+
+	log.Println("stopped")
 }
@@ -0,0 +1,54 @@
+// Copyright (c) 2015 Datacratic. All rights reserved.
+package deploy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SignatureHeader carries the HMAC-SHA256 of the request body, or of the URL
+// path for requests without body, using the secret shared by the build
+// servers and the instances.
+const SignatureHeader = "X-Goship-Signature"
+
+// TimestampHeader carries the time when a request was signed. It is part of
+// the signature so that requests can't be replayed once MaxRequestAge passed.
+const TimestampHeader = "X-Goship-Timestamp"
+
+func Sign(secret string, data []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(data)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// SignRequest signs the data of a request along with the current time.
+func SignRequest(secret string, r *http.Request, data []byte) {
+	when := strconv.FormatInt(time.Now().Unix(), 10)
+	r.Header.Set(TimestampHeader, when)
+	r.Header.Set(SignatureHeader, Sign(secret, timestamped(when, data)))
+}
+
+// Verify checks the signature of a request signed with SignRequest less than
+// MaxRequestAge ago.
+func Verify(secret string, data []byte, r *http.Request) bool {
+	when := r.Header.Get(TimestampHeader)
+	t, err := strconv.ParseInt(when, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	if age := time.Since(time.Unix(t, 0)); age > MaxRequestAge || age < -MaxRequestAge {
+		return false
+	}
+
+	value := r.Header.Get(SignatureHeader)
+	return hmac.Equal([]byte(value), []byte(Sign(secret, timestamped(when, data))))
+}
+
+func timestamped(when string, data []byte) []byte {
+	return append([]byte(when+"\n"), data...)
+}
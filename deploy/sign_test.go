@@ -0,0 +1,52 @@
+package deploy
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"md5":"0123"}`)
+
+	signed := func(secret string, offset time.Duration) func() (string, string) {
+		return func() (string, string) {
+			when := strconv.FormatInt(time.Now().Add(offset).Unix(), 10)
+			return when, Sign(secret, timestamped(when, body))
+		}
+	}
+
+	tests := []struct {
+		name   string
+		header func() (when, signature string)
+		data   []byte
+		ok     bool
+	}{
+		{"signed", signed("secret", 0), body, true},
+		{"skewed clock", signed("secret", time.Minute), body, true},
+		{"other data", signed("secret", 0), []byte(`{"md5":"4567"}`), false},
+		{"other secret", signed("other", 0), body, false},
+		{"stale", signed("secret", -2*MaxRequestAge), body, false},
+		{"future", signed("secret", 2*MaxRequestAge), body, false},
+		{"no timestamp", func() (string, string) { return "", Sign("secret", body) }, body, false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/deploy/new", nil)
+		when, signature := test.header()
+		r.Header.Set(TimestampHeader, when)
+		r.Header.Set(SignatureHeader, signature)
+
+		if ok := Verify("secret", test.data, r); ok != test.ok {
+			t.Errorf("%s: Verify() = %v, want %v", test.name, ok, test.ok)
+		}
+	}
+
+	// requests signed by SignRequest are accepted
+	r := httptest.NewRequest("POST", "/deploy/new", nil)
+	SignRequest("secret", r, body)
+	if !Verify("secret", body, r) {
+		t.Error("signed request was refused")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"crypto/md5"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -15,10 +16,14 @@ import (
 	"path"
 	"strings"
 	"sync"
+	"time"
 )
 
 var Version string
 
+// MaxRequestAge is how long a signed deployment request remains valid.
+var MaxRequestAge = 5 * time.Minute
+
 func init() {
 	if Version != "" {
 		log.Println(Version)
@@ -29,8 +34,21 @@ type Update struct {
 	Address string
 	Servers []string
 
-	version string
-	once    sync.Once
+	// Secret is shared with the build servers to sign requests. When set,
+	// deployments that are not signed or too old are rejected.
+	Secret string
+
+	// TLS is used to reach the build servers and to download updates over
+	// HTTPS e.g. to trust a private CA.
+	TLS *tls.Config
+
+	client    *http.Client
+	version   string
+	installed time.Time
+	failures  int64
+	failed    time.Time
+	mutex     sync.Mutex
+	once      sync.Once
 }
 
 func (u *Update) Start() (err error) {
@@ -50,19 +68,49 @@ func (u *Update) Start() (err error) {
 		Version: u.version,
 	}
 
-	body := &bytes.Buffer{}
-	err = json.NewEncoder(body).Encode(&cmd)
+	body, err := json.Marshal(&cmd)
 	if err != nil {
 		return
 	}
 
 	for _, item := range u.Servers {
-		go http.Post("http://"+item+"/app/instance", "application/json", body)
+		url := item
+		if !strings.Contains(url, "://") {
+			url = "http://" + url
+		}
+
+		go u.post(url+"/app/instance", body)
 	}
 
 	return
 }
 
+func (u *Update) post(url string, body []byte) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if u.Secret != "" {
+		SignRequest(u.Secret, req, body)
+	}
+
+	r, err := u.client.Do(req)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	io.Copy(ioutil.Discard, r.Body)
+	r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		log.Println("registration to", url, "failed:", r.Status)
+	}
+}
+
 func (u *Update) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	u.once.Do(u.initialize)
 
@@ -78,18 +126,42 @@ func (u *Update) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain")
 
 		q := struct {
-			URL string `json:"url"`
-			MD5 string `json:"md5"`
+			URL  string    `json:"url"`
+			MD5  string    `json:"md5"`
+			When time.Time `json:"when"`
 		}{}
 
-		err := json.NewDecoder(r.Body).Decode(&q)
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
+		if u.Secret != "" && !Verify(u.Secret, body, r) {
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		err = json.Unmarshal(body, &q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// refuse to replay old requests
+		if u.Secret != "" && time.Since(q.When) > MaxRequestAge {
+			http.Error(w, "401 request expired", http.StatusUnauthorized)
+			return
+		}
+
 		err = u.update(q.URL, q.MD5)
 		if err != nil {
+			u.mutex.Lock()
+			u.failures++
+			u.failed = time.Now()
+			u.mutex.Unlock()
+
 			http.Error(w, err.Error(), http.StatusServiceUnavailable)
 			return
 		}
@@ -106,6 +178,13 @@ func (u *Update) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (u *Update) initialize() {
+	u.client = &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: u.TLS,
+		},
+	}
+
 	binary, err := ioutil.ReadFile(os.Args[0])
 	if err != nil {
 		log.Println("can't read", os.Args[0])
@@ -113,11 +192,49 @@ func (u *Update) initialize() {
 	}
 
 	u.version = fmt.Sprintf("%x", md5.Sum(binary))
+
+	// updates replace the executable so it was written by the last one
+	if info, err := os.Stat(os.Args[0]); err == nil {
+		u.installed = info.ModTime()
+	}
+}
+
+// Metrics reports the version of the instance, when it was installed and the
+// updates that failed since it started in the text format of Prometheus. It
+// is not installed by Start, e.g. use
+//
+//	http.HandleFunc("/metrics", u.Metrics)
+func (u *Update) Metrics(w http.ResponseWriter, r *http.Request) {
+	u.once.Do(u.initialize)
+
+	u.mutex.Lock()
+	failures, failed := u.failures, u.failed
+	u.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP goship_update_info Version of the running executable.")
+	fmt.Fprintln(w, "# TYPE goship_update_info gauge")
+	fmt.Fprintf(w, "goship_update_info{app=%q,version=%q} 1\n", path.Base(os.Args[0]), u.version)
+
+	fmt.Fprintln(w, "# HELP goship_update_timestamp_seconds Time when the running executable was installed.")
+	fmt.Fprintln(w, "# TYPE goship_update_timestamp_seconds gauge")
+	fmt.Fprintf(w, "goship_update_timestamp_seconds %d\n", u.installed.Unix())
+
+	fmt.Fprintln(w, "# HELP goship_update_failures_total Updates that failed since the instance started.")
+	fmt.Fprintln(w, "# TYPE goship_update_failures_total counter")
+	fmt.Fprintf(w, "goship_update_failures_total %d\n", failures)
+
+	if !failed.IsZero() {
+		fmt.Fprintln(w, "# HELP goship_update_last_failure_timestamp_seconds Time of the last update that failed.")
+		fmt.Fprintln(w, "# TYPE goship_update_last_failure_timestamp_seconds gauge")
+		fmt.Fprintf(w, "goship_update_last_failure_timestamp_seconds %d\n", failed.Unix())
+	}
 }
 
 func (u *Update) update(url, version string) (err error) {
 	if version == u.version {
-		fmt.Errorf("already at version %s", version)
+		err = fmt.Errorf("already at version %s", version)
 		return
 	}
 
@@ -136,13 +253,27 @@ func (u *Update) download(url, version string) (result string, err error) {
 	log.Println("updating using", url)
 
 	// get the archive from server over HTTP
-	r, err := http.Get(url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return
+	}
+
+	if u.Secret != "" {
+		SignRequest(u.Secret, req, []byte(req.URL.Path))
+	}
+
+	r, err := u.client.Do(req)
 	if err != nil {
 		return
 	}
 
 	defer r.Body.Close()
 
+	if r.StatusCode != http.StatusOK {
+		err = fmt.Errorf("unable to download '%s': %s", url, r.Status)
+		return
+	}
+
 	z, err := gzip.NewReader(r.Body)
 	if err != nil {
 		return
@@ -0,0 +1,86 @@
+package ship
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/datacratic/goship/deploy"
+)
+
+// Auth describes who is allowed to talk to the server. Users authenticate
+// with a token or a client certificate whose common name is the user name.
+// Instances sign their requests with the secret they share with the server.
+// Workers authenticate with their own tokens, which users can't use.
+type Auth struct {
+	Tokens  map[string]string `json:"tokens"`
+	Secret  string            `json:"secret"`
+	Workers map[string]string `json:"workers"`
+}
+
+// User returns the name of the authenticated user.
+func (a *Auth) User(r *http.Request) (name string, ok bool) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) != 0 {
+		name = r.TLS.VerifiedChains[0][0].Subject.CommonName
+		ok = name != ""
+		return
+	}
+
+	value := r.Header.Get("Authorization")
+	if !strings.HasPrefix(value, "Bearer ") {
+		return
+	}
+
+	name, ok = a.Token(strings.TrimPrefix(value, "Bearer "))
+	return
+}
+
+// Token returns the name of the user with the token.
+func (a *Auth) Token(token string) (name string, ok bool) {
+	return match(a.Tokens, token)
+}
+
+// Worker returns the name of the authenticated worker.
+func (a *Auth) Worker(r *http.Request) (name string, ok bool) {
+	value := r.Header.Get("Authorization")
+	if !strings.HasPrefix(value, "Bearer ") {
+		return
+	}
+
+	name, ok = match(a.Workers, strings.TrimPrefix(value, "Bearer "))
+	return
+}
+
+func match(tokens map[string]string, token string) (name string, ok bool) {
+	// check every token to avoid leaking which one matched
+	for key, item := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(item)) == 1 && item != "" {
+			name, ok = key, true
+		}
+	}
+
+	return
+}
+
+// Instance reports whether the data was signed by an instance.
+func (a *Auth) Instance(r *http.Request, data []byte) bool {
+	return a.Secret != "" && deploy.Verify(a.Secret, data, r)
+}
+
+// identify replaces the user reported by the client by the authenticated one.
+func identify(q interface{}, name string) {
+	switch q := q.(type) {
+	case *Build:
+		q.User = name
+	case *Lock:
+		q.User = name
+	case *Remote:
+		q.User = name
+	case *Deploy:
+		q.User = name
+	case *Cancel:
+		q.User = name
+	case *Approval:
+		q.User = name
+	}
+}
@@ -1,14 +1,7 @@
 package ship
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
-	"os"
 	"os/user"
-	"strings"
 	"time"
 )
 
@@ -18,14 +11,20 @@ type Build struct {
 	User     string            `json:"by"`
 	When     time.Time         `json:"when"`
 	Versions map[string]string `json:"versions"`
+	Flags    Flags             `json:"flags"`
+	Ref      string            `json:"ref,omitempty"`
+	Trigger  string            `json:"trigger,omitempty"`
 }
 
-func NewBuild(command, wd string) (result *Build, err error) {
+func NewBuild(command, wd string, flags Flags) (result *Build, err error) {
 	p, err := NewProject(command, wd)
 	if err != nil {
 		return
 	}
 
+	// packages are selected using the same constraints as the server
+	p.Context = flags.Context()
+
 	d, err := p.Dependencies()
 	if err != nil {
 		return
@@ -41,47 +40,8 @@ func NewBuild(command, wd string) (result *Build, err error) {
 		Filename: p.Filename,
 		User:     u.Username,
 		Versions: d,
+		Flags:    flags,
 	}
 
 	return
 }
-
-func RequestBuild(url, command, wd string) (version string, err error) {
-	b, err := NewBuild(command, wd)
-	if err != nil {
-		return
-	}
-
-	output, err := b.Send(url)
-	if err != nil {
-		return
-	}
-
-	version = strings.TrimSpace(string(output))
-	return
-}
-
-func (b *Build) Send(url string) (result []byte, err error) {
-	data := &bytes.Buffer{}
-
-	err = json.NewEncoder(data).Encode(b)
-	if err != nil {
-		return
-	}
-
-	req, err := http.Post(url+"/request/build", "application/json", data)
-	if err != nil {
-		return
-	}
-
-	body := &bytes.Buffer{}
-
-	_, err = io.Copy(io.MultiWriter(os.Stdout, body), req.Body)
-	if err != nil {
-		return
-	}
-
-	fmt.Println()
-	result = body.Bytes()
-	return
-}
@@ -3,26 +3,52 @@ package ship
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
 	"path"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Builder struct {
 	Workspace string
 	Root      string
 	Name      string
+	Identity  string
+	Toolchain string
 	Build     *Build
+	Findings  []*Finding `json:"findings,omitempty"`
+	Mirrors   *Mirrors   `json:"-"`
+	Scanner   *Scanner   `json:"-"`
+
+	output    *os.File
+	logger    *log.Logger
+	durations map[string]time.Duration
+	once      sync.Once
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+func (b *Builder) context() context.Context {
+	b.once.Do(func() {
+		b.ctx, b.cancel = context.WithCancel(context.Background())
+	})
 
-	output *os.File
-	logger *log.Logger
+	return b.ctx
+}
+
+// Cancel stops a running build by killing the commands it invoked.
+func (b *Builder) Cancel() {
+	b.context()
+	b.cancel()
 }
 
 func (b *Builder) Make() (result string, err error) {
@@ -35,35 +61,34 @@ func (b *Builder) Make() (result string, err error) {
 	b.logger = log.New(b.output, "", log.Ldate|log.Lmicroseconds)
 	b.logger.Println("workspace", b.Workspace)
 
-	err = b.checkout()
-	if err != nil {
-		return
-	}
-
-	err = b.compile()
-	if err != nil {
-		return
-	}
-
-	err = b.checksum()
-	if err != nil {
-		return
-	}
-
-	err = b.save()
+	b.Identity, err = b.Build.Identity()
 	if err != nil {
 		return
 	}
 
-	// save the state
-	state, err := json.MarshalIndent(b, "", "  ")
-	if err != nil {
-		return
+	b.logger.Println("identity", b.Identity, b.Build.Flags.String())
+
+	stages := []struct {
+		name string
+		run  func() error
+	}{
+		{"checkout", b.checkout},
+		{"scan", b.scan},
+		{"compile", b.compile},
+		{"checksum", b.checksum},
+		{"save", b.save},
+		{"sbom", b.sbom},
 	}
 
-	err = ioutil.WriteFile(path.Join(b.Root, b.Name+".json"), state, 0644)
-	if err != nil {
-		return
+	b.durations = make(map[string]time.Duration)
+	for _, stage := range stages {
+		start := time.Now()
+		err = stage.run()
+		b.durations[stage.name] = time.Since(start)
+		if err != nil {
+			err = b.fail(stage.name, err)
+			return
+		}
 	}
 
 	b.logger.Printf("done")
@@ -79,6 +104,25 @@ func (b *Builder) Make() (result string, err error) {
 	return
 }
 
+// fail keeps the log of a failed build and returns an error referencing it.
+func (b *Builder) fail(stage string, err error) error {
+	if b.context().Err() != nil {
+		err = newError(http.StatusConflict, CodeCanceled, "build was canceled")
+	}
+
+	b.logger.Println(stage, "failed:", err)
+	b.output.Close()
+
+	e := failed(stage, err)
+
+	name := path.Base(b.Workspace) + ".build"
+	if os.Rename(b.output.Name(), path.Join(b.Root, name)) == nil {
+		e.Log = name
+	}
+
+	return e
+}
+
 func (b *Builder) checkout() (err error) {
 	results := make(chan error)
 
@@ -89,8 +133,8 @@ func (b *Builder) checkout() (err error) {
 
 		git := func(path string, args ...string) (err error) {
 			shell := fmt.Sprintf("git %s\n", strings.Join(args, " "))
-			logger.Printf(shell)
-			cmd := exec.Command("git", args...)
+			logger.Print(shell)
+			cmd := exec.CommandContext(b.context(), "git", args...)
 			cmd.Dir = path
 			cmd.Stdout = output
 			cmd.Stderr = output
@@ -103,8 +147,21 @@ func (b *Builder) checkout() (err error) {
 
 		dir := path.Join(b.Workspace, "src", name)
 
-		// clone
-		url := "git@" + strings.Replace(name, "/", ":", 1) + ".git"
+		// clone from the mirror when available
+		url := remote(name)
+		if b.Mirrors != nil {
+			logger.Println("updating mirror of", name)
+
+			mirror, err := b.Mirrors.Update(name)
+			if err != nil {
+				logger.Println(err)
+				results <- err
+				return
+			}
+
+			url = mirror
+		}
+
 		err := git(b.Workspace, "clone", "-q", "--no-checkout", url, path.Join("src", name))
 		if err != nil {
 			logger.Println(err)
@@ -136,8 +193,31 @@ func (b *Builder) checkout() (err error) {
 	return
 }
 
+// scan looks for known vulnerabilities in the dependencies that were checked
+// out and fails the build when asked to.
+func (b *Builder) scan() (err error) {
+	if b.Scanner == nil {
+		return
+	}
+
+	b.Findings = b.Scanner.Scan(b.Build.Versions, func(repo string) string {
+		return path.Join(b.Workspace, "src", repo)
+	})
+
+	for _, f := range b.Findings {
+		b.logger.Println("vulnerable:", f)
+	}
+
+	if len(b.Findings) != 0 && b.Scanner.Fail {
+		err = newError(http.StatusUnprocessableEntity, CodeVulnerable, "%d known vulnerabilities in dependencies", len(b.Findings))
+	}
+
+	return
+}
+
 func (b *Builder) compile() (err error) {
 	env := []string{"GOROOT=" + os.ExpandEnv("$GOROOT"), "GOPATH=" + b.Workspace}
+	env = append(env, b.Build.Flags.Environ()...)
 
 	// add the build information
 	ver, err := json.Marshal(b.Build)
@@ -146,16 +226,36 @@ func (b *Builder) compile() (err error) {
 	}
 
 	ld := fmt.Sprintf("\"-X github.com/datacratic/goship.Version %q\"", ver)
+	if b.Build.Flags.LDFlags != "" {
+		ld = b.Build.Flags.LDFlags + " " + ld
+	}
+
+	// keep track of the compiler used
+	cmd := exec.CommandContext(b.context(), "go", "version")
+	cmd.Env = env
+	version, err := cmd.Output()
+	if err != nil {
+		err = fmt.Errorf("go version\n%s", err.Error())
+		return
+	}
+
+	b.Toolchain = strings.TrimSpace(string(version))
+	b.logger.Println(b.Toolchain)
+
+	// build to a known location even when cross-compiling
+	args := []string{"build", "-o", path.Join(b.Workspace, "bin", b.Build.Filename)}
+	args = append(args, b.Build.Flags.Args()...)
+	args = append(args, "-ldflags", ld, "--", b.Build.Name)
 
 	// invoke the compiler
-	b.logger.Println(strings.Join(env, " "), "go install", b.Build.Name)
-	cmd := exec.Command("go", "install", b.Build.Name, "-ldflags", ld)
+	b.logger.Println(strings.Join(env, " "), "go", strings.Join(args, " "))
+	cmd = exec.CommandContext(b.context(), "go", args...)
 	cmd.Dir = b.Workspace
 	cmd.Env = env
 	cmd.Stdout = b.output
 	cmd.Stderr = b.output
 	if err = cmd.Run(); err != nil {
-		err = fmt.Errorf("go install\n", err.Error())
+		err = fmt.Errorf("go build\n%s", err.Error())
 	}
 
 	return
@@ -190,21 +290,55 @@ func (b *Builder) save() (err error) {
 		return
 	}
 
-	z, err := os.Create(path.Join(b.Root, b.Name+".gz"))
+	defer f.Close()
+
+	name := path.Join(b.Root, b.Name+".gz")
+	z, err := os.Create(name + ".tmp")
 	if err != nil {
 		return
 	}
 
 	w := gzip.NewWriter(z)
-	b.logger.Println("saving to", z.Name())
+	b.logger.Println("saving to", name)
+
+	if _, err = io.Copy(w, f); err == nil {
+		err = w.Close()
+	}
+
+	if err == nil {
+		err = z.Sync()
+	}
+
+	if e := z.Close(); err == nil {
+		err = e
+	}
+
+	if err == nil {
+		err = commitFile(z.Name(), name)
+	}
 
-	_, err = io.Copy(w, f)
+	if err != nil {
+		os.Remove(z.Name())
+	}
+
+	return
+}
+
+// sbom saves the bill of materials of the build beside the executable.
+func (b *Builder) sbom() (err error) {
+	result, err := NewSBOM(b)
 	if err != nil {
 		return
 	}
 
-	f.Close()
-	w.Close()
-	z.Close()
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return
+	}
+
+	name := path.Join(b.Root, b.Name+".sbom.json")
+	b.logger.Println("saving bill of materials to", name)
+
+	err = writeFile(name, data, 0644)
 	return
 }
@@ -0,0 +1,226 @@
+package ship
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DependencyCache is the file used to remember which repositories were found
+// clean and pushed at a given HEAD. They are checked again as soon as their
+// HEAD, their branch or their index changes, or a file they hold is modified.
+// Set it to "" to always check repositories.
+var DependencyCache = defaultCache()
+
+type scanCache struct {
+	Entries map[string]*scanEntry `json:"repositories"`
+
+	lock sync.Mutex
+}
+
+type scanEntry struct {
+	Head    string    `json:"head"`
+	State   string    `json:"state"`
+	Checked time.Time `json:"checked"`
+}
+
+func defaultCache() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+
+	return path.Join(dir, "goship", "dependencies.json")
+}
+
+func readCache(filename string) (c *scanCache) {
+	c = &scanCache{
+		Entries: make(map[string]*scanEntry),
+	}
+
+	if filename == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+
+	// a broken cache is simply ignored
+	if err = json.Unmarshal(data, c); err != nil || c.Entries == nil {
+		c.Entries = make(map[string]*scanEntry)
+	}
+
+	return
+}
+
+// valid returns the HEAD of a repository when it is known to be clean and
+// pushed, without running git.
+func (c *scanCache) valid(repo string) (head string, ok bool) {
+	c.lock.Lock()
+	entry, found := c.Entries[repo]
+	c.lock.Unlock()
+
+	if !found {
+		return
+	}
+
+	state, known := gitState(repo)
+	if !known || state != entry.State || modifiedSince(repo, entry.Checked) {
+		return
+	}
+
+	return entry.Head, true
+}
+
+// add remembers a repository found clean and pushed by a check started at
+// the given time.
+func (c *scanCache) add(repo, head string, checked time.Time) {
+	state, ok := gitState(repo)
+	if !ok {
+		return
+	}
+
+	c.lock.Lock()
+	c.Entries[repo] = &scanEntry{
+		Head:    head,
+		State:   state,
+		Checked: checked,
+	}
+
+	c.lock.Unlock()
+}
+
+func (c *scanCache) save(filename string) (err error) {
+	if filename == "" {
+		return
+	}
+
+	c.lock.Lock()
+	data, err := json.MarshalIndent(c, "", "  ")
+	c.lock.Unlock()
+	if err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(path.Dir(filename), 0755); err != nil {
+		return
+	}
+
+	// replace atomically since several clients may share the file
+	f, err := ioutil.TempFile(path.Dir(filename), path.Base(filename)+"-")
+	if err != nil {
+		return
+	}
+
+	_, err = f.Write(data)
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return
+	}
+
+	err = os.Rename(f.Name(), filename)
+	return
+}
+
+// gitState describes the HEAD, the current branch and the index of a
+// repository, following .git files used by worktrees and submodules.
+func gitState(repo string) (result string, ok bool) {
+	dir := path.Join(repo, ".git")
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return
+	}
+
+	if !info.IsDir() {
+		if dir, ok = gitFile(repo, dir); !ok {
+			return
+		}
+	}
+
+	data, err := ioutil.ReadFile(path.Join(dir, "HEAD"))
+	if err != nil {
+		return "", false
+	}
+
+	// branches live with the main repository of worktrees
+	common := dir
+	if data, err := ioutil.ReadFile(path.Join(dir, "commondir")); err == nil {
+		common = strings.TrimSpace(string(data))
+		if !path.IsAbs(common) {
+			common = path.Join(dir, common)
+		}
+	}
+
+	// the commit of the branch, unless it was packed
+	result = strings.TrimSpace(string(data))
+	if strings.HasPrefix(result, "ref:") {
+		ref := strings.TrimSpace(strings.TrimPrefix(result, "ref:"))
+		if data, err := ioutil.ReadFile(path.Join(common, ref)); err == nil {
+			result += " " + strings.TrimSpace(string(data))
+		}
+	}
+
+	for _, filename := range []string{path.Join(dir, "HEAD"), path.Join(dir, "index"), path.Join(common, "packed-refs")} {
+		if info, err := os.Stat(filename); err == nil {
+			result += fmt.Sprintf(" %d", info.ModTime().UnixNano())
+		} else {
+			result += " -"
+		}
+	}
+
+	ok = true
+	return
+}
+
+// gitFile returns the git directory given by a .git file.
+func gitFile(repo, filename string) (dir string, ok bool) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+
+	line := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(line, "gitdir:") {
+		return
+	}
+
+	dir = strings.TrimSpace(strings.TrimPrefix(line, "gitdir:"))
+	if !path.IsAbs(dir) {
+		dir = path.Join(repo, dir)
+	}
+
+	ok = true
+	return
+}
+
+var errModified = errors.New("modified")
+
+// modifiedSince reports whether a file of the work tree of a repository was
+// written since the given time, since edits change neither HEAD nor the index.
+func modifiedSince(repo string, when time.Time) bool {
+	err := filepath.Walk(repo, func(name string, info os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case info.IsDir() && info.Name() == ".git":
+			return filepath.SkipDir
+		case info.Mode().IsRegular() && !info.ModTime().Before(when):
+			return errModified
+		}
+
+		return nil
+	})
+
+	return err != nil
+}
@@ -0,0 +1,44 @@
+package ship
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestScanCache(t *testing.T) {
+	dir, commits := testRepository(t, 1)
+	filename := path.Join(dir, "main.go")
+	if err := ioutil.WriteFile(filename, []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := readCache("")
+	c.add(dir, commits[0], time.Now().Add(time.Minute))
+
+	if head, ok := c.valid(dir); !ok || head != commits[0] {
+		t.Errorf("valid() = %q, %v, want %q", head, ok, commits[0])
+	}
+
+	// editing a file changes neither HEAD nor the index
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filename, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := c.valid(dir); ok {
+		t.Error("modified repository is still valid")
+	}
+
+	// a commit moves the branch
+	c.add(dir, commits[0], later.Add(time.Minute))
+	if _, err := git(dir, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "commit"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := c.valid(dir); ok {
+		t.Error("repository is still valid after a commit")
+	}
+}
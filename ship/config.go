@@ -0,0 +1,158 @@
+package ship
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Config holds the client settings shared by a team. It is read from the
+// user's configuration directory and then from the closest goship.json found
+// in the working directory or its parents, the latter taking precedence.
+type Config struct {
+	Servers      []string                `json:"servers"`
+	Token        string                  `json:"token"`
+	CA           string                  `json:"ca"`
+	Cert         string                  `json:"cert"`
+	Key          string                  `json:"key"`
+	Command      string                  `json:"command"`
+	Flags        *Flags                  `json:"flags"`
+	Environments map[string]*Environment `json:"environments"`
+}
+
+type Environment struct {
+	Targets []string `json:"targets"`
+	Server  string   `json:"server"`
+}
+
+const ConfigName = "goship.json"
+
+func ReadConfig(wd string) (result *Config, err error) {
+	result = &Config{
+		Environments: make(map[string]*Environment),
+	}
+
+	if dir, e := os.UserConfigDir(); e == nil {
+		if err = result.read(path.Join(dir, "goship", "config.json"), wd); err != nil {
+			return
+		}
+	}
+
+	// look for the repository configuration
+	for dir := wd; ; dir = path.Dir(dir) {
+		filename := path.Join(dir, ConfigName)
+		if _, e := os.Stat(filename); e == nil {
+			err = result.read(filename, wd)
+			return
+		}
+
+		// stop at the top of the repository
+		if _, e := os.Stat(path.Join(dir, ".git")); e == nil || dir == path.Dir(dir) {
+			return
+		}
+	}
+}
+
+func (c *Config) read(filename, wd string) (err error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	defer file.Close()
+
+	item := new(Config)
+	if err = json.NewDecoder(file).Decode(item); err != nil {
+		err = fmt.Errorf("%s: %s", filename, err.Error())
+		return
+	}
+
+	if len(item.Servers) != 0 {
+		c.Servers = item.Servers
+	}
+
+	if item.Token != "" {
+		c.Token = item.Token
+	}
+
+	// files are relative to the configuration file
+	files := []struct{ from, to *string }{
+		{&item.CA, &c.CA},
+		{&item.Cert, &c.Cert},
+		{&item.Key, &c.Key},
+	}
+
+	for _, file := range files {
+		if *file.from == "" {
+			continue
+		}
+
+		*file.to = *file.from
+		if !path.IsAbs(*file.to) {
+			*file.to = path.Join(path.Dir(filename), *file.to)
+		}
+	}
+
+	if item.Command != "" {
+		c.Command = item.Command
+
+		// relative to the configuration file
+		if build.IsLocalImport(c.Command) {
+			var rel string
+			rel, err = filepath.Rel(wd, path.Join(path.Dir(filename), c.Command))
+			if err != nil {
+				return
+			}
+
+			c.Command = "./" + rel
+		}
+	}
+
+	if item.Flags != nil {
+		c.Flags = item.Flags
+	}
+
+	for name, env := range item.Environments {
+		if env == nil {
+			err = fmt.Errorf("%s: environment '%s' is null", filename, name)
+			return
+		}
+
+		c.Environments[name] = env
+	}
+
+	return
+}
+
+// Targets replaces names of environments by their target selectors and
+// returns the server of the environments if any.
+func (c *Config) Targets(args []string) (targets []string, server string, err error) {
+	for _, arg := range args {
+		env, ok := c.Environments[arg]
+		if !ok || env == nil {
+			targets = append(targets, arg)
+			continue
+		}
+
+		if env.Server != "" {
+			if server != "" && server != env.Server {
+				err = fmt.Errorf("environments use different servers: %s and %s", server, env.Server)
+				return
+			}
+
+			server = env.Server
+		}
+
+		targets = append(targets, env.Targets...)
+	}
+
+	return
+}
@@ -0,0 +1,487 @@
+package ship
+
+import (
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// cookieName holds the token of the users of the dashboard.
+const cookieName = "goship"
+
+// page is the data of a page of the dashboard.
+type page struct {
+	User    string
+	Title   string
+	Message string
+
+	Apps      []*appSummary
+	App       string
+	Package   string
+	Instances []*App
+	Builds    []*BuildInfo
+	Deploys   []*DeployInfo
+	Build     *BuildInfo
+	Versions  [][2]string
+}
+
+type appSummary struct {
+	Name      string
+	Instances int
+	Versions  []string
+}
+
+var dashboard = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"when": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+
+		return t.Local().Format("2006-01-02 15:04:05")
+	},
+	"short": func(id string) string {
+		if len(id) > 12 {
+			return id[:12]
+		}
+
+		return id
+	},
+	"path": url.PathEscape,
+}).Parse(htmlDashboard))
+
+// viewer returns the user of the dashboard, who may authenticate with the
+// cookie set by the login page.
+func (s *Server) viewer(r *http.Request) (name string, ok bool) {
+	if s.Auth == nil {
+		ok = true
+		return
+	}
+
+	if name, ok = s.Auth.User(r); ok {
+		return
+	}
+
+	if c, err := r.Cookie(cookieName); err == nil {
+		name, ok = s.Auth.Token(c.Value)
+	}
+
+	return
+}
+
+// sameOrigin rejects forms posted from other sites. Browsers that don't send
+// the origin of a form send its page as referrer instead, which the dashboard
+// asks for, and forms sending neither are rejected.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Referer()
+	}
+
+	if origin == "" || origin == "null" {
+		return false
+	}
+
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func (s *Server) render(w http.ResponseWriter, status int, name string, p *page) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := dashboard.ExecuteTemplate(w, name, p); err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *Server) startDashboard() {
+	// handle serves a page to authenticated users and sends the others to
+	// the login page
+	handle := func(pattern string, f func(w http.ResponseWriter, r *http.Request, p *page) (string, error)) {
+		http.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			user, ok := s.viewer(r)
+			if !ok {
+				http.Redirect(w, r, "/dashboard/login", http.StatusSeeOther)
+				return
+			}
+
+			p := &page{
+				User: user,
+			}
+
+			if r.Method == "POST" && !sameOrigin(r) {
+				s.render(w, http.StatusForbidden, "message", &page{Title: "Forbidden", Message: "cross-origin request"})
+				return
+			}
+
+			name, err := f(w, r, p)
+			if err != nil {
+				status := http.StatusInternalServerError
+				if e, ok := err.(*Error); ok {
+					status = e.Status
+				}
+
+				s.render(w, status, "message", &page{User: p.User, Title: "Error", Message: err.Error()})
+				return
+			}
+
+			if name != "" {
+				s.render(w, http.StatusOK, name, p)
+			}
+		})
+	}
+
+	handle("/", func(w http.ResponseWriter, r *http.Request, p *page) (name string, err error) {
+		if r.URL.Path != "/" {
+			err = notFound("no page '%s'", r.URL.Path)
+			return
+		}
+
+		p.Title = "Applications"
+		if p.Apps, err = s.summary(); err != nil {
+			return
+		}
+
+		builds, err := s.QueryBuilds(&Query{Limit: 20})
+		if err != nil {
+			return
+		}
+
+		deploys, err := s.QueryDeploys(&Query{Limit: 20})
+		if err != nil {
+			return
+		}
+
+		p.Builds, p.Deploys = builds.Builds, deploys.Deploys
+		name = "index"
+		return
+	})
+
+	handle("/dashboard/app/", func(w http.ResponseWriter, r *http.Request, p *page) (name string, err error) {
+		p.App = strings.TrimPrefix(r.URL.Path, "/dashboard/app/")
+		p.Title = p.App
+
+		apps, err := s.QueryApps(&Query{App: p.App, Limit: MaxLimit})
+		if err != nil {
+			return
+		}
+
+		for _, item := range apps.Apps {
+			p.Instances = append(p.Instances, item.App)
+		}
+
+		builds, err := s.QueryBuilds(&Query{App: p.App, Limit: 50})
+		if err != nil {
+			return
+		}
+
+		deploys, err := s.QueryDeploys(&Query{App: p.App, Limit: 50})
+		if err != nil {
+			return
+		}
+
+		p.Builds, p.Deploys = builds.Builds, deploys.Deploys
+		if len(p.Instances) == 0 && len(p.Builds) == 0 && len(p.Deploys) == 0 {
+			err = notFound("no application '%s'", p.App)
+			return
+		}
+
+		// the package is needed to roll back
+		if len(p.Deploys) != 0 {
+			p.Package = p.Deploys[0].Name
+		} else if len(p.Builds) != 0 {
+			p.Package = p.Builds[0].Package
+		}
+
+		name = "app"
+		return
+	})
+
+	handle("/dashboard/build/", func(w http.ResponseWriter, r *http.Request, p *page) (name string, err error) {
+		if p.Build, err = s.BuildInfo(strings.TrimPrefix(r.URL.Path, "/dashboard/build/")); err != nil {
+			return
+		}
+
+		for repo, commit := range p.Build.Versions {
+			p.Versions = append(p.Versions, [2]string{repo, commit})
+		}
+
+		sort.Slice(p.Versions, func(i, j int) bool {
+			return p.Versions[i][0] < p.Versions[j][0]
+		})
+
+		apps, err := s.QueryApps(&Query{App: p.Build.App, Limit: MaxLimit})
+		if err != nil {
+			return
+		}
+
+		for _, item := range apps.Apps {
+			p.Instances = append(p.Instances, item.App)
+		}
+
+		p.Title = "Build " + p.Build.ID
+		name = "build"
+		return
+	})
+
+	// deploy a build, or roll back when the version is empty
+	handle("/dashboard/deploy", func(w http.ResponseWriter, r *http.Request, p *page) (name string, err error) {
+		if r.Method != "POST" {
+			err = newError(http.StatusMethodNotAllowed, CodeMethod, "method not allowed")
+			return
+		}
+
+		d := &Deploy{
+			Name:     r.FormValue("package"),
+			Filename: r.FormValue("app"),
+			User:     p.User,
+			Version:  r.FormValue("version"),
+			Targets:  []string{r.FormValue("target")},
+		}
+
+		if d.Filename == "" || d.Name == "" {
+			err = invalid("missing application")
+			return
+		}
+
+		if _, err = s.Handle(ioutil.Discard, d); err != nil {
+			return
+		}
+
+		http.Redirect(w, r, "/dashboard/app/"+url.PathEscape(d.Filename), http.StatusSeeOther)
+		return
+	})
+
+	http.HandleFunc("/dashboard/login", func(w http.ResponseWriter, r *http.Request) {
+		p := &page{
+			Title: "Login",
+		}
+
+		if r.Method != "POST" {
+			s.render(w, http.StatusOK, "login", p)
+			return
+		}
+
+		token := r.FormValue("token")
+		if s.Auth == nil {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if _, ok := s.Auth.Token(token); !ok || !sameOrigin(r) {
+			p.Message = "invalid token"
+			s.render(w, http.StatusUnauthorized, "login", p)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     cookieName,
+			Value:    token,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteStrictMode,
+		})
+
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})
+
+	http.HandleFunc("/dashboard/logout", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{
+			Name:   cookieName,
+			Path:   "/",
+			MaxAge: -1,
+		})
+
+		http.Redirect(w, r, "/dashboard/login", http.StatusSeeOther)
+	})
+}
+
+// summary returns every application known from its instances or builds.
+func (s *Server) summary() (result []*appSummary, err error) {
+	apps := make(map[string]*appSummary)
+	get := func(name string) *appSummary {
+		item, ok := apps[name]
+		if !ok {
+			item = &appSummary{
+				Name: name,
+			}
+
+			apps[name] = item
+			result = append(result, item)
+		}
+
+		return item
+	}
+
+	err = s.store.View(func(tx *Tx) (err error) {
+		for _, key := range tx.Keys("index:builders:app", "") {
+			get(key[:strings.Index(key, "\x00")])
+		}
+
+		for _, key := range tx.Keys("apps", "") {
+			a := new(App)
+			if _, err = tx.Get("apps", key, a); err != nil {
+				return
+			}
+
+			item := get(a.Name)
+			item.Instances++
+			if !contains(item.Versions, a.Version) {
+				item.Versions = append(item.Versions, a.Version)
+			}
+		}
+
+		return
+	})
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	return
+}
+
+var htmlDashboard = `
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+ <meta charset="utf-8">
+ <meta name="referrer" content="same-origin">
+ <title>{{.Title}} - shipd</title>
+ <style>
+  body { font-family: sans-serif; margin: 2em; color: #222; }
+  table { border-collapse: collapse; margin-bottom: 2em; }
+  th, td { text-align: left; padding: 0.3em 1em 0.3em 0; border-bottom: 1px solid #ddd; vertical-align: top; }
+  code, pre { font-family: monospace; }
+  pre { background: #f6f6f6; padding: 1em; overflow: auto; }
+  .ok { color: #080; } .failed { color: #b00; } .running { color: #a60; }
+  nav { margin-bottom: 2em; } nav form { display: inline; }
+  form.inline { display: inline; }
+ </style>
+</head>
+<body>
+<nav><a href="/">Applications</a>{{if .User}} &middot; {{.User}} <form method="post" action="/dashboard/logout"><button>Log out</button></form>{{end}}</nav>
+<h1>{{.Title}}</h1>
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "builds"}}
+<table>
+ <tr><th>Build</th><th>When</th><th>By</th><th>Application</th><th></th></tr>
+ {{range .}}<tr>
+  <td><a href="/dashboard/build/{{path .ID}}"><code>{{short .ID}}</code></a></td>
+  <td>{{when .When}}</td>
+  <td>{{.User}}</td>
+  <td>{{if .App}}<a href="/dashboard/app/{{path .App}}">{{.App}}</a>{{else}}{{.Package}}{{end}}</td>
+  <td>{{if .Running}}<span class="running">running</span>{{end}}{{if .Interrupted}}<span class="failed">interrupted</span>{{end}}{{if .Findings}}<span class="failed">{{len .Findings}} vulnerabilities</span>{{end}}</td>
+ </tr>{{else}}<tr><td colspan="5">No builds.</td></tr>{{end}}
+</table>
+{{end}}
+
+{{define "deploys"}}
+<table>
+ <tr><th>When</th><th>By</th><th>Application</th><th>Build</th><th>Outcome</th></tr>
+ {{range .}}<tr>
+  <td>{{when .When}}</td>
+  <td>{{.User}}</td>
+  <td><a href="/dashboard/app/{{path .Filename}}">{{.Filename}}</a></td>
+  <td><a href="/dashboard/build/{{path .Version}}"><code>{{short .Version}}</code></a></td>
+  <td>{{if .OK}}<span class="ok">ok</span>{{else}}<span class="failed">failed</span>{{end}}
+   {{range .Results}}<br>{{.Host}}: <span class="{{if .OK}}ok{{else}}failed{{end}}">{{.Message}}</span>{{end}}</td>
+ </tr>{{else}}<tr><td colspan="5">No deployments.</td></tr>{{end}}
+</table>
+{{end}}
+
+{{define "index"}}{{template "header" .}}
+<table>
+ <tr><th>Application</th><th>Instances</th><th>Deployed builds</th></tr>
+ {{range .Apps}}<tr>
+  <td><a href="/dashboard/app/{{path .Name}}">{{.Name}}</a></td>
+  <td>{{.Instances}}</td>
+  <td>{{range .Versions}}<a href="/dashboard/build/{{path .}}"><code>{{short .}}</code></a> {{end}}</td>
+ </tr>{{else}}<tr><td colspan="3">No applications.</td></tr>{{end}}
+</table>
+<h2>Recent builds</h2>
+{{template "builds" .Builds}}
+<h2>Recent deployments</h2>
+{{template "deploys" .Deploys}}
+{{template "footer"}}{{end}}
+
+{{define "app"}}{{template "header" .}}
+<h2>Instances</h2>
+<table>
+ <tr><th>Instance</th><th>Build</th></tr>
+ {{range .Instances}}<tr><td>{{.URL}}</td><td><a href="/dashboard/build/{{path .Version}}"><code>{{short .Version}}</code></a></td></tr>
+ {{else}}<tr><td colspan="2">No registered instance.</td></tr>{{end}}
+</table>
+{{if and .Instances .Package}}
+<form method="post" action="/dashboard/deploy" onsubmit="return confirm('Roll back {{.App}}?')">
+ <input type="hidden" name="app" value="{{.App}}">
+ <input type="hidden" name="package" value="{{.Package}}">
+ <button>Roll back to the previous build</button>
+</form>
+{{end}}
+<h2>Builds</h2>
+{{template "builds" .Builds}}
+<h2>Deployments</h2>
+{{template "deploys" .Deploys}}
+{{template "footer"}}{{end}}
+
+{{define "build"}}{{template "header" .}}
+{{with .Build}}
+<table>
+ <tr><th>Package</th><td>{{.Package}}</td></tr>
+ <tr><th>Application</th><td>{{if .App}}<a href="/dashboard/app/{{path .App}}">{{.App}}</a>{{end}}</td></tr>
+ <tr><th>By</th><td>{{.User}}{{with .Trigger}} after the {{.}}{{end}}</td></tr>
+ <tr><th>When</th><td>{{when .When}}{{if .Running}} <span class="running">running</span>{{end}}{{if .Interrupted}} <span class="failed">{{.Interrupted}}</span>{{end}}</td></tr>
+ <tr><th>Toolchain</th><td>{{.Toolchain}}</td></tr>
+ {{with .Flags.Tags}}<tr><th>Tags</th><td>{{range .}}{{.}} {{end}}</td></tr>{{end}}
+ {{if .URL}}<tr><th>Files</th><td><a href="{{.URL}}">executable</a> &middot; <a href="/builds/{{path .ID}}.sbom.json">bill of materials</a></td></tr>{{end}}
+</table>
+{{if and .URL $.Instances}}
+<form method="post" action="/dashboard/deploy" onsubmit="return confirm('Deploy {{short .ID}}?')">
+ <input type="hidden" name="app" value="{{.App}}">
+ <input type="hidden" name="package" value="{{.Package}}">
+ <input type="hidden" name="version" value="{{.ID}}">
+ <select name="target">
+  <option value="">every instance</option>
+  {{range $.Instances}}<option value="{{.URL}}">{{.URL}}</option>{{end}}
+ </select>
+ <button>Deploy</button>
+</form>
+{{end}}
+{{if .Findings}}
+<h2>Vulnerabilities</h2>
+<ul>{{range .Findings}}<li class="failed">{{.}}</li>{{end}}</ul>
+{{end}}
+{{end}}
+<h2>Dependencies</h2>
+<table>
+ <tr><th>Repository</th><th>Commit</th></tr>
+ {{range .Versions}}<tr><td>{{index . 0}}</td><td><code>{{index . 1}}</code></td></tr>{{end}}
+</table>
+<h2>Log</h2>
+<pre>{{.Build.Log}}</pre>
+{{template "footer"}}{{end}}
+
+{{define "login"}}{{template "header" .}}
+{{with .Message}}<p class="failed">{{.}}</p>{{end}}
+<form method="post" action="/dashboard/login">
+ <input type="password" name="token" placeholder="token" autofocus>
+ <button>Log in</button>
+</form>
+{{template "footer"}}{{end}}
+
+{{define "message"}}{{template "header" .}}
+<p>{{.Message}}</p>
+<p><a href="javascript:history.back()">Back</a></p>
+{{template "footer"}}{{end}}
+`
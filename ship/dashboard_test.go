@@ -0,0 +1,36 @@
+package ship
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSameOrigin(t *testing.T) {
+	tests := []struct {
+		origin, referer string
+		ok              bool
+	}{
+		{"http://ship.example.com", "", true},
+		{"http://evil.example.com", "", false},
+		{"http://evil.example.com", "http://ship.example.com/dashboard/", false},
+		{"null", "", false},
+		{"", "http://ship.example.com/dashboard/app/a", true},
+		{"", "http://evil.example.com/dashboard/app/a", false},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "http://ship.example.com/dashboard/deploy", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+
+		if test.referer != "" {
+			r.Header.Set("Referer", test.referer)
+		}
+
+		if ok := sameOrigin(r); ok != test.ok {
+			t.Errorf("sameOrigin(%q, %q) = %v, want %v", test.origin, test.referer, ok, test.ok)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package ship
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+type Diff struct {
+	From      string            `json:"from"`
+	To        string            `json:"to"`
+	Package   [2]string         `json:"package"`
+	Toolchain [2]string         `json:"toolchain"`
+	Flags     [2]string         `json:"flags"`
+	Added     map[string]string `json:"added"`
+	Removed   map[string]string `json:"removed"`
+	Changed   []*Change         `json:"changed"`
+}
+
+type Change struct {
+	Repository string    `json:"repository"`
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	Commits    []*Commit `json:"commits"`
+	Reverted   []*Commit `json:"reverted"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func NewDiff(from, to *Builder) (d *Diff) {
+	d = &Diff{
+		From:      from.Name,
+		To:        to.Name,
+		Package:   [2]string{from.Build.Name, to.Build.Name},
+		Toolchain: [2]string{from.Toolchain, to.Toolchain},
+		Flags:     [2]string{from.Build.Flags.String(), to.Build.Flags.String()},
+		Added:     make(map[string]string),
+		Removed:   make(map[string]string),
+	}
+
+	for name, hash := range to.Build.Versions {
+		old, ok := from.Build.Versions[name]
+		switch {
+		case !ok:
+			d.Added[name] = hash
+		case old != hash:
+			d.Changed = append(d.Changed, &Change{
+				Repository: name,
+				From:       old,
+				To:         hash,
+			})
+		}
+	}
+
+	for name, hash := range from.Build.Versions {
+		if _, ok := to.Build.Versions[name]; !ok {
+			d.Removed[name] = hash
+		}
+	}
+
+	sort.Sort(byRepository(d.Changed))
+	return
+}
+
+// Log fills the commits of each changed repository using the mirrors.
+func (d *Diff) Log(m *Mirrors) {
+	for _, c := range d.Changed {
+		err := c.log(m)
+		if err != nil {
+			c.Error = err.Error()
+		}
+	}
+}
+
+func (c *Change) log(m *Mirrors) (err error) {
+	if !m.Has(c.Repository, c.From) || !m.Has(c.Repository, c.To) {
+		if _, err = m.Update(c.Repository); err != nil {
+			return
+		}
+	}
+
+	if c.Commits, err = m.Log(c.Repository, c.From, c.To); err != nil {
+		return
+	}
+
+	c.Reverted, err = m.Log(c.Repository, c.To, c.From)
+	return
+}
+
+func (d *Diff) Print(w io.Writer) {
+	fmt.Fprintf(w, "%s..%s\n", d.From, d.To)
+
+	labels := []string{"package", "toolchain", "flags"}
+	for i, item := range [][2]string{d.Package, d.Toolchain, d.Flags} {
+		if item[0] != item[1] {
+			fmt.Fprintf(w, "%s: '%s' -> '%s'\n", labels[i], item[0], item[1])
+		}
+	}
+
+	for _, name := range sortedKeys(d.Added) {
+		fmt.Fprintf(w, "+ %s %s\n", name, d.Added[name])
+	}
+
+	for _, name := range sortedKeys(d.Removed) {
+		fmt.Fprintf(w, "- %s %s\n", name, d.Removed[name])
+	}
+
+	for _, c := range d.Changed {
+		fmt.Fprintf(w, "~ %s %s..%s\n", c.Repository, short(c.From), short(c.To))
+		if c.Error != "" {
+			fmt.Fprintf(w, "    %s\n", c.Error)
+		}
+
+		for _, item := range c.Commits {
+			fmt.Fprintf(w, "    %s %s (%s)\n", short(item.Hash), item.Subject, item.Author)
+		}
+
+		for _, item := range c.Reverted {
+			fmt.Fprintf(w, "  - %s %s (%s)\n", short(item.Hash), item.Subject, item.Author)
+		}
+	}
+}
+
+type byRepository []*Change
+
+func (b byRepository) Len() int           { return len(b) }
+func (b byRepository) Less(i, j int) bool { return b[i].Repository < b[j].Repository }
+func (b byRepository) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+func sortedKeys(m map[string]string) (result []string) {
+	for key := range m {
+		result = append(result, key)
+	}
+
+	sort.Strings(result)
+	return
+}
+
+func short(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+
+	return hash
+}
@@ -0,0 +1,97 @@
+package ship
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Error is the response of the server when a request fails. It is returned
+// with a matching HTTP status code and decoded by the client functions.
+type Error struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Stage   string `json:"stage,omitempty"`
+	Log     string `json:"log,omitempty"`
+}
+
+const (
+	CodeInvalid      = "invalid"
+	CodeUnauthorized = "unauthorized"
+	CodeForbidden    = "forbidden"
+	CodeNotFound     = "not_found"
+	CodeMethod       = "method_not_allowed"
+	CodeBuildFailed  = "build_failed"
+	CodeCanceled     = "canceled"
+	CodeVulnerable   = "vulnerable"
+	CodeInternal     = "internal"
+	CodeUnavailable  = "unavailable"
+)
+
+func (e *Error) Error() string {
+	if e.Stage == "" {
+		return e.Message
+	}
+
+	return e.Stage + ": " + e.Message
+}
+
+func newError(status int, code, format string, args ...interface{}) *Error {
+	return &Error{
+		Status:  status,
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func invalid(format string, args ...interface{}) *Error {
+	return newError(http.StatusBadRequest, CodeInvalid, format, args...)
+}
+
+func notFound(format string, args ...interface{}) *Error {
+	return newError(http.StatusNotFound, CodeNotFound, format, args...)
+}
+
+// failed marks an error as happening during a stage of a build.
+func failed(stage string, err error) *Error {
+	if e, ok := err.(*Error); ok {
+		if e.Stage == "" {
+			e.Stage = stage
+		}
+
+		return e
+	}
+
+	return &Error{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    CodeBuildFailed,
+		Message: err.Error(),
+		Stage:   stage,
+	}
+}
+
+// writeError replies with the error, unknown errors being internal ones.
+func writeError(w http.ResponseWriter, err error) {
+	e, ok := err.(*Error)
+	if !ok {
+		e = newError(http.StatusInternalServerError, CodeInternal, "%s", err.Error())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// ReadError decodes the error replied by the server along with the status.
+func ReadError(r *http.Response, text []byte) (err *Error) {
+	err = new(Error)
+	if json.Unmarshal(text, err) != nil || err.Code == "" {
+		err = newError(r.StatusCode, CodeInternal, "%s", strings.TrimSpace(string(text)))
+	}
+
+	err.Status = r.StatusCode
+	return
+}
@@ -0,0 +1,290 @@
+package ship
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"sort"
+	"strings"
+)
+
+type Flags struct {
+	Tags    []string          `json:"tags,omitempty"`
+	GCFlags string            `json:"gcflags,omitempty"`
+	LDFlags string            `json:"ldflags,omitempty"`
+	Mode    string            `json:"buildmode,omitempty"`
+	Race    bool              `json:"race,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+}
+
+type Allowlist struct {
+	Tags    []string `json:"tags"`
+	GCFlags []string `json:"gcflags"`
+	LDFlags []string `json:"ldflags"`
+	Modes   []string `json:"modes"`
+	Env     []string `json:"env"`
+	Race    bool     `json:"race"`
+}
+
+// an empty list of tags means any well-formed tag is accepted
+var DefaultAllowlist = &Allowlist{
+	GCFlags: []string{"-N", "-l", "-B"},
+	LDFlags: []string{"-s", "-w", "-X", "-linkmode"},
+	Modes:   []string{"default", "exe", "pie"},
+	Env:     []string{"CGO_ENABLED", "GOOS", "GOARCH", "GOARM", "GO386", "GOAMD64"},
+	Race:    true,
+}
+
+// Context returns the build context matching the flags so that the packages
+// selected on the client are the ones the server will compile.
+func (f *Flags) Context() (result build.Context) {
+	result = build.Default
+	result.BuildTags = append([]string(nil), f.Tags...)
+
+	if value, ok := f.Env["GOOS"]; ok {
+		result.GOOS = value
+	}
+
+	if value, ok := f.Env["GOARCH"]; ok {
+		result.GOARCH = value
+	}
+
+	if value, ok := f.Env["CGO_ENABLED"]; ok {
+		result.CgoEnabled = value == "1"
+	}
+
+	// go build -race also selects the files constrained by the race tag
+	if f.Race {
+		result.BuildTags = append(result.BuildTags, "race")
+		result.InstallSuffix = "race"
+	}
+
+	return
+}
+
+// Args returns the arguments to give to the go tool.
+func (f *Flags) Args() (result []string) {
+	if len(f.Tags) != 0 {
+		result = append(result, "-tags", strings.Join(f.Tags, " "))
+	}
+
+	if f.GCFlags != "" {
+		result = append(result, "-gcflags", f.GCFlags)
+	}
+
+	if f.Mode != "" {
+		result = append(result, "-buildmode", f.Mode)
+	}
+
+	if f.Race {
+		result = append(result, "-race")
+	}
+
+	return
+}
+
+// Environ returns the environment overrides in a sorted KEY=VALUE form.
+func (f *Flags) Environ() (result []string) {
+	for key, value := range f.Env {
+		result = append(result, key+"="+value)
+	}
+
+	sort.Strings(result)
+	return
+}
+
+func (f *Flags) String() string {
+	items := f.Args()
+	if f.LDFlags != "" {
+		items = append(items, "-ldflags", f.LDFlags)
+	}
+
+	return strings.Join(append(f.Environ(), items...), " ")
+}
+
+func (a *Allowlist) Check(f *Flags) (err error) {
+	for _, tag := range f.Tags {
+		if tag == "" || strings.IndexFunc(tag, invalidTag) >= 0 {
+			err = fmt.Errorf("invalid build tag '%s'", tag)
+			return
+		}
+
+		if len(a.Tags) != 0 && !contains(a.Tags, tag) {
+			err = fmt.Errorf("build tag '%s' is not allowed", tag)
+			return
+		}
+	}
+
+	if err = checkFlags("gcflags", f.GCFlags, a.GCFlags); err != nil {
+		return
+	}
+
+	if err = checkFlags("ldflags", f.LDFlags, a.LDFlags); err != nil {
+		return
+	}
+
+	if f.Mode != "" && !contains(a.Modes, f.Mode) {
+		err = fmt.Errorf("build mode '%s' is not allowed", f.Mode)
+		return
+	}
+
+	if f.Race && !a.Race {
+		err = fmt.Errorf("race detector is not allowed")
+		return
+	}
+
+	for key := range f.Env {
+		if !contains(a.Env, key) {
+			err = fmt.Errorf("environment variable '%s' is not allowed", key)
+			return
+		}
+	}
+
+	return
+}
+
+// Identity returns a hash of everything that determines the content of the
+// artifact i.e. the package, the versions of its repositories and its flags.
+func (b *Build) Identity() (result string, err error) {
+	key := struct {
+		Name     string            `json:"package"`
+		Versions map[string]string `json:"versions"`
+		Flags    Flags             `json:"flags"`
+	}{
+		Name:     b.Name,
+		Versions: b.Versions,
+		Flags:    b.Flags,
+	}
+
+	key.Flags.Tags = append([]string(nil), b.Flags.Tags...)
+	sort.Strings(key.Flags.Tags)
+
+	// maps are encoded with sorted keys
+	data, err := json.Marshal(&key)
+	if err != nil {
+		return
+	}
+
+	result = fmt.Sprintf("%x", md5.Sum(data))
+	return
+}
+
+// valueOptions lists the options of the compiler and of the linker followed
+// by a value unless it is given after "=".
+var valueOptions = map[string][]string{
+	"gcflags": {"-D", "-I", "-asmhdr", "-buildid", "-c", "-d", "-importcfg", "-lang", "-o", "-p", "-trimpath"},
+	"ldflags": {"-B", "-E", "-H", "-I", "-L", "-R", "-T", "-X", "-buildid", "-buildmode", "-extar", "-extld", "-extldflags", "-installsuffix", "-libgcc", "-linkmode", "-o", "-pluginpath", "-r", "-tmpdir"},
+}
+
+// checkFlags reads the flags like the go tool, which applies them to the
+// packages matching an optional pattern, and rejects the options missing from
+// the list. Other words are only accepted as the value of the option before.
+func checkFlags(kind, value string, allowed []string) (err error) {
+	if !strings.HasPrefix(value, "-") {
+		if i := strings.Index(value, "="); i >= 0 {
+			value = value[i+1:]
+		}
+	}
+
+	items, err := splitQuoted(value)
+	if err != nil {
+		err = fmt.Errorf("%s: %s", kind, err.Error())
+		return
+	}
+
+	option := false
+	for _, item := range items {
+		if !strings.HasPrefix(item, "-") {
+			if !option {
+				err = fmt.Errorf("%s value '%s' doesn't follow an option", kind, item)
+				return
+			}
+
+			option = false
+			continue
+		}
+
+		name := item
+		if i := strings.Index(name, "="); i >= 0 {
+			name = name[:i]
+		}
+
+		if !contains(allowed, name) {
+			err = fmt.Errorf("%s option '%s' is not allowed", kind, name)
+			return
+		}
+
+		option = name == item && contains(valueOptions[kind], name)
+	}
+
+	return
+}
+
+// splitQuoted splits words separated by spaces, which can be quoted with
+// single or double quotes, as the go tool does for its flags.
+func splitQuoted(s string) (result []string, err error) {
+	for {
+		s = strings.TrimLeft(s, " \t\n\r")
+		if s == "" {
+			return
+		}
+
+		if quote := s[0]; quote == '"' || quote == '\'' {
+			i := strings.IndexByte(s[1:], quote)
+			if i < 0 {
+				err = fmt.Errorf("unterminated %c string", quote)
+				return
+			}
+
+			result = append(result, s[1:i+1])
+			s = s[i+2:]
+			continue
+		}
+
+		i := strings.IndexAny(s, " \t\n\r")
+		if i < 0 {
+			i = len(s)
+		}
+
+		result = append(result, s[:i])
+		s = s[i:]
+	}
+}
+
+// checkPackage rejects the names that aren't import paths, which the go tool
+// could take as options.
+func checkPackage(name string) error {
+	for _, item := range strings.Split(name, "/") {
+		if item == "" || item[0] == '-' || item[0] == '.' || strings.IndexFunc(item, invalidPath) >= 0 {
+			return invalid("invalid package '%s'", name)
+		}
+	}
+
+	return nil
+}
+
+func invalidPath(r rune) bool {
+	return invalidTag(r) && !strings.ContainsRune("-~+", r)
+}
+
+func invalidTag(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return false
+	case r == '_' || r == '.':
+		return false
+	}
+
+	return true
+}
+
+func contains(list []string, item string) bool {
+	for _, value := range list {
+		if value == item {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,99 @@
+package ship
+
+import (
+	"testing"
+)
+
+func TestAllowlistCheck(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags Flags
+		ok    bool
+	}{
+		{"none", Flags{}, true},
+		{"tags", Flags{Tags: []string{"netgo", "osusergo"}}, true},
+		{"empty tag", Flags{Tags: []string{""}}, false},
+		{"invalid tag", Flags{Tags: []string{"a,b"}}, false},
+		{"gcflags", Flags{GCFlags: "-N -l"}, true},
+		{"gcflags not allowed", Flags{GCFlags: "-m"}, false},
+		{"ldflags", Flags{LDFlags: "-s -w -X main.version=1.0"}, true},
+		{"ldflags with value", Flags{LDFlags: "-X=main.version=1.0"}, true},
+		{"extldflags", Flags{LDFlags: "-linkmode external -extldflags -static"}, false},
+		{"extldflags with value", Flags{LDFlags: "-extldflags=-static"}, false},
+		{"quoted ldflags", Flags{LDFlags: `-s -X 'main.version=1.0 beta' -X "main.commit=abc"`}, true},
+		{"pattern", Flags{LDFlags: "all=-s -w", GCFlags: "all=-N -l"}, true},
+		{"extldflags with pattern", Flags{LDFlags: "all=-extldflags=-static"}, false},
+		{"quoted extld", Flags{LDFlags: "-s '-extld=/tmp/evil'"}, false},
+		{"gcflags with pattern", Flags{GCFlags: "all=-m"}, false},
+		{"value without option", Flags{LDFlags: "-s evil"}, false},
+		{"value of an option given with =", Flags{LDFlags: "-X=main.version=1.0 evil"}, false},
+		{"unterminated quote", Flags{LDFlags: "-X 'main.version=1.0"}, false},
+		{"mode", Flags{Mode: "pie"}, true},
+		{"mode not allowed", Flags{Mode: "plugin"}, false},
+		{"race", Flags{Race: true}, true},
+		{"env", Flags{Env: map[string]string{"GOOS": "darwin", "CGO_ENABLED": "0"}}, true},
+		{"env not allowed", Flags{Env: map[string]string{"CC": "evil"}}, false},
+	}
+
+	for _, test := range tests {
+		flags := test.flags
+		if err := DefaultAllowlist.Check(&flags); (err == nil) != test.ok {
+			t.Errorf("%s: Check() = %v", test.name, err)
+		}
+	}
+
+	restricted := &Allowlist{Tags: []string{"netgo"}}
+	if err := restricted.Check(&Flags{Tags: []string{"osusergo"}}); err == nil {
+		t.Error("tag missing from the allowlist was accepted")
+	}
+
+	if err := restricted.Check(&Flags{Race: true}); err == nil {
+		t.Error("race detector was accepted")
+	}
+}
+
+func TestContext(t *testing.T) {
+	f := &Flags{
+		Tags: []string{"netgo"},
+		Env:  map[string]string{"GOOS": "darwin", "GOARCH": "arm64", "CGO_ENABLED": "0"},
+		Race: true,
+	}
+
+	c := f.Context()
+	if c.GOOS != "darwin" || c.GOARCH != "arm64" || c.CgoEnabled {
+		t.Errorf("context is for %s/%s with cgo %v", c.GOOS, c.GOARCH, c.CgoEnabled)
+	}
+
+	if !contains(c.BuildTags, "netgo") || !contains(c.BuildTags, "race") {
+		t.Errorf("context has tags %v, want netgo and race", c.BuildTags)
+	}
+
+	if len(f.Tags) != 1 {
+		t.Errorf("context changed the tags of the flags to %v", f.Tags)
+	}
+}
+
+func TestCheckPackage(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"example.com/a/cmd/x", true},
+		{"github.com/a/b-c/v2/cmd/x_y", true},
+		{"x", true},
+		{"", false},
+		{"-toolexec=/bin/sh", false},
+		{"example.com/a/-x", false},
+		{"example.com/../x", false},
+		{"example.com/a/", false},
+		{"/example.com/a", false},
+		{"example.com/a b", false},
+		{"example.com/a;b", false},
+	}
+
+	for _, test := range tests {
+		if err := checkPackage(test.name); (err == nil) != test.ok {
+			t.Errorf("checkPackage(%q) = %v", test.name, err)
+		}
+	}
+}
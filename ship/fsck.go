@@ -0,0 +1,203 @@
+package ship
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Fsck checks the data directory of a stopped server and repairs it. Damaged
+// files are moved to the quarantine directory and the records of builds that
+// can't be deployed are dropped. It returns the problems found, which were
+// all repaired unless an error is returned.
+func Fsck(root string) (problems []string, err error) {
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	// the store is locked first so that a running server is left alone
+	store, err := OpenStore(path.Join(root, "state.db"))
+	if err != nil {
+		return
+	}
+
+	defer store.Close()
+
+	builds := path.Join(root, "builds")
+	entries, err := readDir(builds)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if name := entry.Name(); entry.IsDir() || strings.HasSuffix(name, ".tmp") {
+			if err = os.RemoveAll(path.Join(builds, name)); err != nil {
+				return
+			}
+
+			report("removed interrupted build %s", name)
+		}
+	}
+
+	if store.Quarantined != 0 {
+		report("quarantined %d damaged records of state.db", store.Quarantined)
+	}
+
+	err = store.Update(func(tx *Tx) (err error) {
+		records := []struct {
+			bucket string
+			item   func() interface{}
+		}{
+			{"builders", func() interface{} { return new(Builder) }},
+			{"builds", func() interface{} { return new(Build) }},
+			{"deploys", func() interface{} { return new(Deploy) }},
+			{"apps", func() interface{} { return new(App) }},
+		}
+
+		for _, r := range records {
+			bucket := r.bucket
+			for _, key := range tx.Keys(bucket, "") {
+				if _, e := tx.Get(bucket, key, r.item()); e != nil {
+					report("dropped %s %s: %s", bucket, key, e.Error())
+					if err = tx.Delete(bucket, key); err != nil {
+						return
+					}
+				}
+			}
+		}
+
+		for _, name := range tx.Keys("builders", "") {
+			filename := path.Join(builds, name+".gz")
+			if e := checkExecutable(filename); e != nil {
+				report("dropped build %s: %s", name, e.Error())
+				if err = tx.Delete("builders", name); err != nil {
+					return
+				}
+
+				if _, e := os.Stat(filename); e == nil {
+					if _, err = quarantine(root, filename); err != nil {
+						return
+					}
+				}
+
+				continue
+			}
+
+			filename = path.Join(builds, name+".sbom.json")
+			if e := checkJSON(filename); e != nil {
+				report("quarantined bill of materials of build %s: %s", name, e.Error())
+				if _, err = quarantine(root, filename); err != nil {
+					return
+				}
+			}
+		}
+
+		// drop the index entries of the records removed above
+		dangling := 0
+		for _, bucket := range tx.Buckets("index:") {
+			items := strings.Split(bucket, ":")[1]
+			for _, key := range tx.Keys(bucket, "") {
+				target := key[strings.Index(key, "\x00")+1:]
+				if items == "builders" {
+					target = path.Base(target)
+				}
+
+				if _, ok := tx.get(items, target); ok {
+					continue
+				}
+
+				if err = tx.Delete(bucket, key); err != nil {
+					return
+				}
+
+				dangling++
+			}
+		}
+
+		if dangling != 0 {
+			report("dropped %d index entries of missing records", dangling)
+		}
+
+		aliases := 0
+		for _, job := range tx.Keys("aliases", "") {
+			var name string
+			if _, e := tx.Get("aliases", job, &name); e == nil {
+				if _, ok := tx.get("builders", name); ok {
+					continue
+				}
+			}
+
+			if err = tx.Delete("aliases", job); err != nil {
+				return
+			}
+
+			aliases++
+		}
+
+		if aliases != 0 {
+			report("dropped %d aliases of missing builds", aliases)
+		}
+
+		return
+	})
+
+	return
+}
+
+// checkExecutable reads a saved build entirely to verify that its checksum
+// is the name of the build.
+func checkExecutable(filename string) (err error) {
+	err = verifyArtifact(filename, strings.TrimSuffix(path.Base(filename), ".gz"))
+	if os.IsNotExist(err) {
+		err = fmt.Errorf("executable is missing")
+	}
+
+	return
+}
+
+// checkJSON verifies that a file, if present, holds a JSON document.
+func checkJSON(filename string) (err error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	var value interface{}
+	err = json.Unmarshal(data, &value)
+	return
+}
+
+// quarantine moves a damaged file of the data directory to the quarantine
+// directory, where it keeps its relative path.
+func quarantine(root, filename string) (target string, err error) {
+	name, e := filepath.Rel(root, filename)
+	if e != nil || strings.HasPrefix(name, "..") {
+		name = path.Base(filename)
+	}
+
+	target = path.Join(root, "quarantine", name)
+	if err = os.MkdirAll(path.Dir(target), 0755); err != nil {
+		return
+	}
+
+	err = os.Rename(filename, target)
+	return
+}
+
+func (s *Server) quarantine(filename string, reason error) {
+	target, err := quarantine(s.Root, filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("%s: %s, moved to %s", filename, reason.Error(), target)
+}
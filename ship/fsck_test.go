@@ -0,0 +1,52 @@
+package ship
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCheckExecutable(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("executable")
+	name := fmt.Sprintf("%x", md5.Sum(content))
+
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	w.Write(content)
+	w.Close()
+
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{name, compressed.Bytes(), true},
+		{"0123456789abcdef0123456789abcdef", compressed.Bytes(), false},
+		{name, content, false},
+		{name, compressed.Bytes()[:compressed.Len()-4], false},
+	}
+
+	for i, test := range tests {
+		filename := path.Join(dir, fmt.Sprint(i), test.name+".gz")
+		if err := os.MkdirAll(path.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := writeFile(filename, test.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := checkExecutable(filename); (err == nil) != test.ok {
+			t.Errorf("checkExecutable(%d) = %v", i, err)
+		}
+	}
+
+	if err := checkExecutable(path.Join(dir, name+".gz")); err == nil {
+		t.Error("missing executable was accepted")
+	}
+}
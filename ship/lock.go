@@ -0,0 +1,105 @@
+package ship
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// Lock captures everything needed to reproduce a build without having the
+// repositories checked out locally.
+type Lock struct {
+	Name     string            `json:"package"`
+	Filename string            `json:"file"`
+	User     string            `json:"by,omitempty"`
+	Versions map[string]string `json:"versions"`
+	Flags    Flags             `json:"flags"`
+}
+
+func NewLock(command, wd string, flags Flags) (result *Lock, err error) {
+	b, err := NewBuild(command, wd, flags)
+	if err != nil {
+		return
+	}
+
+	result = &Lock{
+		Name:     b.Name,
+		Filename: b.Filename,
+		Versions: b.Versions,
+		Flags:    b.Flags,
+	}
+
+	return
+}
+
+func ReadLock(filename string) (result *Lock, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+
+	result = new(Lock)
+	if err = json.Unmarshal(data, result); err != nil {
+		err = fmt.Errorf("%s: %s", filename, err.Error())
+		return
+	}
+
+	err = result.check()
+	return
+}
+
+func (l *Lock) check() (err error) {
+	if l.Name == "" || len(l.Versions) == 0 {
+		err = fmt.Errorf("lock must specify a package and its versions")
+		return
+	}
+
+	if l.Filename == "" {
+		l.Filename = path.Base(l.Name)
+	}
+
+	return
+}
+
+func (l *Lock) Write(filename string) (err error) {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return
+	}
+
+	f, err := ioutil.TempFile(path.Dir(filename), path.Base(filename)+"-")
+	if err != nil {
+		return
+	}
+
+	_, err = f.Write(append(data, '\n'))
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return
+	}
+
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		return
+	}
+
+	err = os.Rename(f.Name(), filename)
+	return
+}
+
+func (l *Lock) Build() *Build {
+	return &Build{
+		Name:     l.Name,
+		Filename: l.Filename,
+		User:     l.User,
+		Versions: l.Versions,
+		Flags:    l.Flags,
+	}
+}
+
+func (l *Lock) Deploy(targets []string) (result *Deploy, err error) {
+	result, err = newDeploy(l.Name, l.Filename, targets)
+	return
+}
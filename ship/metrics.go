@@ -0,0 +1,340 @@
+package ship
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metric is a family of samples in the text format of Prometheus.
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	samples map[string]*sample
+}
+
+type sample struct {
+	values []string
+	value  float64
+	counts []uint64
+	sum    float64
+}
+
+// metrics are the measurements of the server exposed at /metrics.
+type metrics struct {
+	builds        *metric
+	buildDuration *metric
+	stageDuration *metric
+	artifactSize  *metric
+	deploys       *metric
+	deployHosts   *metric
+	deployTime    *metric
+}
+
+var (
+	durationBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200}
+	sizeBuckets     = []float64{1 << 20, 4 << 20, 16 << 20, 32 << 20, 64 << 20, 128 << 20, 256 << 20}
+)
+
+func newMetrics() *metrics {
+	return &metrics{
+		builds: &metric{
+			name:   "goship_builds_total",
+			help:   "Builds by package and result.",
+			kind:   "counter",
+			labels: []string{"package", "result"},
+		},
+		buildDuration: &metric{
+			name:    "goship_build_duration_seconds",
+			help:    "Duration of the builds by package and result.",
+			kind:    "histogram",
+			labels:  []string{"package", "result"},
+			buckets: durationBuckets,
+		},
+		stageDuration: &metric{
+			name:    "goship_build_stage_duration_seconds",
+			help:    "Duration of the stages of the builds, such as checkout for cloning the repositories.",
+			kind:    "histogram",
+			labels:  []string{"stage"},
+			buckets: durationBuckets,
+		},
+		artifactSize: &metric{
+			name:    "goship_artifact_size_bytes",
+			help:    "Size of the compressed executables built by package.",
+			kind:    "histogram",
+			labels:  []string{"package"},
+			buckets: sizeBuckets,
+		},
+		deploys: &metric{
+			name:   "goship_deploys_total",
+			help:   "Deployments by application and result.",
+			kind:   "counter",
+			labels: []string{"app", "result"},
+		},
+		deployHosts: &metric{
+			name:   "goship_deploy_hosts_total",
+			help:   "Updates of instances by application, host and result.",
+			kind:   "counter",
+			labels: []string{"app", "host", "result"},
+		},
+		deployTime: &metric{
+			name:    "goship_deploy_duration_seconds",
+			help:    "Duration of the deployments by application.",
+			kind:    "histogram",
+			labels:  []string{"app"},
+			buckets: durationBuckets,
+		},
+	}
+}
+
+func (m *metrics) list() []*metric {
+	return []*metric{m.builds, m.buildDuration, m.stageDuration, m.artifactSize, m.deploys, m.deployHosts, m.deployTime}
+}
+
+// with returns the sample of the label values.
+func (m *metric) with(values ...string) (result *sample) {
+	if m.samples == nil {
+		m.samples = make(map[string]*sample)
+	}
+
+	key := strings.Join(values, "\x00")
+	if result = m.samples[key]; result == nil {
+		result = &sample{
+			values: values,
+			counts: make([]uint64, len(m.buckets)),
+		}
+
+		m.samples[key] = result
+	}
+
+	return
+}
+
+func (m *metric) add(v float64, values ...string) {
+	m.with(values...).value += v
+}
+
+func (m *metric) set(v float64, values ...string) {
+	m.with(values...).value = v
+}
+
+func (m *metric) observe(v float64, values ...string) {
+	item := m.with(values...)
+	for i, bound := range m.buckets {
+		if v <= bound {
+			item.counts[i]++
+		}
+	}
+
+	item.value++
+	item.sum += v
+}
+
+func (m *metric) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+	keys := make([]string, 0, len(m.samples))
+	for key := range m.samples {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		item := m.samples[key]
+		labels := m.format(item.values)
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labels, number(item.value))
+			continue
+		}
+
+		for i, bound := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.format(item.values, number(bound)), item.counts[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %s\n", m.name, m.format(item.values, "+Inf"), number(item.value))
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, number(item.sum))
+		fmt.Fprintf(w, "%s_count%s %s\n", m.name, labels, number(item.value))
+	}
+}
+
+// format returns the labels of a sample, followed by the bound of a bucket.
+func (m *metric) format(values []string, le ...string) string {
+	names := m.labels
+	if len(le) != 0 {
+		names = append(names[:len(names):len(names)], "le")
+		values = append(values[:len(values):len(values)], le...)
+	}
+
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=\"" + labelEscaper.Replace(values[i]) + "\""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func number(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// measureBuild records the outcome of a build.
+func (s *Server) measureBuild(b *Builder, err error) {
+	result := "ok"
+	if e, ok := err.(*Error); ok && e.Code == CodeCanceled {
+		result = "canceled"
+	} else if err != nil {
+		result = "failed"
+	}
+
+	size := int64(-1)
+	if err == nil {
+		if info, e := os.Stat(path.Join(b.Root, b.Name+".gz")); e == nil {
+			size = info.Size()
+		}
+	}
+
+	duration := time.Since(b.Build.When).Seconds()
+	s.feed <- func() {
+		s.metrics.builds.add(1, b.Build.Name, result)
+		s.metrics.buildDuration.observe(duration, b.Build.Name, result)
+		for name, d := range b.durations {
+			s.metrics.stageDuration.observe(d.Seconds(), name)
+		}
+
+		if size >= 0 {
+			s.metrics.artifactSize.observe(float64(size), b.Build.Name)
+		}
+	}
+}
+
+// measureDeploy records the outcome of a deployment on each host.
+func (s *Server) measureDeploy(d *Deploy, r *DeployResult) {
+	s.feed <- func() {
+		result := "ok"
+		for _, h := range r.Hosts {
+			item := "ok"
+			if !h.OK {
+				item, result = "failed", "failed"
+			}
+
+			s.metrics.deployHosts.add(1, d.Filename, h.Host, item)
+		}
+
+		s.metrics.deploys.add(1, d.Filename, result)
+		s.metrics.deployTime.observe(r.Duration, d.Filename)
+	}
+}
+
+// writeMetrics writes the metrics of the server along with the state of its
+// builds, instances, webhooks and workers.
+func (s *Server) writeMetrics(w io.Writer) {
+	s.once.Do(s.initialize)
+
+	running := &metric{
+		name: "goship_builds_running",
+		help: "Builds in progress.",
+		kind: "gauge",
+	}
+
+	stored := &metric{
+		name: "goship_builds_stored",
+		help: "Builds that can be deployed.",
+		kind: "gauge",
+	}
+
+	instances := &metric{
+		name:   "goship_instances",
+		help:   "Registered instances by application.",
+		kind:   "gauge",
+		labels: []string{"app"},
+	}
+
+	queued := &metric{
+		name:   "goship_webhook_queue_length",
+		help:   "Events waiting to be sent by webhook.",
+		kind:   "gauge",
+		labels: []string{"url"},
+	}
+
+	queue := &metric{
+		name: "goship_build_queue_length",
+		help: "Builds waiting for a worker.",
+		kind: "gauge",
+	}
+
+	workers := &metric{
+		name:   "goship_workers",
+		help:   "Live workers by platform.",
+		kind:   "gauge",
+		labels: []string{"goos", "goarch"},
+	}
+
+	for _, h := range s.Webhooks {
+		queued.set(float64(len(h.queue)), h.URL)
+	}
+
+	// don't hold the state of the server while writing to the client
+	b := &bytes.Buffer{}
+	s.call(func() {
+		running.set(float64(len(s.running)))
+		stored.set(float64(len(s.Builders)))
+		for name, items := range s.apps {
+			instances.set(float64(len(items)), name)
+		}
+
+		queue.set(float64(len(s.queue)))
+		for _, w := range s.workers {
+			if time.Since(w.Seen) < WorkerTimeout {
+				workers.add(1, w.GOOS, w.GOARCH)
+			}
+		}
+
+		for _, m := range s.metrics.list() {
+			m.write(b)
+		}
+	})
+
+	for _, m := range []*metric{running, stored, instances, queued, queue, workers} {
+		m.write(b)
+	}
+
+	b.WriteTo(w)
+}
+
+func (s *Server) startMetrics() {
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeError(w, newError(http.StatusMethodNotAllowed, CodeMethod, "method not allowed"))
+			return
+		}
+
+		if _, ok := s.authenticate(w, r); !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.writeMetrics(w)
+	})
+}
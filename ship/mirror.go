@@ -0,0 +1,186 @@
+package ship
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Mirrors keeps a bare mirror of every repository used by builds so that
+// checkouts don't have to go over the network and history can be inspected.
+type Mirrors struct {
+	Root string
+
+	lock  sync.Mutex
+	repos map[string]*sync.Mutex
+}
+
+type Commit struct {
+	Hash    string `json:"hash"`
+	Author  string `json:"author"`
+	Subject string `json:"subject"`
+}
+
+var commitHash = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// checkRepository rejects the names of repositories that would reach outside
+// the mirrors or be taken as options by git.
+func checkRepository(name string) error {
+	if name == "" || strings.HasPrefix(name, "-") || strings.Contains(name, "..") {
+		return invalid("invalid repository '%s'", name)
+	}
+
+	return nil
+}
+
+// checkRef rejects the references that would be taken as options by git.
+func checkRef(ref string) error {
+	if strings.HasPrefix(ref, "-") {
+		return invalid("invalid reference '%s'", ref)
+	}
+
+	return nil
+}
+
+// checkVersions makes sure that the versions sent by a client name
+// repositories and commits.
+func checkVersions(versions map[string]string) (err error) {
+	for name, hash := range versions {
+		if err = checkRepository(name); err != nil {
+			return
+		}
+
+		if !commitHash.MatchString(hash) {
+			err = invalid("version of '%s' must be a commit hash instead of '%s'", name, hash)
+			return
+		}
+	}
+
+	return
+}
+
+// remote returns the URL of a repository from its name e.g. github.com/a/b.
+func remote(name string) string {
+	return "git@" + strings.Replace(name, "/", ":", 1) + ".git"
+}
+
+func (m *Mirrors) get(name string) *sync.Mutex {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.repos == nil {
+		m.repos = make(map[string]*sync.Mutex)
+	}
+
+	l, ok := m.repos[name]
+	if !ok {
+		l = new(sync.Mutex)
+		m.repos[name] = l
+	}
+
+	return l
+}
+
+func (m *Mirrors) Path(name string) string {
+	return path.Join(m.Root, name+".git")
+}
+
+// Update creates or refreshes the mirror of a repository.
+func (m *Mirrors) Update(name string) (dir string, err error) {
+	if err = checkRepository(name); err != nil {
+		return
+	}
+
+	l := m.get(name)
+	l.Lock()
+	defer l.Unlock()
+
+	dir = m.Path(name)
+
+	_, err = os.Stat(dir)
+	switch {
+	case err == nil:
+		_, err = git(dir, "remote", "update", "--prune")
+
+	case os.IsNotExist(err):
+		if err = os.MkdirAll(path.Dir(dir), 0755); err != nil {
+			return
+		}
+
+		_, err = git(path.Dir(dir), "clone", "-q", "--mirror", remote(name), dir)
+	}
+
+	return
+}
+
+// Has reports whether the mirror of a repository knows about a commit.
+func (m *Mirrors) Has(name, hash string) bool {
+	_, err := git(m.Path(name), "cat-file", "-e", hash+"^{commit}")
+	return err == nil
+}
+
+// Resolve returns the commit of a branch, tag or commit of a repository or of
+// its default branch when no reference is given.
+func (m *Mirrors) Resolve(name, ref string) (hash string, err error) {
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	output, err := git(m.Path(name), "rev-parse", "--verify", "--quiet", "--end-of-options", ref+"^{commit}")
+	if err != nil {
+		err = fmt.Errorf("unknown reference '%s' in '%s'", ref, name)
+		return
+	}
+
+	hash = strings.TrimSpace(string(output))
+	return
+}
+
+// Log returns the commits reachable from one version but not the other.
+func (m *Mirrors) Log(name, from, to string) (result []*Commit, err error) {
+	if err = checkRepository(name); err != nil {
+		return
+	}
+
+	output, err := git(m.Path(name), "log", "--format=%H%x00%an <%ae>%x00%s", "--end-of-options", from+".."+to)
+	if err != nil {
+		return
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		items := strings.SplitN(line, "\x00", 3)
+		if len(items) != 3 {
+			continue
+		}
+
+		result = append(result, &Commit{
+			Hash:    items[0],
+			Author:  items[1],
+			Subject: items[2],
+		})
+	}
+
+	return
+}
+
+func git(dir string, args ...string) (result []byte, err error) {
+	output := &bytes.Buffer{}
+	errors := &bytes.Buffer{}
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stdout = output
+	cmd.Stderr = errors
+	if err = cmd.Run(); err != nil {
+		err = fmt.Errorf("git %s\n%s%s", strings.Join(args, " "), errors.String(), err.Error())
+		return
+	}
+
+	result = output.Bytes()
+	return
+}
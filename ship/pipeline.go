@@ -0,0 +1,532 @@
+package ship
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PipelineInterval is the time between two checks of the gates of the
+// pipelines.
+var PipelineInterval = 30 * time.Second
+
+// Pipeline promotes the builds of an application through ordered stages.
+type Pipeline struct {
+	App     string   `json:"app"`
+	Package string   `json:"package"`
+	Stages  []*Stage `json:"stages"`
+}
+
+// Stage is an environment made of the instances matching its targets. A build
+// enters it once approved or, without approval, once it ran on the previous
+// stage for the soak time with every instance healthy. The first stage
+// receives the new builds of the package unless it requires approval.
+type Stage struct {
+	Name     string   `json:"name"`
+	Targets  []string `json:"targets"`
+	Soak     string   `json:"soak"`
+	Approval bool     `json:"approval"`
+
+	soak time.Duration
+}
+
+// States of the promotions.
+const (
+	PromotionApproved = "approved"
+	PromotionDeployed = "deployed"
+	PromotionFailed   = "failed"
+)
+
+// Promotion records a build entering a stage of a pipeline.
+type Promotion struct {
+	App     string        `json:"app"`
+	Build   string        `json:"build"`
+	Stage   string        `json:"stage"`
+	State   string        `json:"state"`
+	User    string        `json:"by"`
+	When    time.Time     `json:"when"`
+	Message string        `json:"message,omitempty"`
+	Hosts   []*HostResult `json:"hosts,omitempty"`
+}
+
+// Approval allows a build to enter a stage requiring approval.
+type Approval struct {
+	App   string `json:"app"`
+	Stage string `json:"stage"`
+	Build string `json:"build"`
+	User  string `json:"by"`
+}
+
+// PipelineStatus tells where the builds of an application stand.
+type PipelineStatus struct {
+	App     string         `json:"app"`
+	Package string         `json:"package"`
+	Stages  []*StageStatus `json:"stages"`
+}
+
+// StageStatus gives the last build deployed on a stage, the last one that
+// failed to since then and the next one with the reason it is waiting.
+type StageStatus struct {
+	Name    string     `json:"name"`
+	Current *Promotion `json:"current,omitempty"`
+	Failed  *Promotion `json:"failed,omitempty"`
+	Next    string     `json:"next,omitempty"`
+	Waiting string     `json:"waiting,omitempty"`
+}
+
+type PromotionPage struct {
+	Promotions []*Promotion `json:"promotions"`
+	Next       string       `json:"next,omitempty"`
+}
+
+func (p *Promotion) key() string {
+	return p.App + "/" + p.Stage + "/" + p.Build
+}
+
+func (p *Pipeline) stage(name string) (int, *Stage) {
+	for i, item := range p.Stages {
+		if item.Name == name {
+			return i, item
+		}
+	}
+
+	return -1, nil
+}
+
+// history is the promotions of a pipeline.
+type history []*Promotion
+
+func (h history) find(stage, build string) *Promotion {
+	for _, p := range h {
+		if p.Stage == stage && p.Build == build {
+			return p
+		}
+	}
+
+	return nil
+}
+
+func (h history) latest(stage, state string) (result *Promotion) {
+	for _, p := range h {
+		if p.Stage == stage && p.State == state && (result == nil || p.When.After(result.When)) {
+			result = p
+		}
+	}
+
+	return
+}
+
+// startPipelines checks the pipelines and starts promoting builds.
+func (s *Server) startPipelines() (err error) {
+	apps := make(map[string]bool)
+	for _, p := range s.Pipelines {
+		if p.App == "" || p.Package == "" || len(p.Stages) == 0 {
+			err = fmt.Errorf("pipeline needs an application, a package and stages")
+			return
+		}
+
+		if apps[p.App] {
+			err = fmt.Errorf("several pipelines for '%s'", p.App)
+			return
+		}
+
+		apps[p.App] = true
+		for _, stage := range p.Stages {
+			if stage.Soak != "" {
+				if stage.soak, err = time.ParseDuration(stage.Soak); err != nil {
+					err = fmt.Errorf("stage '%s' of '%s': %s", stage.Name, p.App, err.Error())
+					return
+				}
+			}
+		}
+	}
+
+	s.started = time.Now().UTC()
+	s.wake = make(chan struct{}, 1)
+
+	s.tasks.Add(1)
+	go func() {
+		defer s.tasks.Done()
+		for !s.draining() {
+			s.advance()
+
+			select {
+			case <-s.wake:
+			case <-time.After(PipelineInterval):
+			case <-s.quit:
+			}
+		}
+	}()
+
+	return
+}
+
+func (s *Server) pipeline(app string) *Pipeline {
+	for _, p := range s.Pipelines {
+		if p.App == app {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// history returns the promotions whose key starts with the prefix.
+func (s *Server) history(prefix string) (result history, err error) {
+	err = s.store.View(func(tx *Tx) (err error) {
+		for _, key := range tx.Keys("promotions", prefix) {
+			p := new(Promotion)
+			if _, err = tx.Get("promotions", key, p); err != nil {
+				return
+			}
+
+			result = append(result, p)
+		}
+
+		return
+	})
+
+	return
+}
+
+func (s *Server) savePromotion(p *Promotion) {
+	s.update(func(tx *Tx) error {
+		return tx.Put("promotions", p.key(), p)
+	})
+}
+
+// newest returns the latest build of a package.
+func (s *Server) newest(name string) (result *Builder, err error) {
+	err = s.store.View(func(tx *Tx) (err error) {
+		keys := tx.Lookup("builders", "package", name)
+		if len(keys) == 0 {
+			return
+		}
+
+		b := new(Builder)
+		if _, err = tx.Get("builders", path.Base(keys[len(keys)-1]), b); err == nil {
+			result = b
+		}
+
+		return
+	})
+
+	return
+}
+
+// advance promotes the builds whose gates are open.
+func (s *Server) advance() {
+	var status []*PipelineStatus
+	for _, p := range s.Pipelines {
+		item, err := s.advancePipeline(p)
+		if err != nil {
+			log.Printf("pipeline of %s: %s", p.App, err.Error())
+			continue
+		}
+
+		status = append(status, item)
+	}
+
+	s.call(func() {
+		s.pipelines = status
+	})
+}
+
+func (s *Server) advancePipeline(p *Pipeline) (result *PipelineStatus, err error) {
+	result = &PipelineStatus{
+		App:     p.App,
+		Package: p.Package,
+	}
+
+	for i, stage := range p.Stages {
+		h, err := s.history(p.App + "/")
+		if err != nil {
+			return nil, err
+		}
+
+		item := &StageStatus{
+			Name: stage.Name,
+		}
+
+		result.Stages = append(result.Stages, item)
+
+		// the build ready to enter the stage and since when
+		var since time.Time
+		if i == 0 {
+			b, err := s.newest(p.Package)
+			if err != nil {
+				return nil, err
+			}
+
+			if b != nil && (stage.Approval || b.Build.When.After(s.started)) {
+				item.Next, since = b.Name, b.Build.When
+			}
+		} else if previous := h.latest(p.Stages[i-1].Name, PromotionDeployed); previous != nil {
+			item.Next, since = previous.Build, previous.When
+		}
+
+		if done := h.find(stage.Name, item.Next); done != nil && done.State != PromotionApproved {
+			item.Next = ""
+		}
+
+		if item.Next != "" && !stage.Approval && i != 0 {
+			item.Waiting = s.soaked(p, i, item.Next, since)
+		}
+
+		switch approved := h.latest(stage.Name, PromotionApproved); {
+		case approved != nil:
+			s.promote(p, stage, approved)
+			item.Next = ""
+		case item.Next == "" || item.Waiting != "":
+		case stage.Approval:
+			item.Waiting = "waiting for approval"
+		default:
+			s.promote(p, stage, &Promotion{
+				App:   p.App,
+				Build: item.Next,
+				Stage: stage.Name,
+				User:  "pipeline",
+			})
+
+			item.Next = ""
+		}
+
+		if h, err = s.history(p.App + "/"); err != nil {
+			return nil, err
+		}
+
+		item.Current = h.latest(stage.Name, PromotionDeployed)
+		if last := h.latest(stage.Name, PromotionFailed); last != nil && (item.Current == nil || last.When.After(item.Current.When)) {
+			item.Failed = last
+		}
+	}
+
+	return
+}
+
+// soaked tells why a build deployed on the previous stage can't enter the
+// stage yet.
+func (s *Server) soaked(p *Pipeline, i int, build string, since time.Time) string {
+	previous := p.Stages[i-1]
+	if until := since.Add(p.Stages[i].soak); time.Now().Before(until) {
+		return "soaking on " + previous.Name + " until " + until.Local().Format(time.Stamp)
+	}
+
+	return s.healthy(p.App, previous, build)
+}
+
+// healthy tells why the instances of a stage are not all running a build.
+func (s *Server) healthy(app string, stage *Stage, build string) string {
+	instances, err := s.Status(app)
+	if err != nil {
+		return err.Error()
+	}
+
+	found := false
+	for _, item := range instances {
+		if !matches(item.Host, stage.Targets) {
+			continue
+		}
+
+		if !item.OK {
+			return fmt.Sprintf("%s is unhealthy: %s", item.Host, item.Message)
+		}
+
+		if item.Version != build {
+			return fmt.Sprintf("%s runs %s", item.Host, item.Version)
+		}
+
+		found = true
+	}
+
+	if !found {
+		return "no instance of " + stage.Name + " is registered"
+	}
+
+	return ""
+}
+
+func matches(host string, targets []string) bool {
+	for _, item := range targets {
+		if strings.Contains(host, item) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// promote deploys a build on a stage and records the outcome.
+func (s *Server) promote(p *Pipeline, stage *Stage, item *Promotion) {
+	d := &Deploy{
+		Name:     p.Package,
+		Filename: p.App,
+		User:     item.User,
+		Version:  item.Build,
+		Targets:  stage.Targets,
+	}
+
+	log.Printf("promoting %s of %s to %s", item.Build, p.App, stage.Name)
+
+	// instances shared with another stage may already run the build
+	if s.healthy(p.App, stage, item.Build) == "" {
+		item.State, item.Message = PromotionDeployed, "already running"
+		item.When = time.Now().UTC()
+		s.savePromotion(item)
+		return
+	}
+
+	result, err := s.makeDeploy(ioutil.Discard, d)
+
+	// approvals are kept for the next start of the server
+	if e, ok := err.(*Error); ok && e.Code == CodeUnavailable {
+		return
+	}
+
+	switch {
+	case err != nil:
+		item.State, item.Message = PromotionFailed, err.Error()
+	case len(result.Hosts) == 0:
+		item.State, item.Message = PromotionFailed, "no instance matches the targets"
+	case result.Failed() != 0:
+		item.State, item.Message = PromotionFailed, fmt.Sprintf("%d of %d hosts were not updated", result.Failed(), len(result.Hosts))
+	default:
+		item.State, item.Message = PromotionDeployed, ""
+	}
+
+	if result != nil {
+		item.Hosts = result.Hosts
+	}
+
+	item.When = time.Now().UTC()
+	s.savePromotion(item)
+}
+
+// approve lets a build enter a stage once it passed the previous one.
+func (s *Server) approve(a *Approval) (result *Promotion, err error) {
+	s.once.Do(s.initialize)
+
+	p := s.pipeline(a.App)
+	if p == nil {
+		err = notFound("no pipeline for '%s'", a.App)
+		return
+	}
+
+	i, stage := p.stage(a.Stage)
+	if stage == nil {
+		err = notFound("no stage '%s' in the pipeline of '%s'", a.Stage, a.App)
+		return
+	}
+
+	if !stage.Approval {
+		err = invalid("stage '%s' doesn't require approval", a.Stage)
+		return
+	}
+
+	b, ok := s.builder(a.Build)
+	if !ok || b.Build == nil || b.Build.Name != p.Package {
+		err = notFound("no build '%s' of '%s'", a.Build, p.Package)
+		return
+	}
+
+	if i != 0 {
+		h, e := s.history(a.App + "/")
+		if e != nil {
+			err = e
+			return
+		}
+
+		previous := p.Stages[i-1].Name
+		if done := h.find(previous, a.Build); done == nil || done.State != PromotionDeployed {
+			err = invalid("build '%s' was not deployed on '%s'", a.Build, previous)
+			return
+		}
+	}
+
+	result = &Promotion{
+		App:   a.App,
+		Build: a.Build,
+		Stage: a.Stage,
+		State: PromotionApproved,
+		User:  a.User,
+		When:  time.Now().UTC(),
+	}
+
+	s.savePromotion(result)
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	return
+}
+
+func (s *Server) builder(id string) (result *Builder, ok bool) {
+	s.call(func() {
+		result, ok = s.Builders[id]
+	})
+
+	return
+}
+
+// PipelineStatus returns where the builds of every pipeline stand.
+func (s *Server) PipelineStatus() (result []*PipelineStatus) {
+	s.once.Do(s.initialize)
+
+	s.call(func() {
+		result = s.pipelines
+	})
+
+	if result == nil {
+		result = []*PipelineStatus{}
+	}
+
+	return
+}
+
+// QueryPromotions returns the promotions matching the application, user and
+// time of the query, starting with the most recent.
+func (s *Server) QueryPromotions(q *Query) (result *PromotionPage, err error) {
+	s.once.Do(s.initialize)
+
+	result = &PromotionPage{
+		Promotions: []*Promotion{},
+	}
+
+	prefix := ""
+	if q.App != "" {
+		prefix = q.App + "/"
+	}
+
+	h, err := s.history(prefix)
+	if err != nil {
+		return
+	}
+
+	// page through the promotions in chronological order
+	items := make(map[string]*Promotion)
+	keys := []string{}
+	for _, p := range h {
+		if q.User != "" && p.User != q.User || !q.during(p.When) {
+			continue
+		}
+
+		key := timeKey(p.When) + "/" + p.key()
+		items[key] = p
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	result.Next, err = q.paginate(keys, true, func(key string) (bool, error) {
+		result.Promotions = append(result.Promotions, items[key])
+		return true, nil
+	})
+
+	return
+}
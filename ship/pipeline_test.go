@@ -0,0 +1,177 @@
+package ship
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartPipelines(t *testing.T) {
+	stages := []*Stage{{Name: "dev"}}
+
+	tests := []struct {
+		name      string
+		pipelines []*Pipeline
+	}{
+		{"no application", []*Pipeline{{Package: "example.com/x", Stages: stages}}},
+		{"no package", []*Pipeline{{App: "x", Stages: stages}}},
+		{"no stages", []*Pipeline{{App: "x", Package: "example.com/x"}}},
+		{"duplicate", []*Pipeline{{App: "x", Package: "example.com/x", Stages: stages}, {App: "x", Package: "example.com/y", Stages: stages}}},
+		{"soak", []*Pipeline{{App: "x", Package: "example.com/x", Stages: []*Stage{{Name: "dev", Soak: "1 hour"}}}}},
+	}
+
+	for _, test := range tests {
+		s := &Server{Pipelines: test.pipelines}
+		if err := s.startPipelines(); err == nil {
+			t.Errorf("%s: pipelines were started", test.name)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := history{
+		{Stage: "dev", Build: "b1", State: PromotionDeployed, When: base},
+		{Stage: "dev", Build: "b2", State: PromotionDeployed, When: base.Add(time.Hour)},
+		{Stage: "dev", Build: "b3", State: PromotionFailed, When: base.Add(2 * time.Hour)},
+		{Stage: "prod", Build: "b1", State: PromotionApproved, When: base.Add(3 * time.Hour)},
+	}
+
+	if p := h.find("prod", "b1"); p == nil || p.State != PromotionApproved {
+		t.Errorf("find(prod, b1) = %v", p)
+	}
+
+	if p := h.find("prod", "b2"); p != nil {
+		t.Errorf("find(prod, b2) = %v", p)
+	}
+
+	if p := h.latest("dev", PromotionDeployed); p == nil || p.Build != "b2" {
+		t.Errorf("latest(dev, deployed) = %v", p)
+	}
+
+	if p := h.latest("prod", PromotionDeployed); p != nil {
+		t.Errorf("latest(prod, deployed) = %v", p)
+	}
+}
+
+// testInstance serves a version like the instances of an application.
+func testInstance(t *testing.T, status int, version string) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(version + "\n"))
+	}))
+
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestSoaked(t *testing.T) {
+	s := testServer(t)
+
+	dev := testInstance(t, http.StatusOK, "b1")
+	broken := testInstance(t, http.StatusInternalServerError, "")
+	s.call(func() {
+		s.apps["x"] = map[string]*App{
+			dev:    {Name: "x", URL: dev},
+			broken: {Name: "x", URL: broken},
+		}
+	})
+
+	p := &Pipeline{
+		App:     "x",
+		Package: "example.com/x",
+		Stages: []*Stage{
+			{Name: "dev", Targets: []string{dev}},
+			{Name: "prod", Targets: []string{"prod"}, soak: time.Hour},
+			{Name: "broken", Targets: []string{broken}},
+		},
+	}
+
+	tests := []struct {
+		stage, build string
+		since        time.Duration
+		want         string
+	}{
+		{"prod", "b1", 0, "soaking on dev until"},
+		{"prod", "b1", -2 * time.Hour, ""},
+		{"prod", "b2", -2 * time.Hour, "runs b1"},
+		{"broken", "b1", 0, "no instance of prod is registered"},
+	}
+
+	for _, test := range tests {
+		i, _ := p.stage(test.stage)
+		got := s.soaked(p, i, test.build, time.Now().Add(test.since))
+		if test.want == "" && got != "" || !strings.Contains(got, test.want) {
+			t.Errorf("soaked(%s, %s) = %q, want %q", test.stage, test.build, got, test.want)
+		}
+	}
+
+	if got := s.healthy("x", p.Stages[2], "b1"); !strings.Contains(got, "is unhealthy") {
+		t.Errorf("healthy(broken) = %q", got)
+	}
+}
+
+func TestApprove(t *testing.T) {
+	s := testServer(t)
+	s.Pipelines = []*Pipeline{{
+		App:     "x",
+		Package: "example.com/x",
+		Stages: []*Stage{
+			{Name: "dev"},
+			{Name: "prod", Approval: true},
+		},
+	}}
+
+	s.call(func() {
+		s.Builders["b1"] = &Builder{Name: "b1", Build: &Build{Name: "example.com/x"}}
+		s.Builders["b2"] = &Builder{Name: "b2", Build: &Build{Name: "example.com/y"}}
+	})
+
+	s.savePromotion(&Promotion{App: "x", Stage: "dev", Build: "b1", State: PromotionDeployed})
+
+	tests := []struct {
+		approval Approval
+		code     string
+	}{
+		{Approval{App: "y", Stage: "prod", Build: "b1"}, CodeNotFound},
+		{Approval{App: "x", Stage: "qa", Build: "b1"}, CodeNotFound},
+		{Approval{App: "x", Stage: "dev", Build: "b1"}, CodeInvalid},
+		{Approval{App: "x", Stage: "prod", Build: "b3"}, CodeNotFound},
+		{Approval{App: "x", Stage: "prod", Build: "b2"}, CodeNotFound},
+		{Approval{App: "x", Stage: "prod", Build: "b1"}, ""},
+	}
+
+	for _, test := range tests {
+		a := test.approval
+		_, err := s.approve(&a)
+
+		code := ""
+		if e, ok := err.(*Error); ok {
+			code = e.Code
+		}
+
+		if code != test.code {
+			t.Errorf("approve(%s %s %s) = %v, want %q", a.App, a.Stage, a.Build, err, test.code)
+		}
+	}
+
+	h, err := s.history("x/prod/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p := h.find("prod", "b1"); p == nil || p.State != PromotionApproved {
+		t.Errorf("approval wasn't recorded: %v", p)
+	}
+
+	// a build must be deployed on the previous stage first
+	s.call(func() {
+		s.Builders["b4"] = &Builder{Name: "b4", Build: &Build{Name: "example.com/x"}}
+	})
+
+	if _, err := s.approve(&Approval{App: "x", Stage: "prod", Build: "b4"}); err == nil {
+		t.Error("build not deployed on dev was approved")
+	}
+}
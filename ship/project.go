@@ -4,17 +4,26 @@ import (
 	"fmt"
 	"go/build"
 	"log"
+	"os"
 	"os/exec"
 	"path"
+	"runtime"
 	"strings"
+	"time"
 )
 
 type Project struct {
 	Name     string
 	Filename string
+	Context  build.Context
 
 	dependencies map[string]*build.Package
 	repositories map[string]string
+	toplevels    map[string]string
+
+	// fetch is called when a package is missing from the workspace and
+	// reports whether it is worth trying again
+	fetch func(name string) (bool, error)
 }
 
 func NewProject(name, wd string) (p *Project, err error) {
@@ -41,8 +50,10 @@ func NewProject(name, wd string) (p *Project, err error) {
 	p = &Project{
 		Name:         dir,
 		Filename:     path.Base(dir),
+		Context:      build.Default,
 		dependencies: make(map[string]*build.Package),
 		repositories: make(map[string]string),
+		toplevels:    make(map[string]string),
 	}
 
 	return
@@ -54,51 +65,125 @@ func (p *Project) Dependencies() (result map[string]string, err error) {
 		return
 	}
 
-	// get workspace git SHA1 from repositories
+	// find the repositories holding the packages
+	repositories := make(map[string]string)
 	for _, pkg := range p.dependencies {
 		if pkg.Goroot {
 			continue
 		}
 
-		// figure out the path
-		run := func(args ...string) (result []byte, err error) {
-			cmd := exec.Command("git", args...)
-			cmd.Dir = pkg.Dir
-			if result, err = cmd.Output(); err != nil {
-				err = fmt.Errorf("git %s\n%s", strings.Join(args, " "), err.Error())
-			}
-
-			return
-		}
-
-		var output []byte
-		output, err = run("rev-parse", "--show-toplevel")
+		var dir string
+		dir, err = p.toplevel(pkg.Dir, pkg.SrcRoot)
 		if err != nil {
 			return
 		}
 
 		src := pkg.SrcRoot + "/"
-		dir := strings.TrimSpace(string(output))
 		git := strings.TrimPrefix(dir, src)
+		repositories[git] = dir
+	}
+
+	cache := readCache(DependencyCache)
+
+	type status struct {
+		name string
+		hash string
+		err  error
+	}
+
+	// get workspace git SHA1 from repositories
+	done := make(chan status)
+	limit := make(chan struct{}, runtime.NumCPU())
+
+	for git, dir := range repositories {
+		go func(name, dir string) {
+			limit <- struct{}{}
+			hash, err := p.commit(name, dir, cache)
+			<-limit
+
+			done <- status{name: name, hash: hash, err: err}
+		}(git, dir)
+	}
+
+	for i, n := 0, len(repositories); i < n; i++ {
+		r := <-done
+		if r.err != nil {
+			if err == nil {
+				err = r.err
+			}
 
-		// already done?
-		if _, ok := p.repositories[git]; ok {
 			continue
 		}
 
-		// get the current SHA1
-		p.repositories[git], err = p.commit(git, dir)
-		if err != nil {
-			return
-		}
+		p.repositories[r.name] = r.hash
+	}
+
+	if err != nil {
+		return
+	}
+
+	if err = cache.save(DependencyCache); err != nil {
+		log.Println("unable to save dependency cache:", err)
+		err = nil
 	}
 
 	result = p.repositories
 	return
 }
 
+// toplevel returns the root of the git repository holding the directory by
+// looking for the closest .git entry, remembering the result for each visited
+// directory since most packages share their repository with others.
+func (p *Project) toplevel(dir, root string) (result string, err error) {
+	if result, ok := p.toplevels[dir]; ok {
+		return result, nil
+	}
+
+	_, err = os.Stat(path.Join(dir, ".git"))
+	switch {
+	case err == nil:
+		result = dir
+
+	case !os.IsNotExist(err):
+		return
+
+	case strings.HasPrefix(path.Dir(dir), root+"/"):
+		result, err = p.toplevel(path.Dir(dir), root)
+
+	default:
+		// let git figure it out
+		cmd := exec.Command("git", "rev-parse", "--show-toplevel")
+		cmd.Dir = dir
+
+		var output []byte
+		if output, err = cmd.Output(); err != nil {
+			err = fmt.Errorf("git rev-parse --show-toplevel\n%s", err.Error())
+		}
+
+		result = strings.TrimSpace(string(output))
+	}
+
+	if err != nil {
+		return
+	}
+
+	p.toplevels[dir] = result
+	return
+}
+
 func (p *Project) include(name string) (err error) {
-	pkg, err := build.Import(name, "", 0)
+	pkg, err := p.Context.Import(name, "", 0)
+	if err != nil && p.fetch != nil {
+		// give a chance to get the missing package
+		ok, e := p.fetch(name)
+		switch {
+		case e != nil:
+			err = e
+		case ok:
+			pkg, err = p.Context.Import(name, "", 0)
+		}
+	}
+
 	if err != nil {
 		return
 	}
@@ -114,7 +199,7 @@ func (p *Project) include(name string) (err error) {
 			continue
 		}
 
-		if pkg.Goroot {
+		if pkg.Goroot || item == "C" {
 			continue
 		}
 
@@ -127,7 +212,14 @@ func (p *Project) include(name string) (err error) {
 	return
 }
 
-func (p *Project) commit(name, repo string) (result string, err error) {
+func (p *Project) commit(name, repo string, cache *scanCache) (result string, err error) {
+	// known to be clean and pushed?
+	if head, ok := cache.valid(repo); ok {
+		return head, nil
+	}
+
+	checked := time.Now()
+
 	// git
 	run := func(args ...string) (result []byte, err error) {
 		cmd := exec.Command("git", args...)
@@ -139,6 +231,14 @@ func (p *Project) commit(name, repo string) (result string, err error) {
 		return
 	}
 
+	// get HEAD
+	hash, err := run("rev-parse", "HEAD")
+	if err != nil {
+		return
+	}
+
+	result = strings.TrimSpace(string(hash))
+
 	// anything pending?
 	status, err := run("status", "--porcelain", "--untracked-files=no")
 	if err != nil {
@@ -166,12 +266,6 @@ func (p *Project) commit(name, repo string) (result string, err error) {
 		}
 	}
 
-	// get HEAD
-	hash, err := run("rev-parse", "HEAD")
-	if err != nil {
-		return
-	}
-
-	result = strings.TrimSpace(string(hash))
+	cache.add(repo, result, checked)
 	return
 }
@@ -0,0 +1,264 @@
+package ship
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Watch lists the commands built by the server when code is pushed to their
+// repository or to the repository of one of their dependencies. Push events
+// are signed with the secret, or authenticated like other requests when
+// empty. Repositories maps the names or URLs of the pushed repositories to
+// the repositories of the packages when they differ.
+type Watch struct {
+	Secret       string            `json:"secret"`
+	Commands     []*Remote         `json:"commands"`
+	Repositories map[string]string `json:"repositories"`
+}
+
+// Push is the part of the push events of GitHub and Gitea used to trigger
+// builds.
+type Push struct {
+	Ref        string `json:"ref"`
+	After      string `json:"after"`
+	Deleted    bool   `json:"deleted"`
+	Repository struct {
+		FullName      string `json:"full_name"`
+		HTMLURL       string `json:"html_url"`
+		CloneURL      string `json:"clone_url"`
+		DefaultBranch string `json:"default_branch"`
+	} `json:"repository"`
+	Pusher struct {
+		Name     string `json:"name"`
+		Login    string `json:"login"`
+		Username string `json:"username"`
+	} `json:"pusher"`
+}
+
+// PushResult lists the commands built because of a push.
+type PushResult struct {
+	Repository string   `json:"repository"`
+	Branch     string   `json:"branch"`
+	Builds     []string `json:"builds"`
+}
+
+// repository returns the name of the pushed repository.
+func (w *Watch) repository(p *Push) string {
+	for _, key := range []string{p.Repository.FullName, p.Repository.HTMLURL, p.Repository.CloneURL} {
+		if name, ok := w.Repositories[key]; ok && key != "" {
+			return name
+		}
+	}
+
+	u, err := url.Parse(p.Repository.HTMLURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+
+	return u.Host + strings.TrimSuffix(u.Path, ".git")
+}
+
+// verify checks the signature of GitHub or Gitea.
+func (w *Watch) verify(r *http.Request, body []byte) bool {
+	h := hmac.New(sha256.New, []byte(w.Secret))
+	h.Write(body)
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	if value := r.Header.Get("X-Hub-Signature-256"); value != "" {
+		return hmac.Equal([]byte(value), []byte("sha256="+sum))
+	}
+
+	return hmac.Equal([]byte(r.Header.Get("X-Gitea-Signature")), []byte(sum))
+}
+
+func (p *Push) user() string {
+	for _, name := range []string{p.Pusher.Login, p.Pusher.Username, p.Pusher.Name} {
+		if name != "" {
+			return name
+		}
+	}
+
+	return "unknown"
+}
+
+// affected returns the watched commands using the pushed branch of the
+// repository, either as their own repository or as a dependency of their
+// latest build. Commands never built are always affected. Commands without
+// a branch use the default one of the repository, or master when the event
+// doesn't tell.
+func (s *Server) affected(repo, branch string, p *Push) (result []*Remote, err error) {
+	err = s.store.View(func(tx *Tx) (err error) {
+		for _, c := range s.Watch.Commands {
+			own := c.repository()
+
+			// the branch the command builds from
+			want := "master"
+			switch {
+			case own == repo && c.Ref != "":
+				want = c.Ref
+			case own != repo && c.Pins[repo] != "":
+				want = c.Pins[repo]
+			case p.Repository.DefaultBranch != "":
+				want = p.Repository.DefaultBranch
+			}
+
+			if branch != want {
+				continue
+			}
+
+			keys := tx.Lookup("builders", "package", c.Name)
+			if own == repo || len(keys) == 0 {
+				result = append(result, c)
+				continue
+			}
+
+			b := new(Builder)
+			if _, err = tx.Get("builders", path.Base(keys[len(keys)-1]), b); err != nil {
+				return
+			}
+
+			if _, ok := b.Build.Versions[repo]; ok {
+				result = append(result, c)
+			}
+		}
+
+		return
+	})
+
+	return
+}
+
+// push triggers the builds of the commands affected by a push.
+func (s *Server) push(p *Push) (result *PushResult, err error) {
+	s.once.Do(s.initialize)
+
+	result = &PushResult{
+		Repository: s.Watch.repository(p),
+		Branch:     strings.TrimPrefix(p.Ref, "refs/heads/"),
+		Builds:     []string{},
+	}
+
+	if result.Repository == "" {
+		err = invalid("unknown repository '%s'", p.Repository.FullName)
+		return
+	}
+
+	// tags and deleted branches don't change what is built
+	if !strings.HasPrefix(p.Ref, "refs/heads/") || p.Deleted {
+		return
+	}
+
+	commands, err := s.affected(result.Repository, result.Branch, p)
+	if err != nil {
+		return
+	}
+
+	for _, c := range commands {
+		r := c.at(result.Repository, p.After)
+		r.User = p.user()
+		r.Trigger = fmt.Sprintf("push of %s to %s@%s", shortHash(p.After), result.Repository, result.Branch)
+
+		result.Builds = append(result.Builds, r.Name)
+		go func(r *Remote) {
+			if _, err := s.makeRemote(r); err != nil {
+				log.Printf("build of %s after %s failed: %s", r.Name, r.Trigger, err.Error())
+			}
+		}(r)
+	}
+
+	return
+}
+
+// at returns a copy of a command building the pushed commit of a repository,
+// even if its branch moved since.
+func (c *Remote) at(repo, hash string) (r *Remote) {
+	r = new(Remote)
+	*r = *c
+	if !commitHash.MatchString(hash) {
+		return
+	}
+
+	if r.repository() == repo {
+		r.Ref = hash
+		return
+	}
+
+	r.Pins = map[string]string{repo: hash}
+	for name, ref := range c.Pins {
+		if name != repo {
+			r.Pins[name] = ref
+		}
+	}
+
+	return
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+
+	return hash
+}
+
+func (s *Server) startPush() {
+	http.HandleFunc("/hooks/push", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, newError(http.StatusMethodNotAllowed, CodeMethod, "method not allowed"))
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			writeError(w, invalid("%s", err.Error()))
+			return
+		}
+
+		if s.Watch.Secret == "" {
+			if _, ok := s.authenticate(w, r); !ok {
+				return
+			}
+		} else if !s.Watch.verify(r, body) {
+			writeError(w, newError(http.StatusUnauthorized, CodeUnauthorized, "invalid signature"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		// other events, such as the ping sent when the hook is created
+		kind := r.Header.Get("X-GitHub-Event")
+		if kind == "" {
+			kind = r.Header.Get("X-Gitea-Event")
+		}
+
+		if kind != "" && kind != "push" {
+			json.NewEncoder(w).Encode(&PushResult{Builds: []string{}})
+			return
+		}
+
+		p := new(Push)
+		if err := json.Unmarshal(body, p); err != nil {
+			writeError(w, invalid("%s", err.Error()))
+			return
+		}
+
+		result, err := s.push(p)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(result)
+	})
+}
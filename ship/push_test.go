@@ -0,0 +1,112 @@
+package ship
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAffected(t *testing.T) {
+	s := &Server{
+		Watch: &Watch{
+			Commands: []*Remote{
+				{Name: "example.com/a/b/cmd/x"},
+				{Name: "example.com/a/c/cmd/y", Ref: "release"},
+				{Name: "example.com/a/d/cmd/z", Pins: map[string]string{"example.com/a/b": "stable"}},
+				{Name: "example.com/a/e/cmd/w"},
+			},
+		},
+		store: openTestStore(t, path.Join(t.TempDir(), "state.db")),
+	}
+
+	defer s.store.Close()
+
+	// w was built without b while z was built with it
+	builds := []*Build{
+		{Name: "example.com/a/b/cmd/x", Versions: map[string]string{"example.com/a/b": "1"}},
+		{Name: "example.com/a/c/cmd/y", Versions: map[string]string{"example.com/a/c": "1"}},
+		{Name: "example.com/a/d/cmd/z", Versions: map[string]string{"example.com/a/b": "1", "example.com/a/d": "1"}},
+		{Name: "example.com/a/e/cmd/w", Versions: map[string]string{"example.com/a/e": "1"}},
+	}
+
+	err := s.store.Update(func(tx *Tx) (err error) {
+		for i, b := range builds {
+			b.When = time.Unix(int64(i), 0)
+			if err = putBuilder(tx, &Builder{Name: fmt.Sprint("b", i), Build: b}); err != nil {
+				return
+			}
+		}
+
+		return
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		repo, branch, defaultBranch string
+		want                        []string
+	}{
+		{"example.com/a/b", "main", "main", []string{"example.com/a/b/cmd/x"}},
+		{"example.com/a/b", "master", "", []string{"example.com/a/b/cmd/x"}},
+		{"example.com/a/b", "stable", "main", []string{"example.com/a/d/cmd/z"}},
+		{"example.com/a/c", "main", "main", nil},
+		{"example.com/a/c", "release", "", []string{"example.com/a/c/cmd/y"}},
+		{"example.com/a/e", "main", "main", []string{"example.com/a/e/cmd/w"}},
+		{"example.com/a/f", "main", "main", nil},
+	}
+
+	for _, test := range tests {
+		p := new(Push)
+		p.Repository.DefaultBranch = test.defaultBranch
+
+		commands, err := s.affected(test.repo, test.branch, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, c := range commands {
+			got = append(got, c.Name)
+		}
+
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("push to %s@%s affected %v, want %v", test.repo, test.branch, got, test.want)
+		}
+	}
+}
+
+func TestRemoteAt(t *testing.T) {
+	const hash = "0123456789abcdef0123456789abcdef01234567"
+
+	c := &Remote{
+		Name: "example.com/a/b/cmd/x",
+		Ref:  "main",
+		Pins: map[string]string{"example.com/a/c": "stable"},
+	}
+
+	tests := []struct {
+		repo, hash string
+		ref        string
+		pins       map[string]string
+	}{
+		{"example.com/a/b", hash, hash, c.Pins},
+		{"example.com/a/c", hash, "main", map[string]string{"example.com/a/c": hash}},
+		{"example.com/a/d", hash, "main", map[string]string{"example.com/a/c": "stable", "example.com/a/d": hash}},
+		{"example.com/a/b", "-invalid", "main", c.Pins},
+	}
+
+	for _, test := range tests {
+		r := c.at(test.repo, test.hash)
+		if r.Ref != test.ref || !reflect.DeepEqual(r.Pins, test.pins) {
+			t.Errorf("at(%s, %s) = %s %v, want %s %v", test.repo, test.hash, r.Ref, r.Pins, test.ref, test.pins)
+		}
+	}
+
+	if c.Ref != "main" || len(c.Pins) != 1 || c.Pins["example.com/a/c"] != "stable" {
+		t.Errorf("at changed the command to %s %v", c.Ref, c.Pins)
+	}
+}
@@ -0,0 +1,640 @@
+package ship
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type BuildInfo struct {
+	ID        string            `json:"id"`
+	Package   string            `json:"package"`
+	App       string            `json:"app,omitempty"`
+	User      string            `json:"by"`
+	When      time.Time         `json:"when"`
+	Running   bool              `json:"running,omitempty"`
+	URL       string            `json:"url,omitempty"`
+	Toolchain string            `json:"toolchain,omitempty"`
+	Trigger   string            `json:"trigger,omitempty"`
+	Versions  map[string]string `json:"versions"`
+	Flags     Flags             `json:"flags"`
+	Findings  []*Finding        `json:"findings,omitempty"`
+	Log       string            `json:"log,omitempty"`
+
+	// Interrupted tells why a build stopped before completing.
+	Interrupted string `json:"interrupted,omitempty"`
+}
+
+// DeployInfo is a recorded deployment and its outcome on every host.
+type DeployInfo struct {
+	ID string `json:"id"`
+	*Deploy
+	OK bool `json:"ok"`
+}
+
+// AppInfo is a registered instance.
+type AppInfo struct {
+	ID string `json:"id"`
+	*App
+}
+
+// BuildPage, DeployPage and AppPage are pages of the results of a query.
+// Next is the cursor of the following page, empty on the last one.
+type BuildPage struct {
+	Builds []*BuildInfo `json:"builds"`
+	Next   string       `json:"next,omitempty"`
+}
+
+type DeployPage struct {
+	Deploys []*DeployInfo `json:"deploys"`
+	Next    string        `json:"next,omitempty"`
+}
+
+type AppPage struct {
+	Apps []*AppInfo `json:"apps"`
+	Next string     `json:"next,omitempty"`
+}
+
+// Query selects the records returned by the API. Empty fields match
+// everything. App matches both the application and the package name.
+type Query struct {
+	App     string
+	Package string
+	User    string
+	Version string // deployed build
+	Commit  string // commit, or prefix of one, of a dependency of the build
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+	After   string // cursor of the page
+}
+
+// MaxLimit is the largest page of results returned by a query.
+const MaxLimit = 1000
+
+const defaultLimit = 100
+
+// ParseQuery reads a query from the parameters of a request.
+func ParseQuery(values url.Values) (q *Query, err error) {
+	q = &Query{
+		App:     values.Get("app"),
+		Package: values.Get("package"),
+		User:    values.Get("user"),
+		Version: values.Get("version"),
+		Commit:  values.Get("commit"),
+		After:   values.Get("after"),
+		Limit:   defaultLimit,
+	}
+
+	if text := values.Get("limit"); text != "" {
+		if q.Limit, err = strconv.Atoi(text); err != nil || q.Limit <= 0 || q.Limit > MaxLimit {
+			err = invalid("limit must be between 1 and %d instead of '%s'", MaxLimit, text)
+			return
+		}
+	}
+
+	for name, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if text := values.Get(name); text != "" {
+			if *t, err = time.Parse(time.RFC3339, text); err != nil {
+				err = invalid("%s must be an RFC 3339 time instead of '%s'", name, text)
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// Values returns the parameters of a request for the query.
+func (q *Query) Values() (result url.Values) {
+	result = url.Values{}
+	set := func(name, value string) {
+		if value != "" {
+			result.Set(name, value)
+		}
+	}
+
+	set("app", q.App)
+	set("package", q.Package)
+	set("user", q.User)
+	set("version", q.Version)
+	set("commit", q.Commit)
+	set("after", q.After)
+
+	if !q.Since.IsZero() {
+		set("since", q.Since.Format(time.RFC3339))
+	}
+
+	if !q.Until.IsZero() {
+		set("until", q.Until.Format(time.RFC3339))
+	}
+
+	if q.Limit != 0 {
+		set("limit", strconv.Itoa(q.Limit))
+	}
+
+	return
+}
+
+func (q *Query) during(t time.Time) bool {
+	return (q.Since.IsZero() || !t.Before(q.Since)) && (q.Until.IsZero() || t.Before(q.Until))
+}
+
+func (q *Query) build(b *Build) bool {
+	if q.App != "" && b.Filename != q.App && b.Name != q.App {
+		return false
+	}
+
+	if q.Package != "" && b.Name != q.Package || q.User != "" && b.User != q.User || !q.during(b.When) {
+		return false
+	}
+
+	if q.Commit == "" {
+		return true
+	}
+
+	for _, commit := range b.Versions {
+		if strings.HasPrefix(commit, q.Commit) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (q *Query) deploy(d *Deploy) bool {
+	if q.App != "" && d.Filename != q.App && d.Name != q.App {
+		return false
+	}
+
+	return (q.Package == "" || d.Name == q.Package) &&
+		(q.User == "" || d.User == q.User) &&
+		(q.Version == "" || d.Version == q.Version) &&
+		q.during(d.When)
+}
+
+// candidates returns the keys of the items of a bucket that may match the
+// query using the most selective index available.
+func (q *Query) candidates(tx *Tx, bucket, all string) (result []string) {
+	switch {
+	case q.Version != "" && bucket == "deploys":
+		return tx.Lookup(bucket, "version", q.Version)
+	case q.Package != "":
+		return tx.Lookup(bucket, "package", q.Package)
+	case q.App != "":
+		keys := append(tx.Lookup(bucket, "app", q.App), tx.Lookup(bucket, "package", q.App)...)
+		sort.Strings(keys)
+		for i, key := range keys {
+			if i == 0 || key != keys[i-1] {
+				result = append(result, key)
+			}
+		}
+
+		return
+	case q.User != "":
+		return tx.Lookup(bucket, "user", q.User)
+	}
+
+	return tx.Keys(all, "")
+}
+
+// paginate calls add with the keys following the cursor of the query until
+// the limit of items is reached and returns the cursor of the next page.
+func (q *Query) paginate(keys []string, descending bool, add func(key string) (bool, error)) (next string, err error) {
+	if descending {
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+
+	count := 0
+	for i, key := range keys {
+		if q.After != "" && (descending && key >= q.After || !descending && key <= q.After) {
+			continue
+		}
+
+		ok, err := add(key)
+		if err != nil {
+			return "", err
+		}
+
+		if ok {
+			count++
+		}
+
+		if count == q.Limit && i+1 < len(keys) {
+			next = key
+			break
+		}
+	}
+
+	return
+}
+
+// Load tells how busy a server is.
+type Load struct {
+	Running int `json:"running"`
+	Builds  int `json:"builds"`
+}
+
+// Cancel asks the server to stop a running build.
+type Cancel struct {
+	ID   string `json:"id"`
+	User string `json:"by"`
+}
+
+// call runs a function with the state of the server and waits for it.
+func (s *Server) call(f func()) {
+	done := make(chan struct{})
+	s.feed <- func() {
+		f()
+		close(done)
+	}
+
+	<-done
+}
+
+// QueryBuilds returns the builds matching the query, starting with the most
+// recent. Running and interrupted builds are listed with the completed ones.
+func (s *Server) QueryBuilds(q *Query) (result *BuildPage, err error) {
+	s.once.Do(s.initialize)
+
+	result = &BuildPage{
+		Builds: []*BuildInfo{},
+	}
+
+	// they are paginated by the same keys as the completed builds
+	others := make(map[string]*BuildInfo)
+	s.call(func() {
+		for id, b := range s.running {
+			if q.build(b.Build) {
+				others[timeKey(b.Build.When)+"/"+id] = s.info(id, b, true)
+			}
+		}
+	})
+
+	list, err := s.interruptions()
+	if err != nil {
+		return
+	}
+
+	for _, item := range list {
+		if q.build(item.Build) {
+			others[timeKey(item.Build.When)+"/"+item.ID] = s.interrupted(item)
+		}
+	}
+
+	err = s.store.View(func(tx *Tx) (err error) {
+		keys := q.candidates(tx, "builders", "index:builders:time")
+		for key := range others {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+		result.Next, err = q.paginate(keys, true, func(key string) (ok bool, err error) {
+			if item, found := others[key]; found {
+				result.Builds = append(result.Builds, item)
+				return true, nil
+			}
+
+			id := path.Base(key)
+
+			b := new(Builder)
+			if ok, err = tx.Get("builders", id, b); !ok || err != nil || !q.build(b.Build) {
+				return false, err
+			}
+
+			result.Builds = append(result.Builds, s.info(id, b, false))
+			return
+		})
+
+		return
+	})
+
+	return
+}
+
+// BuildInfo returns a completed, running or interrupted build with its log.
+func (s *Server) BuildInfo(id string) (result *BuildInfo, err error) {
+	s.once.Do(s.initialize)
+
+	s.call(func() {
+		if b, ok := s.running[id]; ok {
+			result = s.info(id, b, true)
+		}
+	})
+
+	if result == nil {
+		err = s.store.View(func(tx *Tx) (err error) {
+			var ok bool
+
+			// follow a build that completed since it was listed as running
+			name := id
+			if _, err = tx.Get("aliases", id, &name); err != nil {
+				return
+			}
+
+			b := new(Builder)
+			if ok, err = tx.Get("builders", name, b); ok && err == nil && b.Build != nil {
+				result = s.info(name, b, false)
+			}
+
+			return
+		})
+
+		if err != nil {
+			return
+		}
+	}
+
+	if result == nil {
+		item, e := s.interruption(id)
+		if e != nil {
+			err = e
+			return
+		}
+
+		if item != nil {
+			result = s.interrupted(item)
+		}
+	}
+
+	if result == nil {
+		err = notFound("no build '%s'", id)
+		return
+	}
+
+	if name, e := s.logFile(id); e == nil {
+		if data, e := ioutil.ReadFile(name); e == nil {
+			result.Log = string(data)
+		}
+	}
+
+	return
+}
+
+func (s *Server) info(id string, b *Builder, running bool) (result *BuildInfo) {
+	result = &BuildInfo{
+		ID:       id,
+		Package:  b.Build.Name,
+		App:      b.Build.Filename,
+		User:     b.Build.User,
+		When:     b.Build.When,
+		Running:  running,
+		Trigger:  b.Build.Trigger,
+		Versions: b.Build.Versions,
+		Flags:    b.Build.Flags,
+	}
+
+	// running builds are still setting their toolchain and findings
+	if !running {
+		result.URL = s.artifact(id)
+		result.Toolchain, result.Findings = b.Toolchain, b.Findings
+	}
+
+	return
+}
+
+// QueryDeploys returns the deployments matching the query, starting with
+// the most recent.
+func (s *Server) QueryDeploys(q *Query) (result *DeployPage, err error) {
+	s.once.Do(s.initialize)
+
+	result = &DeployPage{
+		Deploys: []*DeployInfo{},
+	}
+
+	err = s.store.View(func(tx *Tx) (err error) {
+		result.Next, err = q.paginate(q.candidates(tx, "deploys", "deploys"), true, func(key string) (ok bool, err error) {
+			d := new(Deploy)
+			if ok, err = tx.Get("deploys", key, d); !ok || err != nil || !q.deploy(d) {
+				return false, err
+			}
+
+			item := &DeployInfo{
+				ID:     key,
+				Deploy: d,
+				OK:     len(d.Results) != 0,
+			}
+
+			for _, r := range d.Results {
+				item.OK = item.OK && r.OK
+			}
+
+			result.Deploys = append(result.Deploys, item)
+			return
+		})
+
+		return
+	})
+
+	return
+}
+
+// QueryApps returns the registered instances of the application of the
+// query, or of every application, in order.
+func (s *Server) QueryApps(q *Query) (result *AppPage, err error) {
+	s.once.Do(s.initialize)
+
+	result = &AppPage{
+		Apps: []*AppInfo{},
+	}
+
+	prefix := ""
+	if q.App != "" {
+		prefix = q.App + "/"
+	}
+
+	err = s.store.View(func(tx *Tx) (err error) {
+		result.Next, err = q.paginate(tx.Keys("apps", prefix), false, func(key string) (ok bool, err error) {
+			a := new(App)
+			if ok, err = tx.Get("apps", key, a); ok && err == nil {
+				result.Apps = append(result.Apps, &AppInfo{ID: key, App: a})
+			}
+
+			return
+		})
+
+		return
+	})
+
+	return
+}
+
+func (s *Server) Load() (result *Load) {
+	s.once.Do(s.initialize)
+
+	result = new(Load)
+	s.call(func() {
+		result.Running = len(s.running)
+		result.Builds = len(s.Builders)
+	})
+
+	return
+}
+
+// logFile returns the log of a build, which is still being written when the
+// build is running.
+func (s *Server) logFile(id string) (result string, err error) {
+	s.once.Do(s.initialize)
+
+	s.call(func() {
+		if b, ok := s.running[id]; ok {
+			result = path.Join(b.Workspace, "log")
+		}
+	})
+
+	if result != "" {
+		return
+	}
+
+	result = path.Join(s.Builds, path.Base(id)+".build")
+	if _, e := os.Stat(result); e != nil {
+		err = notFound("no log for build '%s'", id)
+	}
+
+	return
+}
+
+func (s *Server) cancel(c *Cancel) (err error) {
+	s.once.Do(s.initialize)
+
+	s.call(func() {
+		b, ok := s.running[c.ID]
+		if !ok {
+			err = notFound("build '%s' is not running", c.ID)
+			return
+		}
+
+		b.Cancel()
+	})
+
+	return
+}
+
+func (s *Server) startAPI() {
+	handle := func(pattern string, f func(w http.ResponseWriter, r *http.Request) interface{}) {
+		http.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" {
+				writeError(w, newError(http.StatusMethodNotAllowed, CodeMethod, "method not allowed"))
+				return
+			}
+
+			if _, ok := s.authenticate(w, r); !ok {
+				return
+			}
+
+			if result := f(w, r); result != nil {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(result)
+			}
+		})
+	}
+
+	// query runs a query read from the parameters of the request
+	query := func(w http.ResponseWriter, r *http.Request, f func(q *Query) (interface{}, error)) interface{} {
+		q, err := ParseQuery(r.URL.Query())
+		if err == nil {
+			var result interface{}
+			if result, err = f(q); err == nil {
+				return result
+			}
+		}
+
+		writeError(w, err)
+		return nil
+	}
+
+	handle("/api/v1/builds", func(w http.ResponseWriter, r *http.Request) interface{} {
+		return query(w, r, func(q *Query) (interface{}, error) {
+			return s.QueryBuilds(q)
+		})
+	})
+
+	handle("/api/v1/builds/", func(w http.ResponseWriter, r *http.Request) interface{} {
+		result, err := s.BuildInfo(strings.TrimPrefix(r.URL.Path, "/api/v1/builds/"))
+		if err != nil {
+			writeError(w, err)
+			return nil
+		}
+
+		return result
+	})
+
+	handle("/api/v1/deploys", func(w http.ResponseWriter, r *http.Request) interface{} {
+		return query(w, r, func(q *Query) (interface{}, error) {
+			return s.QueryDeploys(q)
+		})
+	})
+
+	handle("/api/v1/apps", func(w http.ResponseWriter, r *http.Request) interface{} {
+		return query(w, r, func(q *Query) (interface{}, error) {
+			return s.QueryApps(q)
+		})
+	})
+
+	handle("/api/v1/deliveries", func(w http.ResponseWriter, r *http.Request) interface{} {
+		return query(w, r, func(q *Query) (interface{}, error) {
+			return s.QueryDeliveries(q)
+		})
+	})
+
+	handle("/api/v1/pipelines", func(w http.ResponseWriter, r *http.Request) interface{} {
+		return s.PipelineStatus()
+	})
+
+	handle("/api/v1/promotions", func(w http.ResponseWriter, r *http.Request) interface{} {
+		return query(w, r, func(q *Query) (interface{}, error) {
+			return s.QueryPromotions(q)
+		})
+	})
+
+	handle("/api/v1/workers", func(w http.ResponseWriter, r *http.Request) interface{} {
+		return s.Workers()
+	})
+
+	handle("/api/v1/vulnerabilities", func(w http.ResponseWriter, r *http.Request) interface{} {
+		return nonNil(s.Exposures())
+	})
+
+	handle("/api/v1/load", func(w http.ResponseWriter, r *http.Request) interface{} {
+		// clients pick other servers while this one shuts down
+		if s.draining() {
+			writeError(w, unavailable())
+			return nil
+		}
+
+		return s.Load()
+	})
+
+	handle("/api/v1/logs/", func(w http.ResponseWriter, r *http.Request) interface{} {
+		name, err := s.logFile(strings.TrimPrefix(r.URL.Path, "/api/v1/logs/"))
+		if err != nil {
+			writeError(w, err)
+			return nil
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeFile(w, r, name)
+		return nil
+	})
+}
+
+// nonNil makes sure empty lists are encoded as such rather than null.
+func nonNil(list interface{}) interface{} {
+	switch list := list.(type) {
+	case []*Exposure:
+		if list == nil {
+			return []*Exposure{}
+		}
+	}
+
+	return list
+}
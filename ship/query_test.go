@@ -0,0 +1,174 @@
+package ship
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPaginate(t *testing.T) {
+	keys := []string{"a", "b", "c", "d", "e"}
+	odd := func(key string) bool { return key != "b" && key != "d" }
+
+	tests := []struct {
+		limit      int
+		after      string
+		descending bool
+		want       []string
+		next       string
+	}{
+		{2, "", false, []string{"a", "b"}, "b"},
+		{2, "b", false, []string{"c", "d"}, "d"},
+		{2, "d", false, []string{"e"}, ""},
+		{2, "", true, []string{"e", "d"}, "d"},
+		{2, "d", true, []string{"c", "b"}, "b"},
+		{2, "b", true, []string{"a"}, ""},
+		{5, "", false, keys, ""},
+		{10, "", false, keys, ""},
+	}
+
+	for _, test := range tests {
+		q := &Query{Limit: test.limit, After: test.after}
+
+		var got []string
+		next, err := q.paginate(append([]string(nil), keys...), test.descending, func(key string) (bool, error) {
+			got = append(got, key)
+			return true, nil
+		})
+
+		if err != nil || !reflect.DeepEqual(got, test.want) || next != test.next {
+			t.Errorf("paginate(%d, %q, %v) = %v, %q, want %v, %q", test.limit, test.after, test.descending, got, next, test.want, test.next)
+		}
+	}
+
+	// items that don't match are skipped without counting against the limit
+	var got []string
+	q := &Query{Limit: 2}
+	next, _ := q.paginate(append([]string(nil), keys...), false, func(key string) (bool, error) {
+		if !odd(key) {
+			return false, nil
+		}
+
+		got = append(got, key)
+		return true, nil
+	})
+
+	if want := []string{"a", "c"}; !reflect.DeepEqual(got, want) || next != "c" {
+		t.Errorf("paginate of matching items = %v, %q, want %v, %q", got, next, want, "c")
+	}
+}
+
+// testServer returns a server keeping its state in a temporary directory.
+func testServer(t *testing.T) (s *Server) {
+	s = &Server{Root: t.TempDir()}
+	s.once.Do(s.initialize)
+	t.Cleanup(func() {
+		s.store.Close()
+	})
+
+	return
+}
+
+func TestQueryBuilds(t *testing.T) {
+	s := testServer(t)
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) *Build {
+		return &Build{Name: "example.com/a/cmd/x", Filename: "x", When: base.Add(time.Duration(minutes) * time.Minute)}
+	}
+
+	err := s.store.Update(func(tx *Tx) (err error) {
+		for i := 0; i < 5; i++ {
+			if err = putBuilder(tx, &Builder{Name: fmt.Sprint("b", i), Build: at(i)}); err != nil {
+				return
+			}
+		}
+
+		return tx.Put("interrupted", "i0", &Interruption{ID: "i0", Build: at(5), Reason: "stopped"})
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.call(func() {
+		s.running["r0"] = &Builder{Build: at(10)}
+		s.running["r1"] = &Builder{Build: at(11)}
+	})
+
+	want := []string{"r1", "r0", "i0", "b4", "b3", "b2", "b1", "b0"}
+	for _, limit := range []int{1, 2, 3, 8, 100} {
+		q := &Query{Limit: limit}
+
+		var got []string
+		for pages := 0; pages < 10; pages++ {
+			page, err := s.QueryBuilds(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(page.Builds) > limit {
+				t.Errorf("page of %d builds with a limit of %d", len(page.Builds), limit)
+			}
+
+			for _, b := range page.Builds {
+				got = append(got, b.ID)
+			}
+
+			if q.After = page.Next; q.After == "" {
+				break
+			}
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("pages of %d listed %v, want %v", limit, got, want)
+		}
+	}
+}
+
+func TestQueryCompletedBuild(t *testing.T) {
+	s := testServer(t)
+
+	when := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	old := &Builder{Name: "b0", Workspace: "/builds/x-0", Build: &Build{Name: "example.com/a/cmd/x", Filename: "x", When: when}}
+	s.update(func(tx *Tx) error { return putBuilder(tx, old) })
+
+	b := &Builder{Workspace: "/builds/x-1", Build: &Build{Name: "example.com/a/cmd/x", Filename: "x", When: when.Add(time.Minute)}}
+	s.call(func() { s.running["x-1"] = b })
+
+	q := &Query{Limit: 1}
+	page, err := s.QueryBuilds(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Builds) != 1 || page.Builds[0].ID != "x-1" || !page.Builds[0].Running {
+		t.Fatalf("first page lists %v, want the running build", page.Builds)
+	}
+
+	// the build completes before the next page is read
+	s.call(func() {
+		delete(s.running, "x-1")
+		b.Name = "b1"
+		s.saveBuilder(b)
+	})
+
+	q.After = page.Next
+	if page, err = s.QueryBuilds(q); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Builds) != 1 || page.Builds[0].ID != "b0" {
+		t.Errorf("second page lists %v, want b0", page.Builds)
+	}
+
+	info, err := s.BuildInfo("x-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info == nil || info.ID != "b1" || info.Running {
+		t.Errorf("running build became %+v, want b1", info)
+	}
+}
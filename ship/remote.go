@@ -0,0 +1,179 @@
+package ship
+
+import (
+	"fmt"
+	"go/build"
+	"path"
+	"strings"
+)
+
+// Remote is a build request resolved by the server using its mirrors. The
+// repository of the command is taken at the given reference while its
+// dependencies come from the pins or from their default branch. Trigger
+// tells what caused builds not requested by users.
+type Remote struct {
+	Name       string            `json:"package"`
+	Repository string            `json:"repository,omitempty"`
+	Ref        string            `json:"ref"`
+	User       string            `json:"by"`
+	Flags      Flags             `json:"flags"`
+	Pins       map[string]string `json:"pins,omitempty"`
+	Trigger    string            `json:"-"`
+}
+
+// check rejects the repositories and references that git would misread.
+func (r *Remote) check() (err error) {
+	if err = checkRepository(r.Name); err != nil {
+		return
+	}
+
+	if r.Repository != "" {
+		if err = checkRepository(r.Repository); err != nil {
+			return
+		}
+	}
+
+	if err = checkRef(r.Ref); err != nil {
+		return
+	}
+
+	for name, ref := range r.Pins {
+		if err = checkRepository(name); err != nil {
+			return
+		}
+
+		if err = checkRef(ref); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// repository returns the repository of the command.
+func (r *Remote) repository() string {
+	if r.Repository != "" {
+		return r.Repository
+	}
+
+	return repository(r.Name, r.Pins)
+}
+
+func (r *Remote) Resolve(workspace string, m *Mirrors) (result *Build, err error) {
+	repo := r.repository()
+
+	versions := make(map[string]string)
+
+	checkout := func(name, ref string) (err error) {
+		mirror, err := m.Update(name)
+		if err != nil {
+			return
+		}
+
+		hash, err := m.Resolve(name, ref)
+		if err != nil {
+			return
+		}
+
+		dir := path.Join("src", name)
+		if _, err = git(workspace, "clone", "-q", "--no-checkout", mirror, dir); err != nil {
+			return
+		}
+
+		if _, err = git(path.Join(workspace, dir), "checkout", "-q", hash); err != nil {
+			return
+		}
+
+		versions[name] = hash
+		return
+	}
+
+	if err = checkout(repo, r.Ref); err != nil {
+		return
+	}
+
+	context := r.Flags.Context()
+	context.GOPATH = workspace
+
+	p := &Project{
+		Name:         r.Name,
+		Filename:     path.Base(r.Name),
+		Context:      context,
+		dependencies: make(map[string]*build.Package),
+		fetch: func(name string) (ok bool, err error) {
+			// only fetch what looks like a remote package
+			if !strings.Contains(strings.SplitN(name, "/", 2)[0], ".") {
+				return
+			}
+
+			repo := repository(name, versions, r.Pins)
+			if _, found := versions[repo]; found {
+				return
+			}
+
+			ok, err = true, checkout(repo, r.Pins[repo])
+			return
+		},
+	}
+
+	if err = p.include(r.Name); err != nil {
+		return
+	}
+
+	// the import path may differ from the name, e.g. with a trailing slash
+	pkg, ok := p.dependencies[r.Name]
+	if !ok {
+		err = invalid("invalid package '%s'", r.Name)
+		return
+	}
+
+	if !pkg.IsCommand() {
+		err = fmt.Errorf("project must be a command")
+		return
+	}
+
+	result = &Build{
+		Name:     p.Name,
+		Filename: p.Filename,
+		User:     r.User,
+		Versions: versions,
+		Flags:    r.Flags,
+		Ref:      repo + "@" + r.Ref,
+		Trigger:  r.Trigger,
+	}
+
+	return
+}
+
+func (r *Remote) Deploy(targets []string) (result *Deploy, err error) {
+	result, err = newDeploy(r.Name, path.Base(r.Name), targets)
+	return
+}
+
+// repository returns the repository holding a package using the known
+// repositories first and falling back on the usual host/owner/name layout.
+func repository(name string, known ...map[string]string) (result string) {
+	for _, repositories := range known {
+		for repo := range repositories {
+			if name != repo && !strings.HasPrefix(name, repo+"/") {
+				continue
+			}
+
+			if len(repo) > len(result) {
+				result = repo
+			}
+		}
+	}
+
+	if result != "" {
+		return
+	}
+
+	items := strings.SplitN(name, "/", 4)
+	if len(items) > 3 {
+		items = items[:3]
+	}
+
+	result = strings.Join(items, "/")
+	return
+}
@@ -0,0 +1,55 @@
+package ship
+
+type BuildResult struct {
+	ID        string            `json:"id"`
+	URL       string            `json:"url"`
+	Package   string            `json:"package"`
+	Identity  string            `json:"identity"`
+	Toolchain string            `json:"toolchain"`
+	Versions  map[string]string `json:"versions"`
+	Flags     Flags             `json:"flags"`
+	Findings  []*Finding        `json:"findings,omitempty"`
+	Duration  float64           `json:"duration"`
+}
+
+type DeployResult struct {
+	Package  string        `json:"package"`
+	Version  string        `json:"version"`
+	URL      string        `json:"url"`
+	Hosts    []*HostResult `json:"hosts"`
+	Duration float64       `json:"duration"`
+}
+
+type HostResult struct {
+	Host     string  `json:"host"`
+	OK       bool    `json:"ok"`
+	Message  string  `json:"message"`
+	Duration float64 `json:"duration"`
+}
+
+type InstanceStatus struct {
+	Host     string  `json:"host"`
+	Version  string  `json:"version"`
+	OK       bool    `json:"ok"`
+	Message  string  `json:"message,omitempty"`
+	Duration float64 `json:"duration"`
+}
+
+func (h *HostResult) String() string {
+	if h.OK {
+		return h.Host + " OK"
+	}
+
+	return h.Host + " FAILED " + h.Message
+}
+
+// Failed returns the number of hosts that were not updated.
+func (d *DeployResult) Failed() (n int) {
+	for _, h := range d.Hosts {
+		if !h.OK {
+			n++
+		}
+	}
+
+	return
+}
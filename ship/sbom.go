@@ -0,0 +1,235 @@
+package ship
+
+import (
+	"encoding/hex"
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SBOM is the CycloneDX software bill of materials of a build. It lists the
+// repositories checked out for the build along with their commit, license and
+// the packages they provided.
+type SBOM struct {
+	Format      string       `json:"bomFormat"`
+	SpecVersion string       `json:"specVersion"`
+	Serial      string       `json:"serialNumber,omitempty"`
+	Version     int          `json:"version"`
+	Metadata    SBOMMetadata `json:"metadata"`
+	Components  []*Component `json:"components"`
+}
+
+type SBOMMetadata struct {
+	Timestamp time.Time  `json:"timestamp"`
+	Component *Component `json:"component"`
+}
+
+type Component struct {
+	Type       string      `json:"type"`
+	Ref        string      `json:"bom-ref,omitempty"`
+	Name       string      `json:"name"`
+	Version    string      `json:"version,omitempty"`
+	PURL       string      `json:"purl,omitempty"`
+	Licenses   []*License  `json:"licenses,omitempty"`
+	Properties []*Property `json:"properties,omitempty"`
+}
+
+type License struct {
+	License LicenseID `json:"license"`
+}
+
+type LicenseID struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+type Property struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// licenses recognizes the usual license texts by the sentences they contain,
+// the most specific ones first. The GNU licenses don't tell whether later
+// versions apply so they are only named.
+var licenses = []struct {
+	text []string
+	id   string
+	name string
+}{
+	{[]string{"Apache License", "Version 2.0"}, "Apache-2.0", ""},
+	{[]string{"Mozilla Public License Version 2.0"}, "MPL-2.0", ""},
+	{[]string{"GNU LESSER GENERAL PUBLIC LICENSE", "Version 3"}, "", "LGPL-3.0"},
+	{[]string{"GNU LESSER GENERAL PUBLIC LICENSE", "Version 2.1"}, "", "LGPL-2.1"},
+	{[]string{"GNU AFFERO GENERAL PUBLIC LICENSE", "Version 3"}, "", "AGPL-3.0"},
+	{[]string{"GNU GENERAL PUBLIC LICENSE", "Version 3"}, "", "GPL-3.0"},
+	{[]string{"GNU GENERAL PUBLIC LICENSE", "Version 2"}, "", "GPL-2.0"},
+	{[]string{"Redistributions in binary form", "Neither the name"}, "BSD-3-Clause", ""},
+	{[]string{"Redistributions in binary form"}, "BSD-2-Clause", ""},
+	{[]string{"Permission is hereby granted, free of charge"}, "MIT", ""},
+	{[]string{"Permission to use, copy, modify, and/or distribute"}, "ISC", ""},
+	{[]string{"This is free and unencumbered software"}, "Unlicense", ""},
+}
+
+// NewSBOM describes the packages of a build checked out in the workspace.
+func NewSBOM(b *Builder) (result *SBOM, err error) {
+	context := b.Build.Flags.Context()
+	context.GOPATH = b.Workspace
+
+	p := &Project{
+		Name:         b.Build.Name,
+		Filename:     b.Build.Filename,
+		Context:      context,
+		dependencies: make(map[string]*build.Package),
+		repositories: make(map[string]string),
+		toplevels:    make(map[string]string),
+	}
+
+	if err = p.include(b.Build.Name); err != nil {
+		return
+	}
+
+	// group the packages by repository
+	packages := make(map[string][]string)
+	for name, pkg := range p.dependencies {
+		if pkg.Goroot {
+			continue
+		}
+
+		repo := repository(name, b.Build.Versions)
+		packages[repo] = append(packages[repo], name)
+	}
+
+	result = &SBOM{
+		Format:      "CycloneDX",
+		SpecVersion: "1.5",
+		Serial:      serial(b.Identity),
+		Version:     1,
+		Metadata: SBOMMetadata{
+			Timestamp: b.Build.When,
+			Component: &Component{
+				Type:    "application",
+				Ref:     "pkg:golang/" + b.Build.Name + "@" + b.Name,
+				Name:    b.Build.Filename,
+				Version: b.Name,
+				PURL:    "pkg:golang/" + b.Build.Name + "@" + b.Name,
+				Properties: []*Property{
+					{"goship:package", b.Build.Name},
+					{"goship:user", b.Build.User},
+				},
+			},
+		},
+	}
+
+	if flags := b.Build.Flags.String(); flags != "" {
+		m := result.Metadata.Component
+		m.Properties = append(m.Properties, &Property{"goship:flags", flags})
+	}
+
+	for _, repo := range sortedKeys(b.Build.Versions) {
+		hash := b.Build.Versions[repo]
+
+		// a command at the root of its repository has the version of the build
+		// in its bom-ref, which keeps them unique
+		c := &Component{
+			Type:    "library",
+			Name:    repo,
+			Version: hash,
+			PURL:    "pkg:golang/" + repo + "@" + hash,
+		}
+
+		c.Ref = c.PURL
+
+		if c.Licenses, err = detectLicenses(path.Join(b.Workspace, "src", repo)); err != nil {
+			return
+		}
+
+		list := packages[repo]
+		sort.Strings(list)
+
+		for _, name := range list {
+			c.Properties = append(c.Properties, &Property{"goship:import", name})
+		}
+
+		result.Components = append(result.Components, c)
+	}
+
+	// the standard library comes with the toolchain
+	if fields := strings.Fields(b.Toolchain); len(fields) > 2 {
+		result.Components = append(result.Components, &Component{
+			Type:    "library",
+			Ref:     "pkg:golang/stdlib@" + fields[2],
+			Name:    "stdlib",
+			Version: fields[2],
+			PURL:    "pkg:golang/stdlib@" + fields[2],
+		})
+	}
+
+	return
+}
+
+// detectLicenses looks for license files at the root of a repository.
+func detectLicenses(dir string) (result []*License, err error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		name := strings.ToUpper(entry.Name())
+		if entry.IsDir() || !strings.HasPrefix(name, "LICENSE") && !strings.HasPrefix(name, "LICENCE") && !strings.HasPrefix(name, "COPYING") {
+			continue
+		}
+
+		text, e := ioutil.ReadFile(path.Join(dir, entry.Name()))
+		if e != nil {
+			if os.IsNotExist(e) {
+				continue
+			}
+
+			err = e
+			return
+		}
+
+		// unknown licenses are still worth a look
+		l := &License{LicenseID{Name: entry.Name()}}
+		for _, item := range licenses {
+			if containsAll(string(text), item.text) {
+				l.License = LicenseID{ID: item.id, Name: item.name}
+				break
+			}
+		}
+
+		result = append(result, l)
+	}
+
+	return
+}
+
+func containsAll(text string, list []string) bool {
+	for _, item := range list {
+		if !strings.Contains(text, item) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// serial formats the identity of a build as the UUID required by CycloneDX.
+// The identity being an MD5 digest, it is marked as a name-based UUID of
+// version 3 with the variant of RFC 4122.
+func serial(identity string) string {
+	id, err := hex.DecodeString(identity)
+	if err != nil || len(id) != 16 {
+		return ""
+	}
+
+	id[6] = id[6]&0x0f | 0x30
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", id[:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
@@ -0,0 +1,82 @@
+package ship
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestSerial(t *testing.T) {
+	// the serialNumber pattern of the CycloneDX 1.5 schema along with the
+	// version and variant of RFC 4122
+	pattern := regexp.MustCompile(`^urn:uuid:[0-9a-f]{8}-[0-9a-f]{4}-3[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	tests := []struct {
+		identity, want string
+	}{
+		{"00000000000000000000000000000000", "urn:uuid:00000000-0000-3000-8000-000000000000"},
+		{"ffffffffffffffffffffffffffffffff", "urn:uuid:ffffffff-ffff-3fff-bfff-ffffffffffff"},
+		{"d41d8cd98f00b204e9800998ecf8427e", "urn:uuid:d41d8cd9-8f00-3204-a980-0998ecf8427e"},
+		{"", ""},
+		{"d41d8cd98f00b204", ""},
+		{"not an identity of 32 characters", ""},
+	}
+
+	for _, test := range tests {
+		got := serial(test.identity)
+		if got != test.want {
+			t.Errorf("serial(%q) = %q, want %q", test.identity, got, test.want)
+		}
+
+		if got != "" && !pattern.MatchString(got) {
+			t.Errorf("serial(%q) = %q doesn't match the schema", test.identity, got)
+		}
+	}
+}
+
+func TestSBOMRefs(t *testing.T) {
+	dir := t.TempDir()
+	src := path.Join(dir, "src", "example.com", "x")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// the command is at the root of its repository
+	main := "package main\n\nfunc main() {}\n"
+	if err := ioutil.WriteFile(path.Join(src, "main.go"), []byte(main), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Builder{
+		Name:      "d41d8cd98f00b204e9800998ecf8427e",
+		Workspace: dir,
+		Toolchain: "go version go1.21.0 linux/amd64",
+		Build: &Build{
+			Name:     "example.com/x",
+			Filename: "x",
+			When:     time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			Versions: map[string]string{"example.com/x": "0123456789abcdef0123456789abcdef01234567"},
+		},
+	}
+
+	sbom, err := NewSBOM(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs := map[string]bool{sbom.Metadata.Component.Ref: true}
+	for _, c := range sbom.Components {
+		if c.Ref == "" || refs[c.Ref] {
+			t.Errorf("component %s has the bom-ref %q of another", c.Name, c.Ref)
+		}
+
+		refs[c.Ref] = true
+	}
+
+	if len(sbom.Components) != 2 {
+		t.Errorf("listed %d components, want the repository and stdlib", len(sbom.Components))
+	}
+}
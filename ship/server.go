@@ -1,44 +1,63 @@
 package ship
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"html/template"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/datacratic/goship/deploy"
 )
 
 type Server struct {
-	Host     string
-	Root     string
-	Builds   string
-	Builders map[string]*Builder
-	Requests map[string]*Requests
-
-	apps map[string]map[string]*App
-	once sync.Once
-	feed chan func()
-
-	overview *template.Template
+	Host      string
+	Root      string
+	Builds    string
+	Builders  map[string]*Builder
+	Requests  map[string]*Requests
+	Allow     *Allowlist
+	Mirrors   *Mirrors
+	Auth      *Auth
+	Client    *http.Client
+	Scanner   *Scanner
+	Webhooks  []*Webhook
+	Watch     *Watch
+	Pipelines []*Pipeline
+	Go        string
+
+	store     *Store
+	apps      map[string]map[string]*App
+	running   map[string]*Builder
+	workers   map[string]*WorkerInfo
+	jobs      map[string]*job
+	queue     []*job
+	ready     chan struct{}
+	exposures []*Exposure
+	pipelines []*PipelineStatus
+	metrics   *metrics
+	stopping  bool
+	active    sync.WaitGroup
+	quit      chan struct{}
+	tasks     sync.WaitGroup
+	started   time.Time
+	wake      chan struct{}
+	once      sync.Once
+	feed      chan func()
 }
 
 type Requests struct {
 	Name        string
-	Root        string
 	Builds      []*Build
 	Deployments []*Deploy
-
-	output *os.File
-	stream *bufio.Writer
 }
 
 type App struct {
@@ -51,17 +70,36 @@ func (s *Server) initialize() {
 	s.Builders = make(map[string]*Builder)
 	s.Requests = make(map[string]*Requests)
 	s.apps = make(map[string]map[string]*App)
+	s.running = make(map[string]*Builder)
+	s.workers = make(map[string]*WorkerInfo)
+	s.jobs = make(map[string]*job)
+	s.ready = make(chan struct{})
+	s.quit = make(chan struct{})
+	s.metrics = newMetrics()
+
+	if s.Allow == nil {
+		s.Allow = DefaultAllowlist
+	}
 
-	s.readBuilds()
-	s.readRequests()
-	s.readApps()
+	if s.Client == nil {
+		s.Client = http.DefaultClient
+	}
 
-	var err error
-	s.overview, err = template.New("overview").Parse(htmlOverview)
-	if err != nil {
-		log.Fatal(err)
+	if s.Mirrors == nil {
+		s.Mirrors = &Mirrors{
+			Root: path.Join(s.Root, "mirrors"),
+		}
+	}
+
+	// workers build with the same version of Go as the server
+	if s.Go == "" {
+		s.Go, _ = goVersion()
 	}
 
+	s.readBuilds()
+	s.openStore()
+	s.readWorkspaces()
+
 	// process events
 	s.feed = make(chan func())
 	go func() {
@@ -83,67 +121,43 @@ func (s *Server) readBuilds() {
 		log.Fatal(err)
 	}
 
+	// clean interrupted writes
 	for _, entry := range entries {
-		name := entry.Name()
-
-		// clean possibly corrupted builds
-		if entry.IsDir() {
+		if name := entry.Name(); !entry.IsDir() && strings.HasSuffix(name, ".tmp") {
 			if err := os.RemoveAll(path.Join(s.Builds, name)); err != nil {
 				log.Fatal(err)
 			}
 
 			log.Println("removed", name)
-			continue
-		}
-
-		// import builders
-		i := strings.Index(name, ".")
-		if i < 0 {
-			log.Println("unknown", name)
-			continue
-		}
-
-		switch name[i+1:] {
-		case "json":
-			s.readBuilder(name[:i])
-
-		case "build", "gz":
-		default:
-			log.Println("unknown", name)
 		}
 	}
 }
 
 func (s *Server) readBuilder(name string) {
-	b, ok := s.Builders[name]
-	if !ok {
-		b = &Builder{
-			Name: name,
-			Root: s.Root,
-		}
-
-		s.Builders[name] = b
-	}
-
-	file, err := os.Open(path.Join(s.Builds, name+".json"))
+	filename := path.Join(s.Builds, name+".json")
+	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = json.NewDecoder(file).Decode(b)
-	if err != nil {
-		log.Fatal(err)
+	b := &Builder{
+		Name: name,
+		Root: s.Builds,
+	}
+
+	if err = json.Unmarshal(data, b); err != nil {
+		s.quarantine(filename, err)
+		return
 	}
+
+	s.Builders[name] = b
 }
 
 func (s *Server) readRequests() {
 	root := path.Join(s.Root, "logs")
 
-	// make sure the root directory for requests exists
-	os.MkdirAll(root, 0755)
-
 	// inspect it
-	entries, err := ioutil.ReadDir(root)
+	entries, err := readDir(root)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -162,44 +176,47 @@ func (s *Server) readRequests() {
 			continue
 		}
 
-		file, err := os.Open(path.Join(root, name))
+		kind := name[i+1:]
+		if kind != "build" && kind != "deploy" {
+			continue
+		}
+
+		filename := path.Join(root, name)
+		data, err := ioutil.ReadFile(filename)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		lines := bufio.NewScanner(file)
+		// keep the valid lines of damaged files
+		damaged := 0
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
 
-		switch name[i+1:] {
-		case "build":
-			for lines.Scan() {
+			if kind == "build" {
 				b := new(Build)
-				if err = json.Unmarshal(lines.Bytes(), b); err != nil {
-					break
+				if json.Unmarshal(line, b) != nil {
+					damaged++
+					continue
 				}
 
 				r := s.get(b.Filename)
 				r.Builds = append(r.Builds, b)
-			}
-
-		case "deploy":
-			for lines.Scan() {
+			} else {
 				d := new(Deploy)
-				if err = json.Unmarshal(lines.Bytes(), d); err != nil {
-					break
+				if json.Unmarshal(line, d) != nil {
+					damaged++
+					continue
 				}
 
 				r := s.get(d.Filename)
 				r.Deployments = append(r.Deployments, d)
 			}
-
 		}
 
-		if err != nil {
-			log.Fatal("failed to parse", file.Name(), err)
-		}
-
-		if err = lines.Err(); err != nil {
-			log.Fatal(err)
+		if damaged != 0 {
+			s.quarantine(filename, fmt.Errorf("skipped %d damaged records", damaged))
 		}
 	}
 }
@@ -207,11 +224,8 @@ func (s *Server) readRequests() {
 func (s *Server) readApps() {
 	root := path.Join(s.Root, "apps")
 
-	// make sure the root directory for requests exists
-	os.MkdirAll(root, 0755)
-
 	// inspect it
-	entries, err := ioutil.ReadDir(root)
+	entries, err := readDir(root)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -222,74 +236,110 @@ func (s *Server) readApps() {
 		}
 
 		name := entry.Name()
-
-		file, err := os.Open(path.Join(root, name))
+		filename := path.Join(root, name)
+		data, err := ioutil.ReadFile(filename)
 		if err != nil {
 			log.Fatal(err)
 		}
 
 		items := make(map[string]*App)
-
-		err = json.NewDecoder(file).Decode(&items)
-		if err != nil {
-			log.Fatal(err)
+		if err = json.Unmarshal(data, &items); err != nil {
+			s.quarantine(filename, err)
+			continue
 		}
 
 		s.apps[name] = items
 	}
 }
-func (s *Server) Write(w http.ResponseWriter) {
-	w.Header().Set("Content-Type", "text/html")
 
-	done := make(chan struct{})
-	s.feed <- func() {
-		err := s.overview.Execute(w, s)
-		if err != nil {
-			log.Println(err)
-		}
+func (s *Server) Start() (err error) {
+	s.once.Do(s.initialize)
 
-		close(done)
+	if err = s.startWebhooks(); err != nil {
+		return
 	}
 
-	<-done
-}
-
-func (s *Server) Start() (err error) {
-	s.once.Do(s.initialize)
+	http.HandleFunc("/builds/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeError(w, newError(http.StatusMethodNotAllowed, CodeMethod, "method not allowed"))
+			return
+		}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != "/" {
+		// artifacts, bills of materials and build logs
+		if !strings.HasSuffix(r.URL.Path, ".gz") && !strings.HasSuffix(r.URL.Path, ".sbom.json") && !strings.HasSuffix(r.URL.Path, ".build") {
 			http.NotFound(w, r)
 			return
 		}
 
-		s.Write(w)
+		// instances sign the path of the artifacts
+		if s.Auth == nil || !s.Auth.Instance(r, []byte(r.URL.Path)) {
+			if _, ok := s.authenticate(w, r); !ok {
+				return
+			}
+		}
+
+		name := path.Join(s.Root, r.URL.Path)
+		if _, err := os.Stat(name); err != nil {
+			writeError(w, notFound("no such file '%s'", path.Base(name)))
+			return
+		}
+
+		http.ServeFile(w, r, name)
 	})
 
-	http.HandleFunc("/builds/", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/diff", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
-			http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+			writeError(w, newError(http.StatusMethodNotAllowed, CodeMethod, "method not allowed"))
 			return
 		}
 
-		if !strings.HasSuffix(r.URL.Path, ".gz") {
-			http.NotFound(w, r)
+		if _, ok := s.authenticate(w, r); !ok {
 			return
 		}
 
-		http.ServeFile(w, r, path.Join(s.Root, r.URL.Path))
+		d, err := s.Diff(r.FormValue("from"), r.FormValue("to"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d)
 	})
 
 	decode := func(w http.ResponseWriter, r *http.Request, q interface{}) {
 		if r.Method != "POST" {
-			http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+			writeError(w, newError(http.StatusMethodNotAllowed, CodeMethod, "method not allowed"))
+			return
+		}
+
+		name, ok := s.authenticate(w, r)
+		if !ok {
 			return
 		}
 
 		err := json.NewDecoder(r.Body).Decode(q)
 		r.Body.Close()
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, invalid("%s", err.Error()))
+			return
+		}
+
+		// don't trust the user reported by the client
+		if s.Auth != nil {
+			identify(q, name)
+		}
+
+		// structured results for clients asking for them
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			result, err := s.Handle(ioutil.Discard, q)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(result)
 			return
 		}
 
@@ -297,7 +347,7 @@ func (s *Server) Start() (err error) {
 
 		err = s.Process(w, q)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusNotFound)
+			writeError(w, err)
 			return
 		}
 	}
@@ -306,22 +356,89 @@ func (s *Server) Start() (err error) {
 		decode(w, r, new(Build))
 	})
 
+	http.HandleFunc("/request/lock", func(w http.ResponseWriter, r *http.Request) {
+		decode(w, r, new(Lock))
+	})
+
+	http.HandleFunc("/request/remote", func(w http.ResponseWriter, r *http.Request) {
+		decode(w, r, new(Remote))
+	})
+
+	http.HandleFunc("/request/cancel", func(w http.ResponseWriter, r *http.Request) {
+		decode(w, r, new(Cancel))
+	})
+
 	http.HandleFunc("/request/deploy", func(w http.ResponseWriter, r *http.Request) {
 		decode(w, r, new(Deploy))
 	})
 
+	http.HandleFunc("/request/approve", func(w http.ResponseWriter, r *http.Request) {
+		decode(w, r, new(Approval))
+	})
+
+	http.HandleFunc("/app/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeError(w, newError(http.StatusMethodNotAllowed, CodeMethod, "method not allowed"))
+			return
+		}
+
+		if _, ok := s.authenticate(w, r); !ok {
+			return
+		}
+
+		result, err := s.Status(r.FormValue("app"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+
+	s.startAPI()
+	s.startDashboard()
+	s.startMetrics()
+	s.startWorkers()
+
+	if s.Watch != nil {
+		s.startPush()
+	}
+
+	if s.Scanner != nil {
+		s.tasks.Add(1)
+		go s.watch()
+	}
+
+	if len(s.Pipelines) != 0 {
+		if err = s.startPipelines(); err != nil {
+			return
+		}
+	}
+
 	http.HandleFunc("/app/instance", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
-			http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+			writeError(w, newError(http.StatusMethodNotAllowed, CodeMethod, "method not allowed"))
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			writeError(w, invalid("%s", err.Error()))
+			return
+		}
+
+		if s.Auth != nil && !s.Auth.Instance(r, body) {
+			writeError(w, newError(http.StatusUnauthorized, CodeUnauthorized, "unauthorized"))
 			return
 		}
 
 		item := new(App)
 
-		err := json.NewDecoder(r.Body).Decode(&item)
-		r.Body.Close()
+		err = json.Unmarshal(body, item)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, invalid("%s", err.Error()))
 			return
 		}
 
@@ -333,30 +450,165 @@ func (s *Server) Start() (err error) {
 			}
 
 			instances[item.URL] = item
-			body, err := json.MarshalIndent(&instances, "", "\t")
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			err = ioutil.WriteFile(path.Join(s.Root, "apps", item.Name), body, 0666)
-			if err != nil {
-				log.Fatal(err)
-			}
+			s.saveApp(item)
 		}
 	})
 	return
 }
 
+// authenticate returns the name of the user making the request or rejects it
+// when authentication is enabled.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (name string, ok bool) {
+	if s.Auth == nil {
+		ok = true
+		return
+	}
+
+	name, ok = s.Auth.User(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, newError(http.StatusUnauthorized, CodeUnauthorized, "unauthorized"))
+	}
+
+	return
+}
+
 func (s *Server) Process(w io.Writer, r interface{}) (err error) {
+	result, err := s.Handle(w, r)
+	if err != nil {
+		return
+	}
+
+	switch r := result.(type) {
+	case *BuildResult:
+		io.WriteString(w, r.ID)
+	case *Cancel:
+		io.WriteString(w, "canceled "+r.ID)
+	case *Promotion:
+		io.WriteString(w, "approved "+r.Build+" for "+r.Stage)
+	}
+
+	return
+}
+
+// Handle processes a request and returns its result. Progress is reported as
+// text to the writer while the request runs.
+func (s *Server) Handle(w io.Writer, r interface{}) (result interface{}, err error) {
 	switch r := r.(type) {
 	case *Build:
-		err = s.makeBuilder(w, r)
+		result, err = s.makeBuilder(r)
+	case *Lock:
+		if err = r.check(); err != nil {
+			err = invalid("%s", err.Error())
+			return
+		}
+
+		result, err = s.makeBuilder(r.Build())
+	case *Remote:
+		result, err = s.makeRemote(r)
 	case *Deploy:
-		err = s.makeDeploy(w, r)
+		result, err = s.makeDeploy(w, r)
+	case *Cancel:
+		result, err = r, s.cancel(r)
+	case *Approval:
+		result, err = s.approve(r)
 	default:
-		err = fmt.Errorf("unknown type of request: %T", r)
+		err = invalid("unknown type of request: %T", r)
+	}
+
+	return
+}
+
+func (s *Server) Diff(from, to string) (d *Diff, err error) {
+	s.once.Do(s.initialize)
+
+	done := make(chan struct{})
+	s.feed <- func() {
+		defer close(done)
+
+		a, ok := s.Builders[from]
+		if !ok {
+			err = notFound("unknown build '%s'", from)
+			return
+		}
+
+		b, ok := s.Builders[to]
+		if !ok {
+			err = notFound("unknown build '%s'", to)
+			return
+		}
+
+		d = NewDiff(a, b)
+	}
+
+	<-done
+	if err != nil {
+		return
+	}
+
+	d.Log(s.Mirrors)
+	return
+}
+
+// Status queries the current version of every instance of an application.
+func (s *Server) Status(name string) (result []*InstanceStatus, err error) {
+	s.once.Do(s.initialize)
+
+	var hosts []string
+
+	done := make(chan struct{})
+	s.feed <- func() {
+		for host := range s.apps[name] {
+			hosts = append(hosts, host)
+		}
+
+		close(done)
+	}
+
+	<-done
+	if len(hosts) == 0 {
+		err = notFound("no instance of '%s' is registered", name)
+		return
+	}
+
+	sort.Strings(hosts)
+	result = make([]*InstanceStatus, len(hosts))
+
+	wait := sync.WaitGroup{}
+	for i, host := range hosts {
+		wait.Add(1)
+		go func(i int, host string) {
+			defer wait.Done()
+
+			start := time.Now()
+			item := &InstanceStatus{
+				Host: host,
+			}
+
+			r, err := s.Client.Get(URL(host) + "/deploy/version")
+			if err == nil {
+				var text []byte
+				text, err = ioutil.ReadAll(r.Body)
+				r.Body.Close()
+
+				item.OK = err == nil && r.StatusCode == http.StatusOK
+				if item.OK {
+					item.Version = strings.TrimSpace(string(text))
+				} else if err == nil {
+					item.Message = r.Status
+				}
+			}
+
+			if err != nil {
+				item.Message = err.Error()
+			}
+
+			item.Duration = time.Since(start).Seconds()
+			result[i] = item
+		}(i, host)
 	}
 
+	wait.Wait()
 	return
 }
 
@@ -364,7 +616,6 @@ func (s *Server) get(name string) *Requests {
 	r, ok := s.Requests[name]
 	if !ok {
 		r = &Requests{
-			Root: path.Join(s.Root, "logs"),
 			Name: name,
 		}
 
@@ -374,143 +625,330 @@ func (s *Server) get(name string) *Requests {
 	return r
 }
 
-func (s *Server) makeBuilder(w io.Writer, b *Build) (err error) {
+func (s *Server) makeBuilder(b *Build) (result *BuildResult, err error) {
 	s.once.Do(s.initialize)
 
 	// record the time when the request was received
 	b.When = time.Now().UTC()
 
+	if err = s.begin(); err != nil {
+		return
+	}
+
+	defer s.end()
+
+	// reject unexpected flags before doing anything
+	if err = s.Allow.Check(&b.Flags); err != nil {
+		err = &Error{
+			Status:  http.StatusForbidden,
+			Code:    CodeForbidden,
+			Message: err.Error(),
+			Stage:   "validate",
+		}
+
+		return
+	}
+
+	if err = checkVersions(b.Versions); err != nil {
+		return
+	}
+
+	if err = checkPackage(b.Name); err != nil {
+		return
+	}
+
 	// new workspace
 	dir, err := ioutil.TempDir(s.Builds, b.Filename+"-")
 	if err != nil {
 		return
 	}
 
+	if err = checkpoint(dir, b); err != nil {
+		return
+	}
+
 	// keep track of the build request
 	s.feed <- func() {
 		r := s.get(b.Filename)
 		r.Builds = append(r.Builds, b)
-		r.save(b)
+		s.saveBuild(b)
 	}
 
 	builder := &Builder{
 		Workspace: dir,
 		Root:      s.Builds,
 		Build:     b,
+		Mirrors:   s.Mirrors,
+		Scanner:   s.Scanner,
 	}
 
+	// allow the build to be listed and canceled while it runs
+	job := path.Base(dir)
+	s.feed <- func() {
+		s.running[job] = builder
+	}
+
+	s.notify(s.buildEvent(EventBuildStarted, job, builder, nil))
+
 	// build
-	name, err := builder.Make()
+	name, err := s.make(job, builder)
+
+	s.feed <- func() {
+		delete(s.running, job)
+	}
+
+	s.measureBuild(builder, err)
+
+	if e, ok := err.(*Error); ok && e.Code == CodeCanceled && s.draining() {
+		s.interrupt(job, b, "the server was stopped")
+	}
+
 	if err != nil {
+		if e, ok := err.(*Error); ok && e.Log != "" {
+			e.Log = s.Host + "/builds/" + e.Log
+		}
+
+		s.notify(s.buildEvent(EventBuildFailed, job, builder, err))
 		return
 	}
 
 	// keep track of the build
 	s.feed <- func() {
 		s.Builders[name] = builder
+		s.saveBuilder(builder)
+	}
+
+	s.notify(s.buildEvent(EventBuildSucceeded, name, builder, nil))
+
+	result = &BuildResult{
+		ID:        name,
+		URL:       s.artifact(name),
+		Package:   b.Name,
+		Identity:  builder.Identity,
+		Toolchain: builder.Toolchain,
+		Versions:  b.Versions,
+		Flags:     b.Flags,
+		Findings:  builder.Findings,
+		Duration:  time.Since(b.When).Seconds(),
 	}
 
-	io.WriteString(w, name)
 	return
 }
 
-func (s *Server) makeDeploy(w io.Writer, d *Deploy) (err error) {
+func (s *Server) makeRemote(r *Remote) (result *BuildResult, err error) {
 	s.once.Do(s.initialize)
 
-	hosts, ok := s.apps[d.Filename]
-	if ok {
+	if err = s.begin(); err != nil {
+		return
+	}
+
+	defer s.end()
+
+	if r.Name == "" {
+		err = invalid("missing command package")
+		return
+	}
+
+	if err = r.check(); err != nil {
+		return
+	}
+
+	// resolve the dependencies in a workspace of their own
+	dir, err := ioutil.TempDir(s.Builds, path.Base(r.Name)+"-")
+	if err != nil {
+		return
+	}
+
+	defer os.RemoveAll(dir)
+
+	b, err := r.Resolve(dir, s.Mirrors)
+	if err != nil {
+		err = failed("resolve", err)
+		return
+	}
+
+	result, err = s.makeBuilder(b)
+	return
+}
+
+// artifact returns the URL used to download a build.
+func (s *Server) artifact(name string) string {
+	return s.Host + "/builds/" + name + ".gz"
+}
+
+// previous returns the version deployed before the current one.
+func (s *Server) previous(name string) (result string, err error) {
+	done := make(chan struct{})
+	s.feed <- func() {
+		defer close(done)
+
+		r, ok := s.Requests[name]
+		if !ok || len(r.Deployments) == 0 {
+			return
+		}
+
+		current := r.Deployments[len(r.Deployments)-1].Version
+		for i := len(r.Deployments) - 2; i >= 0; i-- {
+			if v := r.Deployments[i].Version; v != "" && v != current {
+				result = v
+				return
+			}
+		}
+	}
+
+	<-done
+	if result == "" {
+		err = notFound("no previous version of '%s' to roll back to", name)
+	}
+
+	return
+}
+
+func (s *Server) makeDeploy(w io.Writer, d *Deploy) (result *DeployResult, err error) {
+	s.once.Do(s.initialize)
+
+	if err = s.begin(); err != nil {
+		return
+	}
+
+	defer s.end()
+
+	var hosts []string
+
+	done := make(chan struct{})
+	s.feed <- func() {
+		for host := range s.apps[d.Filename] {
+			hosts = append(hosts, host)
+		}
+
+		close(done)
+	}
+
+	<-done
+	if len(hosts) == 0 {
+		err = notFound("no instance of '%s' is registered", d.Filename)
 		return
 	}
 
 	// record the time when the request was received
 	d.When = time.Now().UTC()
 
+	// an empty version means a rollback
+	if d.Version == "" {
+		if d.Version, err = s.previous(d.Filename); err != nil {
+			return
+		}
+	}
+
+	// other servers may hold the artifact
+	if _, e := os.Stat(path.Join(s.Builds, path.Base(d.Version)+".gz")); e != nil {
+		err = notFound("build '%s' is not on this server", d.Version)
+		return
+	}
+
 	r := struct {
-		URL string `json:"url"`
-		MD5 string `json:"md5"`
+		URL  string    `json:"url"`
+		MD5  string    `json:"md5"`
+		When time.Time `json:"when"`
 	}{
-		URL: s.Host + "/versions/" + d.Version + ".gz",
-		MD5: d.Version,
+		URL:  s.artifact(d.Version),
+		MD5:  d.Version,
+		When: d.When,
 	}
 
 	body, err := json.Marshal(&r)
 	if err != nil {
-		log.Fatal(err)
+		return
 	}
 
-	done := make(chan string, len(hosts))
+	started := *d
+	s.notify(deployEvent(EventDeployStarted, &started, nil))
+
+	results := make(chan *HostResult)
 
 	update := func(host string) {
-		r, err := http.Post("http://"+host+"/deploy/new", "application/json", bytes.NewReader(body))
+		start := time.Now()
+		h := &HostResult{
+			Host: host,
+		}
+
+		defer func() {
+			h.Duration = time.Since(start).Seconds()
+			results <- h
+		}()
+
+		req, err := http.NewRequest("POST", URL(host)+"/deploy/new", bytes.NewReader(body))
+		if err != nil {
+			h.Message = err.Error()
+			return
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		if s.Auth != nil && s.Auth.Secret != "" {
+			deploy.SignRequest(s.Auth.Secret, req, body)
+		}
+
+		r, err := s.Client.Do(req)
 		if err != nil {
 			log.Println(host, err)
-			done <- host + " " + err.Error()
+			h.Message = err.Error()
 			return
 		}
 
-		io.Copy(os.Stdout, r.Body)
-		done <- host + " OK"
+		// instances exit right after replying so the body may be cut short
+		text, _ := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+
+		h.Message = strings.TrimSpace(string(text))
+		h.OK = r.StatusCode == http.StatusOK
 	}
 
-	// send update requests
-	n := 0
+	// send update requests once to each matching host
+	selected := make(map[string]bool)
 	for _, item := range d.Targets {
-		for host, _ := range hosts {
-			if !strings.Contains(host, item) {
+		for _, host := range hosts {
+			if !strings.Contains(host, item) || selected[host] {
 				continue
 			}
 
-			n++
+			selected[host] = true
 			go update(host)
 		}
 	}
 
+	result = &DeployResult{
+		Package: d.Name,
+		Version: d.Version,
+		URL:     r.URL,
+	}
+
 	// wait for the requests to complete
-	lines := make([]string, n)
-	for i := 0; i < n; i++ {
-		lines[i] = <-done
-		fmt.Fprintf(w, "%s\n", lines[i])
+	lines := make([]string, 0, len(selected))
+	for range selected {
+		h := <-results
+		result.Hosts = append(result.Hosts, h)
+		lines = append(lines, h.String())
+		fmt.Fprintf(w, "%s\n", h)
+		s.notify(deployEvent(EventDeployHost, &started, h))
 	}
 
+	result.Duration = time.Since(d.When).Seconds()
+
+	s.measureDeploy(d, result)
+
+	completed := started
+	completed.Logs = lines
+	completed.Results = result.Hosts
+	s.notify(deployEvent(EventDeployCompleted, &completed, nil))
+
 	// keep track of the deployment request
 	s.feed <- func() {
 		r := s.get(d.Filename)
 		d.Logs = lines
+		d.Results = result.Hosts
 		r.Deployments = append(r.Deployments, d)
-		r.save(d)
+		s.saveDeploy(d)
 	}
 
 	return
 }
-
-func (r *Requests) save(item interface{}) {
-	// get type
-	kind := strings.ToLower(strings.TrimPrefix(fmt.Sprintf("%T", item), "*ship."))
-
-	// and type filename
-	name := fmt.Sprintf("%s-%s.%s", r.Name, time.Now().UTC().Format("20060102"), kind)
-
-	// to get the log file
-	filename := path.Join(r.Root, name)
-	if r.output == nil || r.output.Name() != filename {
-		if r.output != nil {
-			r.stream.Flush()
-			r.output.Close()
-		}
-
-		output, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		r.output = output
-		r.stream = bufio.NewWriter(r.output)
-	}
-
-	err := json.NewEncoder(r.stream).Encode(item)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	r.stream.Flush()
-}
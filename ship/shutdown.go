@@ -0,0 +1,273 @@
+package ship
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+// ShutdownGrace bounds the time given to the canceled builds and to the
+// running deployments to stop once the deadline of a shutdown is reached.
+var ShutdownGrace = 10 * time.Second
+
+// Interruption records a build stopped because the server was.
+type Interruption struct {
+	ID     string    `json:"id"`
+	Build  *Build    `json:"build"`
+	When   time.Time `json:"when"`
+	Reason string    `json:"reason"`
+}
+
+const maxInterruptions = 100
+
+func unavailable() *Error {
+	return newError(http.StatusServiceUnavailable, CodeUnavailable, "server is shutting down")
+}
+
+// begin registers a build or a deployment unless the server is shutting
+// down. end must be called once it completes.
+func (s *Server) begin() (err error) {
+	s.call(func() {
+		if s.stopping {
+			err = unavailable()
+			return
+		}
+
+		s.active.Add(1)
+	})
+
+	return
+}
+
+func (s *Server) end() {
+	s.active.Done()
+}
+
+func (s *Server) draining() (result bool) {
+	s.call(func() {
+		result = s.stopping
+	})
+
+	return
+}
+
+// Shutdown refuses new builds and deployments and waits for the running ones
+// until the context is done. Builds still running then are canceled and
+// recorded as interrupted. The pipelines and the webhooks are stopped last.
+func (s *Server) Shutdown(ctx context.Context) (err error) {
+	s.once.Do(s.initialize)
+
+	s.call(func() {
+		s.stopping = true
+
+		// workers waiting for builds are told to come back later
+		s.signal()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.interruptBuilds(done)
+	}
+
+	s.stop()
+	return
+}
+
+// interruptBuilds stops the running builds and waits for the running deployments.
+func (s *Server) interruptBuilds(done chan struct{}) {
+	s.call(func() {
+		for id, b := range s.running {
+			log.Println("canceling build", id)
+			b.Cancel()
+		}
+	})
+
+	select {
+	case <-done:
+	case <-time.After(ShutdownGrace):
+		log.Println("giving up on the running deployments")
+	}
+}
+
+// stop ends the pipelines and the scans of vulnerabilities and sends the
+// pending events to the webhooks, once each, so that nothing writes to the
+// state once it's closed.
+func (s *Server) stop() {
+	if s.stopped() {
+		return
+	}
+
+	close(s.quit)
+
+	done := make(chan struct{})
+	go func() {
+		s.tasks.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(ShutdownGrace):
+		log.Println("giving up on the background tasks")
+	}
+}
+
+// stopped reports whether the background tasks must stop.
+func (s *Server) stopped() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close releases the state of the server once it is shut down.
+func (s *Server) Close() error {
+	s.once.Do(s.initialize)
+
+	s.stop()
+	return s.store.Close()
+}
+
+// interrupt records a build stopped by the server.
+func (s *Server) interrupt(id string, b *Build, reason string) {
+	log.Printf("build %s of %s was interrupted: %s", id, b.Name, reason)
+
+	item := &Interruption{
+		ID:     id,
+		Build:  b,
+		When:   time.Now().UTC(),
+		Reason: reason,
+	}
+
+	s.update(func(tx *Tx) (err error) {
+		if err = tx.Put("interrupted", timeKey(item.When)+"/"+id, item); err != nil {
+			return
+		}
+
+		keys := tx.Keys("interrupted", "")
+		for i := 0; i < len(keys)-maxInterruptions; i++ {
+			if err = tx.Delete("interrupted", keys[i]); err != nil {
+				return
+			}
+		}
+
+		return
+	})
+}
+
+// interruptions returns the latest interrupted builds.
+func (s *Server) interruptions() (result []*Interruption, err error) {
+	err = s.store.View(func(tx *Tx) (err error) {
+		for _, key := range tx.Keys("interrupted", "") {
+			item := new(Interruption)
+			if _, err = tx.Get("interrupted", key, item); err != nil {
+				return
+			}
+
+			result = append(result, item)
+		}
+
+		return
+	})
+
+	return
+}
+
+func (s *Server) interrupted(item *Interruption) (result *BuildInfo) {
+	result = s.info(item.ID, &Builder{Build: item.Build}, false)
+	result.URL = ""
+	result.Interrupted = item.Reason
+	return
+}
+
+// checkpoint keeps the request of a build in its workspace so that it can be
+// recorded if the server stops during the build.
+func checkpoint(dir string, b *Build) (err error) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return
+	}
+
+	err = writeFile(path.Join(dir, "build.json"), data, 0644)
+	return
+}
+
+// readWorkspaces records the builds interrupted by a crash of the server,
+// keeping their log, and removes the workspaces left behind.
+func (s *Server) readWorkspaces() {
+	entries, err := ioutil.ReadDir(s.Builds)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		name := entry.Name()
+		dir := path.Join(s.Builds, name)
+
+		// finished builds move their log out of the workspace
+		if _, err := os.Stat(path.Join(dir, "log")); err == nil {
+			b := new(Build)
+			if data, err := ioutil.ReadFile(path.Join(dir, "build.json")); err == nil && json.Unmarshal(data, b) == nil {
+				s.recover(name, dir, b)
+			}
+		}
+
+		if err := os.RemoveAll(dir); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Println("removed", name)
+	}
+}
+
+func (s *Server) recover(name, dir string, b *Build) {
+	reason := "the server stopped during the build"
+
+	f, err := os.OpenFile(path.Join(dir, "log"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err == nil {
+		fmt.Fprintf(f, "%s %s\n", time.Now().Format("2006/01/02 15:04:05.000000"), reason)
+		err = f.Close()
+	}
+
+	if err == nil {
+		err = os.Rename(path.Join(dir, "log"), path.Join(s.Builds, name+".build"))
+	}
+
+	if err != nil {
+		log.Println(err)
+	}
+
+	s.interrupt(name, b, reason)
+}
+
+// interruption returns an interrupted build.
+func (s *Server) interruption(id string) (result *Interruption, err error) {
+	list, err := s.interruptions()
+	for _, item := range list {
+		if item.ID == id {
+			result = item
+		}
+	}
+
+	return
+}
@@ -0,0 +1,368 @@
+package ship
+
+import (
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// The state of the server is kept in a store with the following buckets:
+//
+//	builders  completed builds by ID
+//	builds    build requests by time
+//	deploys   deployment requests by time
+//	apps      registered instances by application and URL
+//
+// Builds and deployments are indexed by package, application and user, and
+// deployments by version.
+
+// timeKey formats a time so that keys sort chronologically.
+func timeKey(t time.Time) string {
+	return t.UTC().Format("20060102T150405.000000000Z")
+}
+
+// openStore opens the state of the server, importing the files written by
+// earlier versions the first time.
+func (s *Server) openStore() {
+	var err error
+	if s.store, err = OpenStore(path.Join(s.Root, "state.db")); err != nil {
+		log.Fatal(err)
+	}
+
+	if n := s.store.Quarantined; n != 0 {
+		log.Printf("%s: moved %d damaged records to quarantine", s.store.Filename, n)
+	}
+
+	var migrated bool
+	s.store.View(func(tx *Tx) (err error) {
+		migrated, err = tx.Get("meta", "migrated", new(time.Time))
+		return
+	})
+
+	if !migrated {
+		s.migrate()
+		return
+	}
+
+	s.load()
+}
+
+// migrate imports the builds, requests and instances kept as loose files.
+func (s *Server) migrate() {
+	s.readBuilders()
+	s.readRequests()
+	s.readApps()
+
+	err := s.store.Update(func(tx *Tx) (err error) {
+		for _, b := range s.Builders {
+			if err = putBuilder(tx, b); err != nil {
+				return
+			}
+		}
+
+		for _, r := range s.Requests {
+			for _, b := range r.Builds {
+				if err = putBuild(tx, b); err != nil {
+					return
+				}
+			}
+
+			for _, d := range r.Deployments {
+				if err = putDeploy(tx, d); err != nil {
+					return
+				}
+			}
+		}
+
+		for _, instances := range s.apps {
+			for _, a := range instances {
+				if err = tx.Put("apps", a.Name+"/"+a.URL, a); err != nil {
+					return
+				}
+			}
+		}
+
+		err = tx.Put("meta", "migrated", time.Now().UTC())
+		return
+	})
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("imported %d builds and the requests of %d applications", len(s.Builders), len(s.Requests))
+}
+
+// load reads the state of the server from the store.
+func (s *Server) load() {
+	err := s.store.View(func(tx *Tx) (err error) {
+		for _, key := range tx.Keys("builders", "") {
+			b := &Builder{Root: s.Builds}
+			if _, err = tx.Get("builders", key, b); err != nil {
+				return
+			}
+
+			s.Builders[key] = b
+		}
+
+		for _, key := range tx.Keys("builds", "") {
+			b := new(Build)
+			if _, err = tx.Get("builds", key, b); err != nil {
+				return
+			}
+
+			r := s.get(b.Filename)
+			r.Builds = append(r.Builds, b)
+		}
+
+		for _, key := range tx.Keys("deploys", "") {
+			d := new(Deploy)
+			if _, err = tx.Get("deploys", key, d); err != nil {
+				return
+			}
+
+			r := s.get(d.Filename)
+			r.Deployments = append(r.Deployments, d)
+		}
+
+		for _, key := range tx.Keys("apps", "") {
+			a := new(App)
+			if _, err = tx.Get("apps", key, a); err != nil {
+				return
+			}
+
+			instances, ok := s.apps[a.Name]
+			if !ok {
+				instances = make(map[string]*App)
+				s.apps[a.Name] = instances
+			}
+
+			instances[a.URL] = a
+		}
+
+		return
+	})
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func putBuilder(tx *Tx, b *Builder) (err error) {
+	old := new(Builder)
+	ok, err := tx.Get("builders", b.Name, old)
+	if err != nil {
+		return
+	}
+
+	if err = tx.Put("builders", b.Name, b); err != nil {
+		return
+	}
+
+	var key, previous string
+	var fields, stale map[string]string
+	if b.Build != nil {
+		key, fields = builderIndex(b)
+	}
+
+	if ok && old.Build != nil {
+		previous, stale = builderIndex(old)
+	}
+
+	if previous != "" && previous != key {
+		if err = tx.Delete("index:builders:time", previous); err != nil {
+			return
+		}
+	}
+
+	if key != "" {
+		// keep the builds in chronological order in the indexes
+		if err = tx.Put("index:builders:time", key, true); err != nil {
+			return
+		}
+	}
+
+	// a build is known by its workspace while it runs
+	if b.Workspace != "" {
+		if err = tx.Put("aliases", path.Base(b.Workspace), b.Name); err != nil {
+			return
+		}
+	}
+
+	err = reindex(tx, "builders", previous, stale, key, fields)
+	return
+}
+
+func builderIndex(b *Builder) (key string, fields map[string]string) {
+	// list a build where it was while running, so that pages don't move
+	// once it completes
+	key = timeKey(b.Build.When) + "/" + b.Name
+	if b.Workspace != "" {
+		key = timeKey(b.Build.When) + "/" + path.Base(b.Workspace) + "/" + b.Name
+	}
+
+	fields = map[string]string{
+		"package": b.Build.Name,
+		"app":     b.Build.Filename,
+		"user":    b.Build.User,
+	}
+
+	return
+}
+
+func putBuild(tx *Tx, b *Build) (err error) {
+	key := timeKey(b.When) + "/" + b.Filename
+
+	old := new(Build)
+	ok, err := tx.Get("builds", key, old)
+	if err != nil {
+		return
+	}
+
+	if err = tx.Put("builds", key, b); err != nil {
+		return
+	}
+
+	var stale map[string]string
+	if ok {
+		stale = buildIndex(old)
+	}
+
+	err = reindex(tx, "builds", key, stale, key, buildIndex(b))
+	return
+}
+
+func buildIndex(b *Build) map[string]string {
+	return map[string]string{
+		"package": b.Name,
+		"app":     b.Filename,
+		"user":    b.User,
+	}
+}
+
+func putDeploy(tx *Tx, d *Deploy) (err error) {
+	key := timeKey(d.When) + "/" + d.Filename
+
+	old := new(Deploy)
+	ok, err := tx.Get("deploys", key, old)
+	if err != nil {
+		return
+	}
+
+	if err = tx.Put("deploys", key, d); err != nil {
+		return
+	}
+
+	var stale map[string]string
+	if ok {
+		stale = deployIndex(old)
+	}
+
+	err = reindex(tx, "deploys", key, stale, key, deployIndex(d))
+	return
+}
+
+func deployIndex(d *Deploy) map[string]string {
+	return map[string]string{
+		"package": d.Name,
+		"app":     d.Filename,
+		"user":    d.User,
+		"version": d.Version,
+	}
+}
+
+// reindex replaces the index entries of the previous version of a record by
+// the entries of the new one.
+func reindex(tx *Tx, bucket, previous string, stale map[string]string, key string, fields map[string]string) (err error) {
+	for field, value := range stale {
+		if value == "" || (previous == key && fields[field] == value) {
+			continue
+		}
+
+		if err = tx.Unindex(bucket, field, value, previous); err != nil {
+			return
+		}
+	}
+
+	for field, value := range fields {
+		if value == "" {
+			continue
+		}
+
+		if err = tx.Index(bucket, field, value, key); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (s *Server) update(f func(tx *Tx) error) {
+	err := s.store.Update(f)
+	if err == ErrClosed {
+		log.Println("dropping a change made once the server stopped")
+		return
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (s *Server) saveBuilder(b *Builder) {
+	s.update(func(tx *Tx) error {
+		return putBuilder(tx, b)
+	})
+}
+
+func (s *Server) saveBuild(b *Build) {
+	s.update(func(tx *Tx) error {
+		return putBuild(tx, b)
+	})
+}
+
+func (s *Server) saveDeploy(d *Deploy) {
+	s.update(func(tx *Tx) error {
+		return putDeploy(tx, d)
+	})
+}
+
+func (s *Server) saveApp(a *App) {
+	s.update(func(tx *Tx) error {
+		return tx.Put("apps", a.Name+"/"+a.URL, a)
+	})
+}
+
+// readBuilders imports the state files of the builds.
+func (s *Server) readBuilders() {
+	entries, err := readDir(s.Builds)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasSuffix(name, ".json") && !strings.HasSuffix(name, ".sbom.json") {
+			s.readBuilder(strings.TrimSuffix(name, ".json"))
+		}
+	}
+}
+
+// readDir lists a directory, which may not exist.
+func readDir(dir string) (result []os.FileInfo, err error) {
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	result, err = f.Readdir(-1)
+	return
+}
@@ -0,0 +1,553 @@
+package ship
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Store is an embedded transactional key/value store. Values are JSON
+// documents grouped in buckets and kept in memory. Every transaction is
+// appended to a journal as a single checksummed record that is synced before
+// the transaction is applied, so that a transaction is either entirely
+// replayed when the store is opened again or not at all. The journal is
+// compacted once it mostly holds outdated records.
+//
+// Damaged records, such as the last one when the machine crashed while it was
+// written, are moved to the quarantine directory beside the journal when the
+// store is opened and counted in Quarantined.
+//
+// A single process can open the store at a time, which is enforced by an
+// exclusive lock on a file beside the journal.
+//
+// The keys of every bucket are also kept sorted so that the keys starting with
+// a prefix, and thus the index entries of a value, are found without scanning
+// the bucket.
+type Store struct {
+	Filename    string
+	Quarantined int
+
+	lock    sync.RWMutex
+	owner   *os.File
+	file    *os.File
+	buckets map[string]map[string]json.RawMessage
+	keys    map[string][]string
+	size    int64
+	live    int64
+	closed  bool
+	damaged error
+}
+
+// ErrClosed is returned by the transactions updating a closed store.
+var ErrClosed = errors.New("store is closed")
+
+// Tx reads and writes the store. Writes are only visible to the transaction
+// until it commits.
+type Tx struct {
+	store    *Store
+	writable bool
+	changes  []*change
+	pending  map[string]map[string]*change
+}
+
+type change struct {
+	Bucket string          `json:"b"`
+	Key    string          `json:"k"`
+	Value  json.RawMessage `json:"v,omitempty"`
+	Delete bool            `json:"d,omitempty"`
+}
+
+// compactSize is the size under which the journal is never compacted.
+const compactSize = 1 << 20
+
+// OpenStore opens the store, creating it when missing.
+func OpenStore(filename string) (s *Store, err error) {
+	s = &Store{
+		Filename: filename,
+		buckets:  make(map[string]map[string]json.RawMessage),
+		keys:     make(map[string][]string),
+	}
+
+	if err = os.MkdirAll(path.Dir(filename), 0755); err != nil {
+		return
+	}
+
+	// the journal is replaced when compacted so it can't hold the lock
+	if s.owner, err = os.OpenFile(filename+".lock", os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		return
+	}
+
+	if err = lockFile(s.owner); err != nil {
+		s.owner.Close()
+		s = nil
+		return
+	}
+
+	// a compaction was interrupted
+	if err = os.Remove(filename + ".tmp"); err == nil || os.IsNotExist(err) {
+		s.file, err = os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	}
+
+	if err == nil {
+		if err = s.replay(); err != nil {
+			s.file.Close()
+		}
+	}
+
+	if err != nil {
+		s.owner.Close()
+		s = nil
+	}
+
+	return
+}
+
+func (s *Store) replay() (err error) {
+	var damaged [][]byte
+
+	r := bufio.NewReader(s.file)
+	clean := true
+	for {
+		line, e := r.ReadBytes('\n')
+		if e == io.EOF && len(line) == 0 {
+			break
+		}
+
+		if e != nil && e != io.EOF {
+			return e
+		}
+
+		changes, e := decodeRecord(line)
+		if e != nil {
+			damaged = append(damaged, line)
+			continue
+		}
+
+		s.apply(changes)
+		s.size += int64(len(line))
+		clean = bytes.HasSuffix(line, []byte("\n"))
+	}
+
+	if len(damaged) == 0 && clean {
+		return
+	}
+
+	if err = s.quarantine(damaged); err != nil {
+		return
+	}
+
+	// drop the damaged records from the journal
+	err = s.compact()
+	return
+}
+
+// quarantine keeps a copy of damaged records.
+func (s *Store) quarantine(records [][]byte) (err error) {
+	if len(records) == 0 {
+		return
+	}
+
+	dir := path.Join(path.Dir(s.Filename), "quarantine")
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+
+	f, err := os.OpenFile(path.Join(dir, path.Base(s.Filename)), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+
+	for _, record := range records {
+		if !bytes.HasSuffix(record, []byte("\n")) {
+			record = append(record, '\n')
+		}
+
+		if _, err = f.Write(record); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if e := f.Close(); err == nil {
+		err = e
+	}
+
+	s.Quarantined += len(records)
+	return
+}
+
+// decodeRecord checks and decodes a line of the journal.
+func decodeRecord(line []byte) (result []*change, err error) {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+
+	i := bytes.IndexByte(line, ' ')
+	if i < 0 {
+		err = fmt.Errorf("truncated record")
+		return
+	}
+
+	var sum uint32
+	if _, err = fmt.Sscanf(string(line[:i]), "%08x", &sum); err != nil || sum != crc32.ChecksumIEEE(line[i+1:]) {
+		err = fmt.Errorf("checksum mismatch")
+		return
+	}
+
+	err = json.Unmarshal(line[i+1:], &result)
+	return
+}
+
+func encodeRecord(changes []*change) (result []byte, err error) {
+	data, err := json.Marshal(changes)
+	if err != nil {
+		return
+	}
+
+	result = []byte(fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(data), data))
+	return
+}
+
+func (s *Store) apply(changes []*change) {
+	for _, c := range changes {
+		bucket, ok := s.buckets[c.Bucket]
+		if !ok {
+			bucket = make(map[string]json.RawMessage)
+			s.buckets[c.Bucket] = bucket
+		}
+
+		old, ok := bucket[c.Key]
+		if ok {
+			s.live -= int64(len(c.Bucket) + len(c.Key) + len(old))
+		}
+
+		keys := s.keys[c.Bucket]
+		i := sort.SearchStrings(keys, c.Key)
+		if c.Delete {
+			if ok {
+				delete(bucket, c.Key)
+				s.keys[c.Bucket] = append(keys[:i], keys[i+1:]...)
+			}
+
+			continue
+		}
+
+		if !ok {
+			keys = append(keys, "")
+			copy(keys[i+1:], keys[i:])
+			keys[i] = c.Key
+			s.keys[c.Bucket] = keys
+		}
+
+		bucket[c.Key] = c.Value
+		s.live += int64(len(c.Bucket) + len(c.Key) + len(c.Value))
+	}
+}
+
+// Close releases the journal.
+func (s *Store) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+	err := s.file.Close()
+	if e := s.owner.Close(); err == nil {
+		err = e
+	}
+
+	return err
+}
+
+// View runs a read-only transaction.
+func (s *Store) View(f func(tx *Tx) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return f(&Tx{store: s})
+}
+
+// Update runs a transaction that is committed unless f returns an error.
+func (s *Store) Update(f func(tx *Tx) error) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	if s.damaged != nil {
+		return s.damaged
+	}
+
+	tx := &Tx{
+		store:    s,
+		writable: true,
+		pending:  make(map[string]map[string]*change),
+	}
+
+	if err = f(tx); err != nil || len(tx.changes) == 0 {
+		return
+	}
+
+	record, err := encodeRecord(tx.changes)
+	if err != nil {
+		return
+	}
+
+	if _, err = s.file.Write(record); err == nil {
+		err = s.file.Sync()
+	}
+
+	if err != nil {
+		s.rollback()
+		return
+	}
+
+	s.apply(tx.changes)
+	s.size += int64(len(record))
+
+	// the transaction is committed even if the journal can't be compacted
+	if s.size > compactSize && s.size > 2*s.live {
+		if e := s.compact(); e != nil {
+			log.Printf("compacting %s: %s", s.Filename, e.Error())
+		}
+	}
+
+	return
+}
+
+// rollback removes what may have been written of a record that failed so
+// that the next records aren't appended to it and it isn't replayed. Further
+// changes are refused when the journal can't be restored.
+func (s *Store) rollback() {
+	err := s.file.Truncate(s.size)
+	if err == nil {
+		err = s.file.Sync()
+	}
+
+	if err != nil {
+		s.damaged = fmt.Errorf("journal %s is damaged: %s", s.Filename, err.Error())
+		log.Println(s.damaged)
+	}
+}
+
+// compact rewrites the journal as a single record holding the current state.
+// The journal is left as is when it fails.
+func (s *Store) compact() (err error) {
+	changes := []*change{}
+	for _, name := range sortedBuckets(s.buckets) {
+		for key, value := range s.buckets[name] {
+			changes = append(changes, &change{Bucket: name, Key: key, Value: value})
+		}
+	}
+
+	record, err := encodeRecord(changes)
+	if err != nil {
+		return
+	}
+
+	// the new journal is opened before it replaces the current one so that
+	// the store never appends to a journal that was replaced
+	tmp := s.Filename + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+
+	if _, err = file.Write(record); err == nil {
+		err = file.Sync()
+	}
+
+	if err == nil {
+		err = commitFile(tmp, s.Filename)
+	}
+
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return
+	}
+
+	s.file.Close()
+	s.file = file
+	s.size = int64(len(record))
+	return
+}
+
+// writeFile replaces a file so that it holds either its previous content or
+// the new one, even if the machine crashes.
+func writeFile(filename string, data []byte, perm os.FileMode) (err error) {
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return
+	}
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+
+	if e := f.Close(); err == nil {
+		err = e
+	}
+
+	if err == nil {
+		err = commitFile(tmp, filename)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return
+}
+
+// commitFile renames a synced file and syncs the directory holding it.
+func commitFile(tmp, filename string) (err error) {
+	if err = os.Rename(tmp, filename); err != nil {
+		return
+	}
+
+	dir, err := os.Open(path.Dir(filename))
+	if err != nil {
+		return
+	}
+
+	err = dir.Sync()
+	if e := dir.Close(); err == nil {
+		err = e
+	}
+
+	return
+}
+
+func sortedBuckets(buckets map[string]map[string]json.RawMessage) (result []string) {
+	for name := range buckets {
+		result = append(result, name)
+	}
+
+	sort.Strings(result)
+	return
+}
+
+// Get decodes the value of a key and reports whether it was found.
+func (tx *Tx) Get(bucket, key string, value interface{}) (ok bool, err error) {
+	data, ok := tx.get(bucket, key)
+	if ok {
+		err = json.Unmarshal(data, value)
+	}
+
+	return
+}
+
+func (tx *Tx) get(bucket, key string) (data json.RawMessage, ok bool) {
+	if c, found := tx.pending[bucket][key]; found {
+		return c.Value, !c.Delete
+	}
+
+	data, ok = tx.store.buckets[bucket][key]
+	return
+}
+
+// Put sets the value of a key.
+func (tx *Tx) Put(bucket, key string, value interface{}) (err error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+
+	err = tx.change(&change{Bucket: bucket, Key: key, Value: data})
+	return
+}
+
+// Delete removes a key.
+func (tx *Tx) Delete(bucket, key string) error {
+	return tx.change(&change{Bucket: bucket, Key: key, Delete: true})
+}
+
+func (tx *Tx) change(c *change) error {
+	if !tx.writable {
+		return fmt.Errorf("read-only transaction")
+	}
+
+	if _, ok := tx.pending[c.Bucket]; !ok {
+		tx.pending[c.Bucket] = make(map[string]*change)
+	}
+
+	tx.pending[c.Bucket][c.Key] = c
+	tx.changes = append(tx.changes, c)
+	return nil
+}
+
+// Keys returns the sorted keys of a bucket starting with the prefix.
+func (tx *Tx) Keys(bucket, prefix string) (result []string) {
+	keys := tx.store.keys[bucket]
+	i := sort.SearchStrings(keys, prefix)
+	for _, key := range keys[i:] {
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+
+		if _, ok := tx.pending[bucket][key]; !ok {
+			result = append(result, key)
+		}
+	}
+
+	pending := false
+	for key, c := range tx.pending[bucket] {
+		if !c.Delete && strings.HasPrefix(key, prefix) {
+			result = append(result, key)
+			pending = true
+		}
+	}
+
+	if pending {
+		sort.Strings(result)
+	}
+
+	return
+}
+
+// Buckets returns the sorted names of the buckets starting with the prefix.
+func (tx *Tx) Buckets(prefix string) (result []string) {
+	for _, name := range sortedBuckets(tx.store.buckets) {
+		if strings.HasPrefix(name, prefix) {
+			result = append(result, name)
+		}
+	}
+
+	return
+}
+
+// Index records that an item of a bucket has a value for a field so that
+// items can be looked up by field value in the order of their keys.
+func (tx *Tx) Index(bucket, field, value, key string) error {
+	return tx.Put("index:"+bucket+":"+field, value+"\x00"+key, true)
+}
+
+// Unindex removes an entry added by Index.
+func (tx *Tx) Unindex(bucket, field, value, key string) error {
+	return tx.Delete("index:"+bucket+":"+field, value+"\x00"+key)
+}
+
+// Lookup returns the keys of the items of a bucket having a value for a
+// field, in order.
+func (tx *Tx) Lookup(bucket, field, value string) (result []string) {
+	prefix := value + "\x00"
+	for _, key := range tx.Keys("index:"+bucket+":"+field, prefix) {
+		result = append(result, strings.TrimPrefix(key, prefix))
+	}
+
+	return
+}
@@ -0,0 +1,303 @@
+package ship
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T, filename string) *Store {
+	s, err := OpenStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func put(t *testing.T, s *Store, bucket string, values map[string]string) {
+	err := s.Update(func(tx *Tx) (err error) {
+		for key, value := range values {
+			if err = tx.Put(bucket, key, value); err != nil {
+				return
+			}
+		}
+
+		return
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func contents(t *testing.T, s *Store, bucket string) (result map[string]string) {
+	result = make(map[string]string)
+	err := s.View(func(tx *Tx) (err error) {
+		for _, key := range tx.Keys(bucket, "") {
+			var value string
+			if _, err = tx.Get(bucket, key, &value); err != nil {
+				return
+			}
+
+			result[key] = value
+		}
+
+		return
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func TestStoreReplay(t *testing.T) {
+	filename := path.Join(t.TempDir(), "state.db")
+
+	s := openTestStore(t, filename)
+	put(t, s, "a", map[string]string{"x": "1", "y": "2"})
+	put(t, s, "a", map[string]string{"x": "3"})
+	s.Update(func(tx *Tx) error { return tx.Delete("a", "y") })
+
+	// a failed transaction is not committed
+	s.Update(func(tx *Tx) error {
+		tx.Put("a", "z", "4")
+		return os.ErrInvalid
+	})
+
+	s.Close()
+
+	if err := s.Update(func(tx *Tx) error { return nil }); err != ErrClosed {
+		t.Errorf("update of a closed store returned %v", err)
+	}
+
+	s = openTestStore(t, filename)
+	defer s.Close()
+
+	want := map[string]string{"x": "3"}
+	if got := contents(t, s, "a"); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %v, want %v", got, want)
+	}
+}
+
+func TestStoreQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	filename := path.Join(dir, "state.db")
+
+	s := openTestStore(t, filename)
+	put(t, s, "a", map[string]string{"x": "1"})
+	put(t, s, "a", map[string]string{"y": "2"})
+	s.Close()
+
+	// damage the second record and leave a truncated one at the end
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.SplitAfter(string(data), "\n")
+	lines[1] = strings.Replace(lines[1], `"2"`, `"3"`, 1)
+	data = []byte(lines[0] + lines[1] + `00000000 [{"b":"a"`)
+	if err = ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestStore(t, filename)
+	if s.Quarantined != 2 {
+		t.Errorf("quarantined %d records, want 2", s.Quarantined)
+	}
+
+	want := map[string]string{"x": "1"}
+	if got := contents(t, s, "a"); !reflect.DeepEqual(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+
+	s.Close()
+
+	// the damaged records were dropped from the journal
+	s = openTestStore(t, filename)
+	defer s.Close()
+
+	if s.Quarantined != 0 {
+		t.Errorf("quarantined %d records once reopened", s.Quarantined)
+	}
+
+	data, err = ioutil.ReadFile(path.Join(dir, "quarantine", "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := strings.Count(string(data), "\n"); n != 2 {
+		t.Errorf("quarantine holds %d records, want 2", n)
+	}
+}
+
+func TestStoreCompact(t *testing.T) {
+	filename := path.Join(t.TempDir(), "state.db")
+
+	s := openTestStore(t, filename)
+	value := strings.Repeat("x", 1<<16)
+	for i := 0; i < 40; i++ {
+		put(t, s, "a", map[string]string{"x": value, "y": string(rune('a' + i))})
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size() > compactSize {
+		t.Errorf("journal of %d bytes wasn't compacted", info.Size())
+	}
+
+	// the store keeps appending to the compacted journal
+	put(t, s, "a", map[string]string{"z": "1"})
+	s.Close()
+
+	s = openTestStore(t, filename)
+	defer s.Close()
+
+	want := map[string]string{"x": value, "y": string(rune('a' + 39)), "z": "1"}
+	if got := contents(t, s, "a"); !reflect.DeepEqual(got, want) {
+		t.Errorf("compacted store holds %d keys, want %d", len(got), len(want))
+	}
+}
+
+func TestStoreKeys(t *testing.T) {
+	s := openTestStore(t, path.Join(t.TempDir(), "state.db"))
+	defer s.Close()
+
+	put(t, s, "a", map[string]string{"b/2": "", "a/1": "", "b/1": "", "c/1": ""})
+
+	s.Update(func(tx *Tx) (err error) {
+		tx.Delete("a", "b/1")
+		tx.Put("a", "b/0", "")
+		tx.Put("a", "b/3", "")
+
+		want := []string{"b/0", "b/2", "b/3"}
+		if got := tx.Keys("a", "b/"); !reflect.DeepEqual(got, want) {
+			t.Errorf("keys of the transaction are %v, want %v", got, want)
+		}
+
+		return
+	})
+
+	s.View(func(tx *Tx) error {
+		want := []string{"a/1", "b/0", "b/2", "b/3", "c/1"}
+		if got := tx.Keys("a", ""); !reflect.DeepEqual(got, want) {
+			t.Errorf("keys are %v, want %v", got, want)
+		}
+
+		if got := tx.Keys("a", "d"); len(got) != 0 {
+			t.Errorf("keys starting with d are %v", got)
+		}
+
+		return nil
+	})
+}
+
+func TestStoreIndex(t *testing.T) {
+	s := openTestStore(t, path.Join(t.TempDir(), "state.db"))
+	defer s.Close()
+
+	when := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := &Builder{
+		Name:  "b1",
+		Build: &Build{Name: "example.com/a", Filename: "a", User: "alice", When: when},
+	}
+
+	s.Update(func(tx *Tx) error { return putBuilder(tx, b) })
+
+	// building again moves the build in the indexes
+	b.Build = &Build{Name: "example.com/a", Filename: "a", User: "bob", When: when.Add(time.Hour)}
+	s.Update(func(tx *Tx) error { return putBuilder(tx, b) })
+
+	s.View(func(tx *Tx) error {
+		key := timeKey(b.Build.When) + "/b1"
+		tests := []struct {
+			field, value string
+			want         []string
+		}{
+			{"package", "example.com/a", []string{key}},
+			{"app", "a", []string{key}},
+			{"user", "bob", []string{key}},
+			{"user", "alice", nil},
+		}
+
+		for _, test := range tests {
+			if got := tx.Lookup("builders", test.field, test.value); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("lookup of %s %s = %v, want %v", test.field, test.value, got, test.want)
+			}
+		}
+
+		if got := tx.Keys("index:builders:time", ""); !reflect.DeepEqual(got, []string{key}) {
+			t.Errorf("time index holds %v, want %v", got, []string{key})
+		}
+
+		return nil
+	})
+}
+
+func TestStoreLock(t *testing.T) {
+	filename := path.Join(t.TempDir(), "state.db")
+
+	s := openTestStore(t, filename)
+	if _, err := OpenStore(filename); err == nil {
+		t.Error("store opened twice")
+	}
+
+	s.Close()
+
+	s = openTestStore(t, filename)
+	s.Close()
+}
+
+func TestStoreRollback(t *testing.T) {
+	filename := path.Join(t.TempDir(), "state.db")
+
+	s := openTestStore(t, filename)
+	put(t, s, "a", map[string]string{"x": "1"})
+
+	// a record was partly written before failing
+	if _, err := s.file.Write([]byte(`00000000 [{"b":"a","k":"y"`)); err != nil {
+		t.Fatal(err)
+	}
+
+	s.rollback()
+	put(t, s, "a", map[string]string{"z": "2"})
+	s.Close()
+
+	s = openTestStore(t, filename)
+	if s.Quarantined != 0 {
+		t.Errorf("quarantined %d records", s.Quarantined)
+	}
+
+	want := map[string]string{"x": "1", "z": "2"}
+	if got := contents(t, s, "a"); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %v, want %v", got, want)
+	}
+
+	// the journal can't be restored
+	journal := s.file
+	if s.file, _ = os.Open(filename); s.file == nil {
+		t.Fatal("journal can't be opened")
+	}
+
+	if err := s.Update(func(tx *Tx) error { return tx.Put("a", "w", "3") }); err == nil {
+		t.Error("change was written in a read-only journal")
+	}
+
+	if err := s.Update(func(tx *Tx) error { return tx.Put("a", "v", "4") }); err == nil || err != s.damaged {
+		t.Errorf("change to a damaged store returned %v", err)
+	}
+
+	s.file.Close()
+	s.file = journal
+	s.Close()
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package ship
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on a file, failing when another process
+// holds it.
+func lockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		err = fmt.Errorf("%s is used by another process", f.Name())
+	}
+
+	return err
+}
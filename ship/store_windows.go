@@ -0,0 +1,10 @@
+package ship
+
+import (
+	"os"
+)
+
+// lockFile is a no-op as servers only run on Unix systems.
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,119 @@
+package ship
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Certificate serves a key pair that is loaded again whenever one of its
+// files changes so that certificates can be renewed without a restart.
+type Certificate struct {
+	Cert string
+	Key  string
+
+	lock     sync.Mutex
+	current  *tls.Certificate
+	modified time.Time
+}
+
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (result *tls.Certificate, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	when := time.Time{}
+	for _, name := range []string{c.Cert, c.Key} {
+		info, err := os.Stat(name)
+		if err != nil {
+			// keep serving the last valid certificate
+			if c.current != nil {
+				return c.current, nil
+			}
+
+			return nil, err
+		}
+
+		if info.ModTime().After(when) {
+			when = info.ModTime()
+		}
+	}
+
+	if c.current == nil || when.After(c.modified) {
+		pair, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			if c.current != nil {
+				return c.current, nil
+			}
+
+			return nil, err
+		}
+
+		c.current = &pair
+		c.modified = when
+	}
+
+	result = c.current
+	return
+}
+
+func LoadCertPool(filename string) (result *x509.CertPool, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+
+	result = x509.NewCertPool()
+	if !result.AppendCertsFromPEM(data) {
+		err = fmt.Errorf("no certificate found in '%s'", filename)
+	}
+
+	return
+}
+
+// NewTLSConfig returns the client configuration trusting the given CA, if
+// any, and presenting the given certificate, if any.
+func NewTLSConfig(ca, cert, key string) (result *tls.Config, err error) {
+	result = new(tls.Config)
+
+	if ca != "" {
+		if result.RootCAs, err = LoadCertPool(ca); err != nil {
+			return
+		}
+	}
+
+	if cert != "" || key != "" {
+		var pair tls.Certificate
+		if pair, err = tls.LoadX509KeyPair(cert, key); err != nil {
+			return
+		}
+
+		result.Certificates = []tls.Certificate{pair}
+	}
+
+	return
+}
+
+// NewHTTPClient returns a client using the given TLS configuration.
+func NewHTTPClient(config *tls.Config) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: config,
+		},
+	}
+}
+
+// URL returns the address with a scheme, using plain HTTP when none is given.
+func URL(address string) string {
+	if strings.Contains(address, "://") {
+		return address
+	}
+
+	return "http://" + address
+}
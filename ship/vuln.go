@@ -0,0 +1,660 @@
+package ship
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Vulnerability is an entry of an OSV database.
+type Vulnerability struct {
+	ID        string      `json:"id"`
+	Aliases   []string    `json:"aliases"`
+	Summary   string      `json:"summary"`
+	Withdrawn string      `json:"withdrawn"`
+	Affected  []*Affected `json:"affected"`
+}
+
+type Affected struct {
+	Package struct {
+		Ecosystem string `json:"ecosystem"`
+		Name      string `json:"name"`
+	} `json:"package"`
+	Ranges   []*Range `json:"ranges"`
+	Versions []string `json:"versions"`
+}
+
+type Range struct {
+	Type   string   `json:"type"`
+	Repo   string   `json:"repo"`
+	Events []*Event `json:"events"`
+}
+
+type Event struct {
+	Introduced   string `json:"introduced,omitempty"`
+	Fixed        string `json:"fixed,omitempty"`
+	LastAffected string `json:"last_affected,omitempty"`
+	Limit        string `json:"limit,omitempty"`
+}
+
+// Finding is a vulnerability affecting the commit of a repository.
+type Finding struct {
+	ID         string   `json:"id"`
+	Aliases    []string `json:"aliases,omitempty"`
+	Summary    string   `json:"summary,omitempty"`
+	Repository string   `json:"repository"`
+	Commit     string   `json:"commit"`
+	Version    string   `json:"version,omitempty"`
+	Fixed      string   `json:"fixed,omitempty"`
+}
+
+// Exposure is a running instance of a build with known vulnerabilities.
+type Exposure struct {
+	App      string     `json:"app"`
+	URL      string     `json:"url"`
+	Build    string     `json:"build"`
+	Findings []*Finding `json:"findings"`
+}
+
+// Scanner checks the dependencies of builds against an OSV database. The
+// database is a JSON file holding one entry or a list of entries, or a zip
+// archive of such files as published by osv.dev.
+type Scanner struct {
+	Filename string
+	Fail     bool
+
+	lock     sync.Mutex
+	list     []*Vulnerability
+	modified time.Time
+}
+
+// ScanInterval is how often the server checks whether the database changed.
+var ScanInterval = time.Minute
+
+func (f *Finding) String() string {
+	text := fmt.Sprintf("%s in %s@%s", f.ID, f.Repository, short(f.Commit))
+	if f.Version != "" {
+		text += " (" + f.Version + ")"
+	}
+
+	if f.Fixed != "" {
+		text += ", fixed in " + f.Fixed
+	}
+
+	if f.Summary != "" {
+		text += ": " + f.Summary
+	}
+
+	return text
+}
+
+// Reload reads the database again when its file changed and reports whether
+// it did.
+func (s *Scanner) Reload() (changed bool, err error) {
+	info, err := os.Stat(s.Filename)
+	if err != nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.list != nil && info.ModTime().Equal(s.modified) {
+		return
+	}
+
+	list, err := readVulnerabilities(s.Filename)
+	if err != nil {
+		return
+	}
+
+	s.list, s.modified, changed = list, info.ModTime(), true
+	return
+}
+
+func readVulnerabilities(filename string) (result []*Vulnerability, err error) {
+	if !strings.HasSuffix(filename, ".zip") {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		return decodeVulnerabilities(filename, data)
+	}
+
+	r, err := zip.OpenReader(filename)
+	if err != nil {
+		return
+	}
+
+	defer r.Close()
+
+	for _, file := range r.File {
+		if !strings.HasSuffix(file.Name, ".json") {
+			continue
+		}
+
+		f, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		list, err := decodeVulnerabilities(file.Name, data)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, list...)
+	}
+
+	return
+}
+
+func decodeVulnerabilities(name string, data []byte) (result []*Vulnerability, err error) {
+	data = bytes.TrimSpace(data)
+	if len(data) != 0 && data[0] == '[' {
+		err = json.Unmarshal(data, &result)
+	} else {
+		item := new(Vulnerability)
+		err = json.Unmarshal(data, item)
+		result = []*Vulnerability{item}
+	}
+
+	if err != nil {
+		err = fmt.Errorf("invalid OSV entry in '%s': %s", name, err.Error())
+	}
+
+	return
+}
+
+// Scan returns the vulnerabilities affecting the commits of the repositories.
+// The git repository of each one, given by dir, is used to find out how
+// commits relate to the affected versions.
+func (s *Scanner) Scan(versions map[string]string, dir func(repo string) string) (result []*Finding) {
+	s.lock.Lock()
+	list := s.list
+	s.lock.Unlock()
+
+	for _, repo := range sortedKeys(versions) {
+		r := &revision{
+			repo:     repo,
+			hash:     versions[repo],
+			dir:      dir(repo),
+			versions: make(map[string]string),
+		}
+
+		for _, v := range list {
+			if v.Withdrawn != "" {
+				continue
+			}
+
+			for _, a := range v.Affected {
+				f := r.affected(a)
+				if f == nil {
+					continue
+				}
+
+				f.ID, f.Aliases, f.Summary = v.ID, v.Aliases, v.Summary
+				result = append(result, f)
+				break
+			}
+		}
+	}
+
+	return
+}
+
+// revision is the commit of a repository being checked.
+type revision struct {
+	repo string
+	hash string
+	dir  string
+
+	// semantic versions of the commit by tag prefix
+	versions map[string]string
+}
+
+func (r *revision) affected(a *Affected) (result *Finding) {
+	finding := func(version, fixed string) *Finding {
+		return &Finding{
+			Repository: r.repo,
+			Commit:     r.hash,
+			Version:    version,
+			Fixed:      fixed,
+		}
+	}
+
+	// commits are checked against the history of the repository
+	for _, item := range a.Ranges {
+		if item.Type == "GIT" && sameRepository(item.Repo, r.repo) {
+			if ok, fixed := r.commitAffected(item.Events); ok {
+				return finding("", fixed)
+			}
+		}
+	}
+
+	prefix, ok := r.module(a)
+	if !ok {
+		return
+	}
+
+	version := r.version(prefix)
+	if version == "" {
+		return
+	}
+
+	for _, item := range a.Versions {
+		if compareVersions(item, version) == 0 {
+			return finding(version, "")
+		}
+	}
+
+	for _, item := range a.Ranges {
+		if item.Type != "SEMVER" && item.Type != "ECOSYSTEM" {
+			continue
+		}
+
+		if ok, fixed := versionAffected(item.Events, version); ok {
+			return finding(version, fixed)
+		}
+	}
+
+	return
+}
+
+// module returns the prefix of the tags of the Go module affected by the
+// vulnerability when it lives in the repository.
+func (r *revision) module(a *Affected) (prefix string, ok bool) {
+	if a.Package.Ecosystem != "Go" {
+		return
+	}
+
+	name := a.Package.Name
+	switch {
+	case name == r.repo:
+		return "", true
+	case !strings.HasPrefix(name, r.repo+"/"):
+		return
+	}
+
+	// major versions share the tags of the repository
+	rel := strings.TrimPrefix(name, r.repo+"/")
+	if n, err := strconv.Atoi(strings.TrimPrefix(rel, "v")); err == nil && n > 1 && rel[0] == 'v' {
+		return "", true
+	}
+
+	return rel + "/", true
+}
+
+// version returns the semantic version of the commit, which is a Go
+// pseudo-version when it isn't tagged. It is unknown in a repository without
+// tags, which is then only checked by commit.
+func (r *revision) version(prefix string) (result string) {
+	if result, ok := r.versions[prefix]; ok {
+		return result
+	}
+
+	defer func() {
+		r.versions[prefix] = result
+	}()
+
+	output, err := git(r.dir, "tag", "--points-at", r.hash, "--list", prefix+"v*")
+	if err != nil {
+		return
+	}
+
+	for _, tag := range strings.Fields(string(output)) {
+		tag = strings.TrimPrefix(tag, prefix)
+		if result == "" || compareVersions(tag, result) > 0 {
+			result = tag
+		}
+	}
+
+	if result != "" {
+		return
+	}
+
+	output, err = git(r.dir, "describe", "--tags", "--abbrev=0", "--match", prefix+"v*", r.hash)
+	if err != nil {
+		return
+	}
+
+	tag := strings.TrimPrefix(strings.TrimSpace(string(output)), prefix)
+	result = pseudoVersion(tag)
+	return
+}
+
+// commitAffected evaluates the events of a GIT range. Each introduced commit
+// starts a range ending with the fixed or last affected commit following it,
+// so that a vulnerability introduced again after a fix is still found.
+func (r *revision) commitAffected(events []*Event) (affected bool, fixed string) {
+	for i, e := range events {
+		if e.Introduced == "" {
+			continue
+		}
+
+		var end *Event
+		for _, next := range events[i+1:] {
+			if next.Introduced != "" {
+				break
+			}
+
+			if next.Fixed != "" || next.LastAffected != "" {
+				end = next
+				break
+			}
+		}
+
+		if e.Introduced != "0" && !r.descends(e.Introduced) {
+			continue
+		}
+
+		switch {
+		case end == nil:
+			return true, ""
+		case end.Fixed != "":
+			if !r.descends(end.Fixed) {
+				return true, end.Fixed
+			}
+		case end.LastAffected == r.hash || !r.descends(end.LastAffected):
+			return true, ""
+		}
+	}
+
+	return
+}
+
+// descends reports whether the commit comes after the given one.
+func (r *revision) descends(hash string) bool {
+	cmd := exec.Command("git", "merge-base", "--is-ancestor", hash, r.hash)
+	cmd.Dir = r.dir
+	return cmd.Run() == nil
+}
+
+// versionAffected evaluates the events of a SEMVER range.
+func versionAffected(events []*Event, version string) (affected bool, fixed string) {
+	list := make([]*Event, len(events))
+	copy(list, events)
+
+	value := func(e *Event) string {
+		switch {
+		case e.Introduced == "0":
+			return "0.0.0-0"
+		case e.Introduced != "":
+			return e.Introduced
+		case e.Fixed != "":
+			return e.Fixed
+		case e.LastAffected != "":
+			return e.LastAffected
+		}
+
+		return e.Limit
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		return compareVersions(value(list[i]), value(list[j])) < 0
+	})
+
+	for _, e := range list {
+		switch {
+		case e.Introduced != "":
+			if compareVersions(version, value(e)) >= 0 {
+				affected, fixed = true, ""
+			}
+
+		case e.Fixed != "":
+			if compareVersions(version, e.Fixed) >= 0 {
+				affected = false
+			} else if affected && fixed == "" {
+				fixed = e.Fixed
+			}
+
+		case e.LastAffected != "":
+			if compareVersions(version, e.LastAffected) > 0 {
+				affected = false
+			}
+		}
+	}
+
+	return
+}
+
+// pseudoVersion returns a version sorting right after the tag, like the
+// pseudo-versions of Go modules.
+func pseudoVersion(tag string) string {
+	if strings.Contains(tag, "-") {
+		return tag + ".0"
+	}
+
+	major, minor, patch := splitVersion(tag)
+	return fmt.Sprintf("v%d.%d.%d-0", major, minor, patch+1)
+}
+
+func splitVersion(version string) (major, minor, patch int) {
+	version = strings.TrimPrefix(version, "v")
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		version = version[:i]
+	}
+
+	fields := strings.SplitN(version, ".", 3)
+	numbers := []*int{&major, &minor, &patch}
+	for i, item := range fields {
+		*numbers[i], _ = strconv.Atoi(item)
+	}
+
+	return
+}
+
+// compareVersions compares semantic versions with or without their v prefix.
+func compareVersions(a, b string) int {
+	a, b = strings.TrimPrefix(a, "v"), strings.TrimPrefix(b, "v")
+
+	a1, a2, a3 := splitVersion(a)
+	b1, b2, b3 := splitVersion(b)
+	for _, item := range [][2]int{{a1, b1}, {a2, b2}, {a3, b3}} {
+		if item[0] != item[1] {
+			if item[0] < item[1] {
+				return -1
+			}
+
+			return 1
+		}
+	}
+
+	pa, pb := prerelease(a), prerelease(b)
+	switch {
+	case pa == pb:
+		return 0
+	case pa == "":
+		return 1
+	case pb == "":
+		return -1
+	}
+
+	x, y := strings.Split(pa, "."), strings.Split(pb, ".")
+	for i := 0; i < len(x) && i < len(y); i++ {
+		if x[i] == y[i] {
+			continue
+		}
+
+		n, errX := strconv.Atoi(x[i])
+		m, errY := strconv.Atoi(y[i])
+		switch {
+		case errX == nil && errY == nil:
+			if n < m {
+				return -1
+			}
+
+			return 1
+		case errX == nil:
+			return -1
+		case errY == nil:
+			return 1
+		case x[i] < y[i]:
+			return -1
+		default:
+			return 1
+		}
+	}
+
+	switch {
+	case len(x) < len(y):
+		return -1
+	case len(x) > len(y):
+		return 1
+	}
+
+	return 0
+}
+
+func prerelease(version string) string {
+	if i := strings.Index(version, "+"); i >= 0 {
+		version = version[:i]
+	}
+
+	if i := strings.Index(version, "-"); i >= 0 {
+		return version[i+1:]
+	}
+
+	return ""
+}
+
+// sameRepository compares the URL of a repository with its name.
+func sameRepository(url, name string) bool {
+	if i := strings.Index(url, "://"); i >= 0 {
+		url = url[i+3:]
+	}
+
+	url = strings.TrimSuffix(strings.TrimSuffix(url, "/"), ".git")
+	return url == name
+}
+
+// Exposures returns the running instances affected by known vulnerabilities
+// as of the last scan.
+func (s *Server) Exposures() (result []*Exposure) {
+	s.once.Do(s.initialize)
+
+	s.call(func() {
+		result = s.exposures
+	})
+
+	return
+}
+
+// watch scans the running builds again whenever the database changes, until
+// the server stops.
+func (s *Server) watch() {
+	defer s.tasks.Done()
+
+	if _, err := s.Scanner.Reload(); err != nil {
+		log.Println("vulnerability database:", err)
+	}
+
+	for {
+		s.rescan()
+
+		// wait for changes
+		for changed := false; !changed; {
+			select {
+			case <-time.After(ScanInterval):
+			case <-s.quit:
+				return
+			}
+
+			var err error
+			if changed, err = s.Scanner.Reload(); err != nil {
+				log.Println("vulnerability database:", err)
+			}
+		}
+	}
+}
+
+// rescan checks the builds running on registered instances.
+func (s *Server) rescan() {
+	type instance struct {
+		app     *App
+		builder *Builder
+	}
+
+	list := []instance{}
+	s.call(func() {
+		for _, instances := range s.apps {
+			for _, app := range instances {
+				if b, ok := s.Builders[app.Version]; ok && b.Build != nil {
+					list = append(list, instance{app, b})
+				}
+			}
+		}
+	})
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].app.URL < list[j].app.URL
+	})
+
+	result := []*Exposure{}
+	scanned := make(map[string][]*Finding)
+
+	for _, item := range list {
+		if s.stopped() {
+			return
+		}
+
+		b := item.builder
+
+		findings, ok := scanned[b.Name]
+		if !ok {
+			findings = s.Scanner.Scan(b.Build.Versions, s.mirror)
+			scanned[b.Name] = findings
+
+			s.feed <- func() {
+				b.Findings = findings
+				s.saveBuilder(b)
+			}
+		}
+
+		if len(findings) == 0 {
+			continue
+		}
+
+		log.Printf("%s at %s runs %s with %d known vulnerabilities", item.app.Name, item.app.URL, b.Name, len(findings))
+
+		result = append(result, &Exposure{
+			App:      item.app.Name,
+			URL:      item.app.URL,
+			Build:    b.Name,
+			Findings: findings,
+		})
+	}
+
+	s.feed <- func() {
+		s.exposures = result
+	}
+}
+
+// mirror returns the mirror of a repository, creating it when missing.
+func (s *Server) mirror(repo string) string {
+	dir := s.Mirrors.Path(repo)
+	if _, err := os.Stat(dir); err != nil {
+		if _, err := s.Mirrors.Update(repo); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return dir
+}
@@ -0,0 +1,224 @@
+package ship
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"v1.0.0", "1.0.0", 0},
+		{"v1.0.0", "v1.0.1", -1},
+		{"v1.2.0", "v1.10.0", -1},
+		{"v2.0.0", "v1.9.9", 1},
+		{"v1.0", "v1.0.0", 0},
+		{"v1.0.0-rc.1", "v1.0.0", -1},
+		{"v1.0.0-alpha", "v1.0.0-alpha.1", -1},
+		{"v1.0.0-alpha.1", "v1.0.0-alpha.beta", -1},
+		{"v1.0.0-beta.2", "v1.0.0-beta.11", -1},
+		{"v1.0.0-beta", "v1.0.0-alpha", 1},
+		{"v1.0.0+build", "v1.0.0", 0},
+		{"v1.0.0-rc.1+build", "v1.0.0-rc.1", 0},
+	}
+
+	for _, test := range tests {
+		if got := compareVersions(test.a, test.b); got != test.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+
+		if got := compareVersions(test.b, test.a); got != -test.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", test.b, test.a, got, -test.want)
+		}
+	}
+}
+
+func TestPseudoVersion(t *testing.T) {
+	tests := []struct {
+		tag, want, next string
+	}{
+		{"v1.2.3", "v1.2.4-0", "v1.2.4"},
+		{"v0.0.0", "v0.0.1-0", "v0.0.1"},
+		{"v1.2.3-rc.1", "v1.2.3-rc.1.0", "v1.2.3-rc.2"},
+	}
+
+	for _, test := range tests {
+		got := pseudoVersion(test.tag)
+		if got != test.want {
+			t.Errorf("pseudoVersion(%q) = %q, want %q", test.tag, got, test.want)
+		}
+
+		// commits after a tag sort between it and the next release
+		if compareVersions(got, test.tag) <= 0 || compareVersions(got, test.next) >= 0 {
+			t.Errorf("pseudoVersion(%q) = %q doesn't sort between %q and %q", test.tag, got, test.tag, test.next)
+		}
+	}
+}
+
+func TestVersionAffected(t *testing.T) {
+	introduced := func(v string) *Event { return &Event{Introduced: v} }
+	fixed := func(v string) *Event { return &Event{Fixed: v} }
+	last := func(v string) *Event { return &Event{LastAffected: v} }
+
+	tests := []struct {
+		name     string
+		events   []*Event
+		version  string
+		affected bool
+		fixed    string
+	}{
+		{"before fix", []*Event{introduced("0"), fixed("1.2.0")}, "v1.1.0", true, "1.2.0"},
+		{"fixed", []*Event{introduced("0"), fixed("1.2.0")}, "v1.2.0", false, ""},
+		{"after fix", []*Event{introduced("0"), fixed("1.2.0")}, "v1.3.0", false, ""},
+		{"before introduced", []*Event{introduced("1.0.0"), fixed("1.2.0")}, "v0.9.0", false, ""},
+		{"prerelease of fix", []*Event{introduced("0"), fixed("1.2.0")}, "v1.2.0-rc.1", true, "1.2.0"},
+		{"pseudo-version", []*Event{introduced("0"), fixed("1.2.0")}, "v1.1.1-0", true, "1.2.0"},
+		{"no fix", []*Event{introduced("1.0.0")}, "v5.0.0", true, ""},
+		{"between ranges", []*Event{introduced("1.0.0"), fixed("1.2.0"), introduced("1.5.0"), fixed("1.6.0")}, "v1.3.0", false, ""},
+		{"introduced again", []*Event{introduced("1.0.0"), fixed("1.2.0"), introduced("1.5.0"), fixed("1.6.0")}, "v1.5.2", true, "1.6.0"},
+		{"introduced again without fix", []*Event{introduced("1.0.0"), fixed("1.2.0"), introduced("1.5.0")}, "v2.0.0", true, ""},
+		{"unordered", []*Event{fixed("1.6.0"), introduced("1.5.0"), fixed("1.2.0"), introduced("1.0.0")}, "v1.1.0", true, "1.2.0"},
+		{"last affected", []*Event{introduced("0"), last("1.4.0")}, "v1.4.0", true, ""},
+		{"after last affected", []*Event{introduced("0"), last("1.4.0")}, "v1.4.1", false, ""},
+	}
+
+	for _, test := range tests {
+		affected, fixed := versionAffected(test.events, test.version)
+		if affected != test.affected || fixed != test.fixed {
+			t.Errorf("%s: versionAffected(%s) = %v, %q, want %v, %q", test.name, test.version, affected, fixed, test.affected, test.fixed)
+		}
+	}
+}
+
+func TestModule(t *testing.T) {
+	r := &revision{repo: "github.com/a/b"}
+
+	tests := []struct {
+		ecosystem, name string
+		prefix          string
+		ok              bool
+	}{
+		{"Go", "github.com/a/b", "", true},
+		{"Go", "github.com/a/b/v2", "", true},
+		{"Go", "github.com/a/b/sub", "sub/", true},
+		{"Go", "github.com/a/b/sub/v2", "sub/v2/", true},
+		{"Go", "github.com/a/bc", "", false},
+		{"Go", "github.com/a", "", false},
+		{"PyPI", "github.com/a/b", "", false},
+	}
+
+	for _, test := range tests {
+		a := new(Affected)
+		a.Package.Ecosystem, a.Package.Name = test.ecosystem, test.name
+
+		prefix, ok := r.module(a)
+		if prefix != test.prefix || ok != test.ok {
+			t.Errorf("module(%s %s) = %q, %v, want %q, %v", test.ecosystem, test.name, prefix, ok, test.prefix, test.ok)
+		}
+	}
+}
+
+func TestSameRepository(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://github.com/a/b", true},
+		{"https://github.com/a/b.git", true},
+		{"https://github.com/a/b/", true},
+		{"github.com/a/b", true},
+		{"https://github.com/a/bc", false},
+		{"https://gitlab.com/a/b", false},
+	}
+
+	for _, test := range tests {
+		if got := sameRepository(test.url, "github.com/a/b"); got != test.want {
+			t.Errorf("sameRepository(%q) = %v, want %v", test.url, got, test.want)
+		}
+	}
+}
+
+// testRepository creates a repository with a linear history and returns its
+// directory and commits, oldest first.
+func testRepository(t *testing.T, n int) (dir string, commits []string) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir = t.TempDir()
+	run := func(args ...string) string {
+		args = append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+		output, err := git(dir, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return strings.TrimSpace(string(output))
+	}
+
+	run("init", "-q")
+	for i := 0; i < n; i++ {
+		run("commit", "-q", "--allow-empty", "-m", "commit")
+		commits = append(commits, run("rev-parse", "HEAD"))
+	}
+
+	return
+}
+
+func TestCommitAffected(t *testing.T) {
+	dir, c := testRepository(t, 5)
+
+	introduced := func(i int) *Event { return &Event{Introduced: c[i]} }
+	fixed := func(i int) *Event { return &Event{Fixed: c[i]} }
+	last := func(i int) *Event { return &Event{LastAffected: c[i]} }
+
+	tests := []struct {
+		name     string
+		events   []*Event
+		commit   int
+		affected bool
+		fixed    string
+	}{
+		{"before introduced", []*Event{introduced(1), fixed(2)}, 0, false, ""},
+		{"introduced", []*Event{introduced(1), fixed(2)}, 1, true, c[2]},
+		{"fixed", []*Event{introduced(1), fixed(2)}, 2, false, ""},
+		{"from the start", []*Event{{Introduced: "0"}, fixed(1)}, 0, true, c[1]},
+		{"no fix", []*Event{introduced(1)}, 4, true, ""},
+		{"between ranges", []*Event{introduced(1), fixed(2), introduced(3)}, 2, false, ""},
+		{"introduced again", []*Event{introduced(1), fixed(2), introduced(3)}, 3, true, ""},
+		{"introduced again and fixed", []*Event{introduced(1), fixed(2), introduced(3), fixed(4)}, 3, true, c[4]},
+		{"fixed again", []*Event{introduced(1), fixed(2), introduced(3), fixed(4)}, 4, false, ""},
+		{"last affected", []*Event{introduced(1), last(2)}, 2, true, ""},
+		{"after last affected", []*Event{introduced(1), last(2)}, 3, false, ""},
+	}
+
+	for _, test := range tests {
+		r := &revision{repo: "example.com/a", hash: c[test.commit], dir: dir}
+		affected, fixed := r.commitAffected(test.events)
+		if affected != test.affected || fixed != test.fixed {
+			t.Errorf("%s: commitAffected(%d) = %v, %q, want %v, %q", test.name, test.commit, affected, fixed, test.affected, test.fixed)
+		}
+	}
+}
+
+func TestUntaggedRepository(t *testing.T) {
+	dir, c := testRepository(t, 2)
+	r := &revision{repo: "example.com/a", hash: c[1], dir: dir, versions: make(map[string]string)}
+
+	a := &Affected{Ranges: []*Range{{Type: "SEMVER", Events: []*Event{{Introduced: "0"}, {Fixed: "1.2.0"}}}}}
+	a.Package.Ecosystem = "Go"
+	a.Package.Name = "example.com/a"
+
+	// the version of a repository without tags is unknown
+	if f := r.affected(a); f != nil {
+		t.Errorf("untagged commit affected by %s at version %q", a.Package.Name, f.Version)
+	}
+
+	a.Ranges = append(a.Ranges, &Range{Type: "GIT", Repo: "https://example.com/a", Events: []*Event{{Introduced: c[0]}}})
+	if f := r.affected(a); f == nil || f.Commit != c[1] {
+		t.Errorf("untagged commit not matched by commit: %+v", f)
+	}
+}
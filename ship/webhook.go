@@ -0,0 +1,375 @@
+package ship
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/datacratic/goship/deploy"
+)
+
+// Events sent to webhooks.
+const (
+	EventBuildStarted    = "build.started"
+	EventBuildSucceeded  = "build.succeeded"
+	EventBuildFailed     = "build.failed"
+	EventDeployStarted   = "deploy.started"
+	EventDeployHost      = "deploy.host"
+	EventDeployCompleted = "deploy.completed"
+)
+
+// Notification tells webhooks about an event of the server. Build describes
+// the build of build events, Deploy the deployment and Host the result of
+// updating one of its hosts.
+type Notification struct {
+	ID      string      `json:"id"`
+	Type    string      `json:"type"`
+	When    time.Time   `json:"when"`
+	Server  string      `json:"server"`
+	Summary string      `json:"summary"`
+	Build   *BuildInfo  `json:"build,omitempty"`
+	Deploy  *Deploy     `json:"deploy,omitempty"`
+	Host    *HostResult `json:"host,omitempty"`
+	Error   *Error      `json:"error,omitempty"`
+}
+
+// Webhook sends events to a URL. Events selects the types of events, or
+// their prefix such as "deploy.", and defaults to every event. The payload is
+// the event in JSON unless a template is given, which is executed with the
+// event. It is signed with the secret like the requests sent to instances and
+// sent again after failures as many times as Retries, 5 by default.
+type Webhook struct {
+	URL      string   `json:"url"`
+	Secret   string   `json:"secret"`
+	Events   []string `json:"events"`
+	Template string   `json:"template"`
+	Retries  int      `json:"retries"`
+
+	index    int
+	template *template.Template
+	queue    chan *Notification
+}
+
+// Delivery records the outcome of sending an event to a webhook.
+type Delivery struct {
+	ID       string    `json:"id"`
+	Event    string    `json:"event"`
+	Type     string    `json:"type"`
+	URL      string    `json:"url"`
+	When     time.Time `json:"when"`
+	Attempts int       `json:"attempts"`
+	Status   int       `json:"status,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	OK       bool      `json:"ok"`
+}
+
+type DeliveryPage struct {
+	Deliveries []*Delivery `json:"deliveries"`
+	Next       string      `json:"next,omitempty"`
+}
+
+const (
+	webhookQueue   = 256
+	webhookBackoff = time.Second
+	maxDeliveries  = 1000
+)
+
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+var webhookFuncs = template.FuncMap{
+	// json quotes a value to be used in a JSON template
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"short": func(id string) string {
+		if len(id) > 12 {
+			return id[:12]
+		}
+
+		return id
+	},
+}
+
+// startWebhooks checks the webhooks and starts sending them events.
+func (s *Server) startWebhooks() (err error) {
+	for i, h := range s.Webhooks {
+		if h.URL == "" {
+			err = fmt.Errorf("webhook without URL")
+			return
+		}
+
+		if h.Template != "" {
+			if h.template, err = template.New(h.URL).Funcs(webhookFuncs).Parse(h.Template); err != nil {
+				return
+			}
+		}
+
+		if h.Retries == 0 {
+			h.Retries = 5
+		}
+
+		h.index = i
+		h.queue = make(chan *Notification, webhookQueue)
+		s.tasks.Add(1)
+		go func(h *Webhook) {
+			defer s.tasks.Done()
+			for {
+				select {
+				case e := <-h.queue:
+					s.deliver(h, e)
+				case <-s.quit:
+					s.flush(h)
+					return
+				}
+			}
+		}(h)
+	}
+
+	return
+}
+
+func (h *Webhook) match(kind string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+
+	for _, item := range h.Events {
+		if item == kind || strings.HasSuffix(item, ".") && strings.HasPrefix(kind, item) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h *Webhook) payload(e *Notification) (result []byte, err error) {
+	if h.template == nil {
+		result, err = json.Marshal(e)
+		return
+	}
+
+	b := &bytes.Buffer{}
+	err = h.template.Execute(b, e)
+	result = b.Bytes()
+	return
+}
+
+// notify queues an event for the webhooks interested in it.
+func (s *Server) notify(e *Notification) {
+	if len(s.Webhooks) == 0 {
+		return
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	e.ID = hex.EncodeToString(id)
+	e.When = time.Now().UTC()
+	e.Server = s.Host
+
+	for _, h := range s.Webhooks {
+		if !h.match(e.Type) {
+			continue
+		}
+
+		select {
+		case h.queue <- e:
+		default:
+			s.record(h, e, &Delivery{Error: "too many pending events"})
+		}
+	}
+}
+
+// deliver sends an event to a webhook until it succeeds or the retries are
+// exhausted, waiting longer after each failure.
+func (s *Server) deliver(h *Webhook, e *Notification) {
+	d := new(Delivery)
+
+	body, err := h.payload(e)
+	if err != nil {
+		d.Error = err.Error()
+		s.record(h, e, d)
+		return
+	}
+
+	wait := webhookBackoff
+	for d.Attempts = 1; ; d.Attempts++ {
+		if d.Status, err = h.send(e, body); err == nil {
+			d.OK, d.Error = true, ""
+			break
+		}
+
+		d.Error = err.Error()
+		if d.Attempts > h.Retries || s.stopped() {
+			break
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-s.quit:
+		}
+
+		wait *= 2
+	}
+
+	s.record(h, e, d)
+}
+
+// flush tries the events still queued once the server stops.
+func (s *Server) flush(h *Webhook) {
+	for {
+		select {
+		case e := <-h.queue:
+			s.deliver(h, e)
+		default:
+			return
+		}
+	}
+}
+
+func (h *Webhook) send(e *Notification, body []byte) (status int, err error) {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Goship-Event", e.Type)
+	req.Header.Set("X-Goship-Delivery", e.ID)
+	if h.Secret != "" {
+		deploy.SignRequest(h.Secret, req, body)
+	}
+
+	r, err := webhookClient.Do(req)
+	if err != nil {
+		return
+	}
+
+	io.Copy(ioutil.Discard, r.Body)
+	r.Body.Close()
+
+	status = r.StatusCode
+	if status < 200 || status >= 300 {
+		err = fmt.Errorf("%s replied %s", h.URL, r.Status)
+	}
+
+	return
+}
+
+// record keeps the outcome of a delivery, dropping the oldest ones.
+func (s *Server) record(h *Webhook, e *Notification, d *Delivery) {
+	d.Event, d.Type, d.URL = e.ID, e.Type, h.URL
+	d.When = time.Now().UTC()
+	d.ID = fmt.Sprintf("%s/%s-%d", timeKey(d.When), e.ID, h.index)
+
+	if !d.OK {
+		log.Printf("webhook %s failed to receive %s %s: %s", h.URL, e.Type, e.ID, d.Error)
+	}
+
+	s.update(func(tx *Tx) (err error) {
+		if err = tx.Put("deliveries", d.ID, d); err != nil {
+			return
+		}
+
+		keys := tx.Keys("deliveries", "")
+		for i := 0; i < len(keys)-maxDeliveries; i++ {
+			if err = tx.Delete("deliveries", keys[i]); err != nil {
+				return
+			}
+		}
+
+		return
+	})
+}
+
+// QueryDeliveries returns the outcome of the latest deliveries to webhooks.
+func (s *Server) QueryDeliveries(q *Query) (result *DeliveryPage, err error) {
+	s.once.Do(s.initialize)
+
+	result = &DeliveryPage{
+		Deliveries: []*Delivery{},
+	}
+
+	err = s.store.View(func(tx *Tx) (err error) {
+		result.Next, err = q.paginate(tx.Keys("deliveries", ""), true, func(key string) (ok bool, err error) {
+			d := new(Delivery)
+			if ok, err = tx.Get("deliveries", key, d); ok && err == nil {
+				result.Deliveries = append(result.Deliveries, d)
+			}
+
+			return
+		})
+
+		return
+	})
+
+	return
+}
+
+// buildEvent describes a build for webhooks.
+func (s *Server) buildEvent(kind, id string, b *Builder, err error) (e *Notification) {
+	e = &Notification{
+		Type:  kind,
+		Build: s.info(id, b, kind == EventBuildStarted),
+	}
+
+	name := fmt.Sprintf("%s (%s)", b.Build.Filename, b.Build.Name)
+	switch kind {
+	case EventBuildStarted:
+		e.Summary = fmt.Sprintf("%s started building %s", b.Build.User, name)
+	case EventBuildSucceeded:
+		e.Summary = fmt.Sprintf("build %s of %s by %s succeeded", id, name, b.Build.User)
+		if n := len(b.Findings); n != 0 {
+			e.Summary += fmt.Sprintf(" with %d known vulnerabilities", n)
+		}
+	case EventBuildFailed:
+		e.Build.URL = ""
+		e.Summary = fmt.Sprintf("build of %s by %s failed: %s", name, b.Build.User, err.Error())
+
+		var ok bool
+		if e.Error, ok = err.(*Error); !ok {
+			e.Error = failed("build", err)
+		}
+	}
+
+	return
+}
+
+// deployEvent describes a deployment for webhooks.
+func deployEvent(kind string, d *Deploy, h *HostResult) (e *Notification) {
+	e = &Notification{
+		Type:   kind,
+		Deploy: d,
+		Host:   h,
+	}
+
+	switch kind {
+	case EventDeployStarted:
+		e.Summary = fmt.Sprintf("%s is deploying %s to %s", d.User, d.Version, d.Filename)
+	case EventDeployHost:
+		e.Summary = fmt.Sprintf("%s %s", d.Filename, h)
+	case EventDeployCompleted:
+		ok := 0
+		for _, h := range d.Results {
+			if h.OK {
+				ok++
+			}
+		}
+
+		e.Summary = fmt.Sprintf("%s deployed %s to %s: %d of %d hosts updated", d.User, d.Version, d.Filename, ok, len(d.Results))
+	}
+
+	return
+}
@@ -0,0 +1,120 @@
+package ship
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/datacratic/goship/deploy"
+)
+
+func TestWebhookMatch(t *testing.T) {
+	tests := []struct {
+		events []string
+		kind   string
+		want   bool
+	}{
+		{nil, EventBuildStarted, true},
+		{[]string{EventBuildFailed}, EventBuildFailed, true},
+		{[]string{EventBuildFailed}, EventBuildSucceeded, false},
+		{[]string{"deploy."}, EventDeployHost, true},
+		{[]string{"deploy."}, EventBuildFailed, false},
+		{[]string{"deploy"}, EventDeployHost, false},
+		{[]string{"build.", EventDeployCompleted}, EventDeployCompleted, true},
+	}
+
+	for _, test := range tests {
+		h := &Webhook{Events: test.events}
+		if got := h.match(test.kind); got != test.want {
+			t.Errorf("match(%v, %s) = %v, want %v", test.events, test.kind, got, test.want)
+		}
+	}
+}
+
+func TestWebhookPayload(t *testing.T) {
+	s := &Server{
+		Webhooks: []*Webhook{
+			{URL: "http://example.com/a"},
+			{URL: "http://example.com/b", Template: `{"text": {{json .Summary}}, "id": "{{short .ID}}"}`},
+		},
+	}
+
+	if err := s.startWebhooks(); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &Notification{ID: "0123456789abcdef", Type: EventBuildFailed, Summary: `build of "x" failed`}
+
+	data, err := s.Webhooks[0].payload(e)
+	if err != nil || string(data) != `{"id":"0123456789abcdef","type":"build.failed","when":"0001-01-01T00:00:00Z","server":"","summary":"build of \"x\" failed"}` {
+		t.Errorf("payload = %s, %v", data, err)
+	}
+
+	data, err = s.Webhooks[1].payload(e)
+	if err != nil || string(data) != `{"text": "build of \"x\" failed", "id": "0123456789ab"}` {
+		t.Errorf("payload of the template = %s, %v", data, err)
+	}
+
+	if s.Webhooks[0].Retries != 5 {
+		t.Errorf("webhook retries %d times by default", s.Webhooks[0].Retries)
+	}
+
+	s = &Server{Webhooks: []*Webhook{{URL: "http://example.com", Template: "{{"}}}
+	if err := s.startWebhooks(); err == nil {
+		t.Error("webhook with an invalid template was started")
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	s := testServer(t)
+
+	var lock sync.Mutex
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		body, _ := ioutil.ReadAll(r.Body)
+		switch {
+		case !deploy.Verify("secret", body, r) || r.Header.Get("X-Goship-Event") != EventBuildFailed:
+			w.WriteHeader(http.StatusForbidden)
+		case failures > 0:
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	defer server.Close()
+
+	h := &Webhook{URL: server.URL, Secret: "secret", Retries: 1}
+	e := &Notification{ID: "e1", Type: EventBuildFailed}
+	s.deliver(h, e)
+
+	// the server stopping ends the retries
+	lock.Lock()
+	failures = 1
+	lock.Unlock()
+
+	s.stop()
+	s.deliver(h, &Notification{ID: "e2", Type: EventBuildFailed})
+
+	page, err := s.QueryDeliveries(&Query{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Deliveries) != 2 {
+		t.Fatalf("recorded %d deliveries, want 2", len(page.Deliveries))
+	}
+
+	for _, d := range page.Deliveries {
+		switch {
+		case d.Event == "e1" && (!d.OK || d.Attempts != 2 || d.Status != http.StatusOK):
+			t.Errorf("delivery of e1 = %+v, want a success on the second attempt", d)
+		case d.Event == "e2" && (d.OK || d.Attempts != 1 || d.Status != http.StatusServiceUnavailable):
+			t.Errorf("delivery of e2 = %+v, want a single failed attempt", d)
+		}
+	}
+}
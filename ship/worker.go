@@ -0,0 +1,861 @@
+package ship
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// PollTimeout bounds the time a worker waits for a build in one request.
+	PollTimeout = 25 * time.Second
+
+	// WorkerTimeout is how long a worker may stay silent before its builds
+	// fail and it stops receiving new ones.
+	WorkerTimeout = time.Minute
+
+	// QueueTimeout bounds the time a build waits for a worker.
+	QueueTimeout = 10 * time.Minute
+
+	// LogInterval is the time between two parts of the log sent by workers.
+	LogInterval = 2 * time.Second
+)
+
+// WorkerInfo describes what a worker builds. The coordinator records when it
+// was last seen and the builds it runs.
+type WorkerInfo struct {
+	Name    string    `json:"name"`
+	GOOS    string    `json:"goos"`
+	GOARCH  string    `json:"goarch"`
+	Go      []string  `json:"go"`
+	Slots   int       `json:"slots"`
+	Seen    time.Time `json:"seen"`
+	Running []string  `json:"running"`
+}
+
+// Job is a build given to a worker.
+type Job struct {
+	ID    string `json:"id"`
+	Build *Build `json:"build"`
+}
+
+// JobResult is what a worker reports once a build completes. The artifact
+// and the bill of materials of successful builds are uploaded before.
+type JobResult struct {
+	Name      string     `json:"name"`
+	Identity  string     `json:"identity"`
+	Toolchain string     `json:"toolchain"`
+	Findings  []*Finding `json:"findings,omitempty"`
+	Error     *Error     `json:"error,omitempty"`
+}
+
+// job is a build waiting for a worker or running on one.
+type job struct {
+	Job
+	builder *Builder
+	worker  string
+	name    string
+	queued  time.Time
+	seen    time.Time
+	done    chan *JobResult
+}
+
+var artifactName = regexp.MustCompile(`^[0-9a-f]{32}\.gz$`)
+
+// platform returns the system and architecture a build targets.
+func platform(b *Build) (goos, goarch string) {
+	goos, goarch = runtime.GOOS, runtime.GOARCH
+	if value, ok := b.Flags.Env["GOOS"]; ok {
+		goos = value
+	}
+
+	if value, ok := b.Flags.Env["GOARCH"]; ok {
+		goarch = value
+	}
+
+	return
+}
+
+// goVersion returns the version of the go command, such as go1.22.1.
+func goVersion() (result string, err error) {
+	output, err := exec.Command("go", "version").Output()
+	if err != nil {
+		err = fmt.Errorf("go version: %s", err.Error())
+		return
+	}
+
+	if fields := strings.Fields(string(output)); len(fields) > 2 {
+		result = fields[2]
+	}
+
+	return
+}
+
+// match reports whether the worker builds for the platform of a build with
+// the version of Go, any version being accepted when empty.
+func (w *WorkerInfo) match(b *Build, version string) bool {
+	goos, goarch := platform(b)
+	if w.GOOS != goos || w.GOARCH != goarch {
+		return false
+	}
+
+	for _, item := range w.Go {
+		if version == "" || item == version {
+			return true
+		}
+	}
+
+	return version == ""
+}
+
+// available reports whether a live worker builds for the platform of a build.
+func (s *Server) available(b *Build) (result bool) {
+	s.call(func() {
+		for _, w := range s.workers {
+			if time.Since(w.Seen) < WorkerTimeout && w.match(b, s.Go) {
+				result = true
+			}
+		}
+	})
+
+	return
+}
+
+// make runs a build on a worker for its platform when there is one, or on
+// the server otherwise.
+func (s *Server) make(id string, b *Builder) (string, error) {
+	if !s.available(b.Build) {
+		return b.Make()
+	}
+
+	return s.dispatch(id, b)
+}
+
+// dispatch queues a build for the workers and waits for its result. The log
+// sent by the worker is kept in the workspace like for local builds.
+func (s *Server) dispatch(id string, b *Builder) (result string, err error) {
+	b.output, err = os.Create(path.Join(b.Workspace, "log"))
+	if err != nil {
+		return
+	}
+
+	b.logger = log.New(b.output, "", log.Ldate|log.Lmicroseconds)
+	b.logger.Println("queued for a worker")
+
+	j := &job{
+		Job: Job{
+			ID:    id,
+			Build: b.Build,
+		},
+		builder: b,
+		queued:  time.Now(),
+		done:    make(chan *JobResult, 1),
+	}
+
+	s.feed <- func() {
+		s.jobs[id] = j
+		s.queue = append(s.queue, j)
+		s.signal()
+	}
+
+	r, err := s.wait(j)
+
+	// stop accepting the log before closing it
+	s.call(func() {
+		s.dequeue(j)
+		s.release(j)
+		delete(s.jobs, id)
+	})
+
+	switch {
+	case err != nil:
+		err = b.fail("dispatch", err)
+	case r.Error != nil:
+		err = b.fail(r.Error.Stage, r.Error)
+	case r.Name != j.name:
+		err = b.fail("upload", fmt.Errorf("worker %s didn't upload the artifact", j.worker))
+	}
+
+	if err != nil {
+		return
+	}
+
+	b.Name, b.Identity, b.Toolchain, b.Findings = r.Name, r.Identity, r.Toolchain, r.Findings
+	b.logger.Println("done")
+	b.output.Close()
+
+	err = os.Rename(b.output.Name(), path.Join(b.Root, b.Name+".build"))
+	if err == nil {
+		result = b.Name
+	}
+
+	return
+}
+
+// wait returns the result of a build sent by its worker.
+func (s *Server) wait(j *job) (result *JobResult, err error) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case result = <-j.done:
+			return
+		case <-j.builder.context().Done():
+			err = j.builder.context().Err()
+			return
+		case <-ticker.C:
+		}
+
+		s.call(func() {
+			switch {
+			case j.worker == "" && time.Since(j.queued) > QueueTimeout:
+				err = fmt.Errorf("no worker took the build")
+			case j.worker != "" && time.Since(j.seen) > WorkerTimeout:
+				err = fmt.Errorf("worker %s stopped responding", j.worker)
+			}
+		})
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// signal wakes up the workers waiting for builds.
+func (s *Server) signal() {
+	close(s.ready)
+	s.ready = make(chan struct{})
+}
+
+func (s *Server) dequeue(j *job) {
+	for i, item := range s.queue {
+		if item == j {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// take gives the oldest matching build to a worker, or returns a channel
+// closed when new builds are queued.
+func (s *Server) take(w *WorkerInfo) (result *Job, ready chan struct{}) {
+	s.call(func() {
+		w.Seen, w.Running = time.Now().UTC(), nil
+		if item, ok := s.workers[w.Name]; ok {
+			w.Running = item.Running
+		}
+
+		s.workers[w.Name] = w
+
+		for _, j := range s.queue {
+			if len(w.Running) >= w.Slots || !w.match(j.Build, s.Go) {
+				continue
+			}
+
+			s.dequeue(j)
+			j.worker, j.seen = w.Name, time.Now()
+			j.builder.logger.Println("running on worker", w.Name)
+			w.Running = append(w.Running, j.ID)
+
+			result = &j.Job
+			return
+		}
+
+		ready = s.ready
+	})
+
+	return
+}
+
+// poll waits for a build to give to a worker.
+func (s *Server) poll(r *http.Request, w *WorkerInfo) (result *Job, err error) {
+	s.once.Do(s.initialize)
+
+	if w.Name == "" || w.GOOS == "" || w.GOARCH == "" || w.Slots <= 0 {
+		err = invalid("worker needs a name, a system, an architecture and slots")
+		return
+	}
+
+	timeout := time.After(PollTimeout)
+	for {
+		if s.draining() {
+			err = unavailable()
+			return
+		}
+
+		var ready chan struct{}
+		if result, ready = s.take(w); result != nil {
+			return
+		}
+
+		select {
+		case <-ready:
+		case <-timeout:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// assigned returns a build running on a worker and notes that the worker is
+// alive. Only the worker running the build is given it when they're named.
+func (s *Server) assigned(id, name string) (result *job, err error) {
+	s.call(func() {
+		if j, ok := s.jobs[id]; ok && j.worker != "" && (name == "" || j.worker == name) {
+			j.seen = time.Now()
+			if w, ok := s.workers[j.worker]; ok {
+				w.Seen = time.Now().UTC()
+			}
+
+			result = j
+		}
+	})
+
+	if result == nil {
+		err = notFound("build '%s' is not running on a worker", id)
+	}
+
+	return
+}
+
+func (s *Server) release(j *job) {
+	if w, ok := s.workers[j.worker]; ok {
+		for i, id := range w.Running {
+			if id == j.ID {
+				w.Running = append(w.Running[:i], w.Running[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// upload saves the artifact of a build sent by a worker, whose checksum must
+// match its name, then its bill of materials.
+func (s *Server) upload(j *job, name string, body io.Reader) (err error) {
+	var version string
+	s.call(func() {
+		version = j.name
+	})
+
+	artifact := version == "" && artifactName.MatchString(name)
+	if !artifact && (version == "" || name != version+".sbom.json") {
+		err = invalid("unexpected file '%s'", name)
+		return
+	}
+
+	filename := path.Join(s.Builds, name)
+	tmp := filename + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return
+	}
+
+	defer os.Remove(tmp)
+
+	_, err = io.Copy(f, body)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if e := f.Close(); err == nil {
+		err = e
+	}
+
+	if err != nil {
+		return
+	}
+
+	if artifact {
+		version = strings.TrimSuffix(name, ".gz")
+		if err = verifyArtifact(tmp, version); err != nil {
+			return
+		}
+	}
+
+	s.call(func() {
+		if s.jobs[j.ID] != j {
+			err = notFound("build '%s' is not running on a worker", j.ID)
+			return
+		}
+
+		j.name = version
+		j.builder.logger.Println("received", name)
+	})
+
+	if err == nil {
+		err = commitFile(tmp, filename)
+	}
+
+	return
+}
+
+func verifyArtifact(filename, version string) (err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		err = invalid("%s", err.Error())
+		return
+	}
+
+	h := md5.New()
+	if _, err = io.Copy(h, z); err != nil {
+		err = invalid("%s", err.Error())
+		return
+	}
+
+	if value := fmt.Sprintf("%x", h.Sum(nil)); value != version {
+		err = invalid("checksum failed: expected '%s' instead of '%s'", version, value)
+	}
+
+	return
+}
+
+// write adds a part of the log sent by a worker unless the build completed.
+func (s *Server) write(j *job, body io.Reader) (err error) {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return
+	}
+
+	s.call(func() {
+		if s.jobs[j.ID] != j {
+			err = notFound("build '%s' is not running on a worker", j.ID)
+			return
+		}
+
+		_, err = j.builder.output.Write(data)
+	})
+
+	return
+}
+
+// Workers returns the workers seen recently.
+func (s *Server) Workers() (result []*WorkerInfo) {
+	s.once.Do(s.initialize)
+
+	result = []*WorkerInfo{}
+	s.call(func() {
+		for _, w := range s.workers {
+			if time.Since(w.Seen) < WorkerTimeout {
+				item := *w
+				item.Running = append([]string{}, w.Running...)
+				result = append(result, &item)
+			}
+		}
+	})
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	return
+}
+
+// worker returns the name of the worker sending a request, empty when the
+// authentication is disabled.
+func (s *Server) worker(w http.ResponseWriter, r *http.Request) (name string, ok bool) {
+	if s.Auth == nil {
+		ok = true
+		return
+	}
+
+	name, ok = s.Auth.Worker(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, newError(http.StatusUnauthorized, CodeUnauthorized, "unauthorized"))
+	}
+
+	return
+}
+
+func (s *Server) startWorkers() {
+	authenticate := func(w http.ResponseWriter, r *http.Request) (name string, ok bool) {
+		if r.Method != "POST" {
+			writeError(w, newError(http.StatusMethodNotAllowed, CodeMethod, "method not allowed"))
+			return
+		}
+
+		return s.worker(w, r)
+	}
+
+	http.HandleFunc("/workers/poll", func(w http.ResponseWriter, r *http.Request) {
+		name, ok := authenticate(w, r)
+		if !ok {
+			return
+		}
+
+		info := new(WorkerInfo)
+		err := json.NewDecoder(r.Body).Decode(info)
+		r.Body.Close()
+		if err != nil {
+			writeError(w, invalid("%s", err.Error()))
+			return
+		}
+
+		// workers are known by the name of their token
+		if name != "" {
+			info.Name = name
+		}
+
+		result, err := s.poll(r, info)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if result == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+
+	// /workers/jobs/<id>/log, /workers/jobs/<id>/files/<name> and /workers/jobs/<id>/done
+	http.HandleFunc("/workers/jobs/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/workers/jobs/"), "/", 3)
+		if len(parts) < 2 {
+			writeError(w, notFound("no page '%s'", r.URL.Path))
+			return
+		}
+
+		name, ok := authenticate(w, r)
+		if !ok {
+			return
+		}
+
+		j, err := s.assigned(parts[0], name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		switch {
+		case parts[1] == "log":
+			err = s.write(j, r.Body)
+		case parts[1] == "files" && len(parts) == 3:
+			err = s.upload(j, parts[2], r.Body)
+		case parts[1] == "done":
+			result := new(JobResult)
+			if err = json.NewDecoder(r.Body).Decode(result); err != nil {
+				err = invalid("%s", err.Error())
+				break
+			}
+
+			select {
+			case j.done <- result:
+			default:
+				err = invalid("build '%s' already completed", j.ID)
+			}
+		default:
+			err = notFound("no page '%s'", r.URL.Path)
+		}
+
+		r.Body.Close()
+		if err != nil {
+			writeError(w, err)
+		}
+	})
+}
+
+// Worker runs the builds of a coordinator and sends them back.
+type Worker struct {
+	Coordinator string
+	Root        string
+	Name        string
+	Slots       int
+	Token       string
+	Client      *http.Client
+	Mirrors     *Mirrors
+	Scanner     *Scanner
+
+	info *WorkerInfo
+}
+
+// Run registers the worker and runs builds. It only returns if the worker
+// can't start.
+func (w *Worker) Run() (err error) {
+	if w.Slots <= 0 {
+		w.Slots = 1
+	}
+
+	if w.Client == nil {
+		w.Client = http.DefaultClient
+	}
+
+	if w.Mirrors == nil {
+		w.Mirrors = &Mirrors{
+			Root: path.Join(w.Root, "mirrors"),
+		}
+	}
+
+	// the directory of a server holds builds that must survive
+	if _, e := os.Stat(path.Join(w.Root, "state.db")); e == nil {
+		err = fmt.Errorf("%s is the directory of a server", w.Root)
+		return
+	}
+
+	builds := path.Join(w.Root, "worker")
+	if err = os.RemoveAll(builds); err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(builds, 0755); err != nil {
+		return
+	}
+
+	version, err := goVersion()
+	if err != nil {
+		return
+	}
+
+	w.info = &WorkerInfo{
+		Name:   w.Name,
+		GOOS:   runtime.GOOS,
+		GOARCH: runtime.GOARCH,
+		Go:     []string{version},
+		Slots:  w.Slots,
+	}
+
+	log.Printf("worker %s building for %s/%s with %s in %d slots", w.Name, w.info.GOOS, w.info.GOARCH, strings.Join(w.info.Go, " "), w.Slots)
+
+	if w.Scanner != nil {
+		go func() {
+			for {
+				time.Sleep(ScanInterval)
+				if _, err := w.Scanner.Reload(); err != nil {
+					log.Println("vulnerability database:", err)
+				}
+			}
+		}()
+	}
+
+	for i := 1; i < w.Slots; i++ {
+		go w.loop(builds)
+	}
+
+	w.loop(builds)
+	return
+}
+
+func (w *Worker) loop(root string) {
+	for {
+		j, err := w.poll()
+		if err != nil {
+			log.Println("poll:", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		if j != nil {
+			w.run(root, j)
+		}
+	}
+}
+
+func (w *Worker) post(name string, body io.Reader, result interface{}) (status int, err error) {
+	req, err := http.NewRequest("POST", URL(w.Coordinator)+name, body)
+	if err != nil {
+		return
+	}
+
+	if w.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.Token)
+	}
+
+	r, err := w.Client.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer r.Body.Close()
+
+	text, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+
+	status = r.StatusCode
+	switch {
+	case status >= 300:
+		err = ReadError(r, text)
+	case result != nil && status == http.StatusOK:
+		err = json.Unmarshal(text, result)
+	}
+
+	return
+}
+
+func (w *Worker) poll() (result *Job, err error) {
+	data, err := json.Marshal(w.info)
+	if err != nil {
+		return
+	}
+
+	j := new(Job)
+	status, err := w.post("/workers/poll", bytes.NewReader(data), j)
+	if err == nil && status == http.StatusOK {
+		result = j
+	}
+
+	return
+}
+
+// run makes a build and sends its log as it goes, then its files and result.
+func (w *Worker) run(root string, j *Job) {
+	log.Println("building", j.ID, j.Build.Name)
+
+	dir, err := ioutil.TempDir(root, j.Build.Filename+"-")
+	if err != nil {
+		w.finish(j, &JobResult{Error: failed("workspace", err)})
+		return
+	}
+
+	defer os.RemoveAll(dir)
+
+	b := &Builder{
+		Workspace: path.Join(dir, "work"),
+		Root:      dir,
+		Build:     j.Build,
+		Mirrors:   w.Mirrors,
+		Scanner:   w.Scanner,
+	}
+
+	if err = os.Mkdir(b.Workspace, 0755); err != nil {
+		w.finish(j, &JobResult{Error: failed("workspace", err)})
+		return
+	}
+
+	// the log is followed from the start since the builder renames it once done
+	if _, err = os.Create(path.Join(b.Workspace, "log")); err != nil {
+		w.finish(j, &JobResult{Error: failed("workspace", err)})
+		return
+	}
+
+	f, err := os.Open(path.Join(b.Workspace, "log"))
+	if err != nil {
+		w.finish(j, &JobResult{Error: failed("workspace", err)})
+		return
+	}
+
+	defer f.Close()
+
+	stop := make(chan struct{})
+	sent := make(chan struct{})
+	go func() {
+		w.stream(j, b, f, stop)
+		close(sent)
+	}()
+
+	_, err = b.Make()
+	close(stop)
+	<-sent
+
+	result := &JobResult{
+		Name:      b.Name,
+		Identity:  b.Identity,
+		Toolchain: b.Toolchain,
+		Findings:  b.Findings,
+	}
+
+	if err != nil {
+		// the coordinator keeps its own copy of the log
+		result.Error = failed("build", err)
+		result.Error.Log = ""
+		w.finish(j, result)
+		return
+	}
+
+	for _, name := range []string{b.Name + ".gz", b.Name + ".sbom.json"} {
+		if err = w.send(j, dir, name); err != nil {
+			result.Error = failed("upload", err)
+			break
+		}
+	}
+
+	w.finish(j, result)
+}
+
+// stream sends the log of a build until it stops, canceling the build when
+// the coordinator no longer expects it.
+func (w *Worker) stream(j *Job, b *Builder, f *os.File, stop chan struct{}) {
+	ticker := time.NewTicker(LogInterval)
+	defer ticker.Stop()
+
+	for done := false; !done; {
+		select {
+		case <-stop:
+			done = true
+		case <-ticker.C:
+		}
+
+		part := &bytes.Buffer{}
+		io.Copy(part, f)
+
+		_, err := w.post("/workers/jobs/"+j.ID+"/log", part, nil)
+		if e, ok := err.(*Error); ok && e.Code == CodeNotFound {
+			if b.context().Err() == nil {
+				log.Println("build", j.ID, "was canceled")
+				b.Cancel()
+			}
+		} else if err != nil {
+			log.Println("log of", j.ID+":", err)
+		}
+	}
+}
+
+func (w *Worker) send(j *Job, dir, name string) (err error) {
+	f, err := os.Open(path.Join(dir, name))
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	_, err = w.post("/workers/jobs/"+j.ID+"/files/"+name, f, nil)
+	return
+}
+
+func (w *Worker) finish(j *Job, result *JobResult) {
+	if result.Error != nil {
+		log.Println("build", j.ID, "failed:", result.Error)
+	} else {
+		log.Println("built", j.ID, "as", result.Name)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	// canceled builds are no longer expected
+	_, err = w.post("/workers/jobs/"+j.ID+"/done", bytes.NewReader(data), nil)
+	if e, ok := err.(*Error); err != nil && !(ok && e.Code == CodeNotFound) {
+		log.Println("result of", j.ID+":", err)
+	}
+}
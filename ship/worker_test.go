@@ -0,0 +1,267 @@
+package ship
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestWorkerMatch(t *testing.T) {
+	w := &WorkerInfo{GOOS: "linux", GOARCH: "arm64", Go: []string{"go1.21.0", "go1.22.1"}}
+	build := func(env map[string]string) *Build {
+		return &Build{Flags: Flags{Env: env}}
+	}
+
+	arm := map[string]string{"GOOS": "linux", "GOARCH": "arm64"}
+	tests := []struct {
+		build   *Build
+		version string
+		want    bool
+	}{
+		{build(arm), "go1.22.1", true},
+		{build(arm), "go1.21.0", true},
+		{build(arm), "", true},
+		{build(arm), "go1.20.0", false},
+		{build(map[string]string{"GOOS": "darwin", "GOARCH": "arm64"}), "go1.22.1", false},
+		{build(map[string]string{"GOOS": "linux", "GOARCH": "amd64"}), "go1.22.1", false},
+	}
+
+	for i, test := range tests {
+		if got := w.match(test.build, test.version); got != test.want {
+			t.Errorf("match(%d, %q) = %v, want %v", i, test.version, got, test.want)
+		}
+	}
+
+	if (&WorkerInfo{GOOS: "linux", GOARCH: "arm64"}).match(build(arm), "go1.22.1") {
+		t.Error("worker without a version of Go matched")
+	}
+}
+
+func TestAuthWorker(t *testing.T) {
+	a := &Auth{
+		Tokens:  map[string]string{"alice": "t1"},
+		Workers: map[string]string{"arm1": "w1", "empty": ""},
+	}
+
+	tests := []struct {
+		header string
+		name   string
+		ok     bool
+	}{
+		{"Bearer w1", "arm1", true},
+		{"Bearer t1", "", false},
+		{"Bearer ", "", false},
+		{"w1", "", false},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/workers/poll", nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+
+		if name, ok := a.Worker(r); name != test.name || ok != test.ok {
+			t.Errorf("Worker(%q) = %q, %v, want %q, %v", test.header, name, ok, test.name, test.ok)
+		}
+	}
+}
+
+// testJob queues a build for the workers as dispatch does.
+func testJob(s *Server, id string, env map[string]string) (j *job) {
+	j = &job{
+		Job: Job{
+			ID:    id,
+			Build: &Build{Flags: Flags{Env: env}},
+		},
+		builder: &Builder{logger: log.New(ioutil.Discard, "", 0)},
+		done:    make(chan *JobResult, 1),
+	}
+
+	s.call(func() {
+		s.jobs[id] = j
+		s.queue = append(s.queue, j)
+		s.signal()
+	})
+
+	return
+}
+
+func TestTake(t *testing.T) {
+	s := testServer(t)
+	s.Go = "go1.22.1"
+
+	arm := map[string]string{"GOOS": "linux", "GOARCH": "arm64"}
+	testJob(s, "j1", map[string]string{"GOOS": "linux", "GOARCH": "amd64"})
+	j2 := testJob(s, "j2", arm)
+	testJob(s, "j3", arm)
+
+	w := &WorkerInfo{Name: "w1", GOOS: "linux", GOARCH: "arm64", Go: []string{"go1.22.1"}, Slots: 1}
+	result, _ := s.take(w)
+	if result == nil || result.ID != "j2" {
+		t.Fatalf("worker took %v, want j2", result)
+	}
+
+	// every slot of the worker is used
+	w = &WorkerInfo{Name: "w1", GOOS: "linux", GOARCH: "arm64", Go: []string{"go1.22.1"}, Slots: 1}
+	result, ready := s.take(w)
+	if result != nil || ready == nil {
+		t.Fatalf("busy worker took %v", result)
+	}
+
+	if _, err := s.assigned("j2", "w2"); err == nil {
+		t.Error("build was given to another worker")
+	}
+
+	if j, err := s.assigned("j2", "w1"); err != nil || j != j2 {
+		t.Errorf("assigned(j2) = %v, %v", j, err)
+	}
+
+	s.call(func() {
+		s.release(j2)
+		s.dequeue(j2)
+		delete(s.jobs, "j2")
+	})
+
+	result, _ = s.take(w)
+	if result == nil || result.ID != "j3" {
+		t.Fatalf("worker took %v once free, want j3", result)
+	}
+
+	// workers with another version of Go are left waiting
+	other := &WorkerInfo{Name: "w2", GOOS: "linux", GOARCH: "amd64", Go: []string{"go1.21.0"}, Slots: 4}
+	if result, _ := s.take(other); result != nil {
+		t.Errorf("worker with go1.21.0 took %v", result)
+	}
+
+	s.call(func() {
+		if want := []string{"j3"}; !reflect.DeepEqual(s.workers["w1"].Running, want) {
+			t.Errorf("worker runs %v, want %v", s.workers["w1"].Running, want)
+		}
+	})
+}
+
+func compress(t *testing.T, data []byte) []byte {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.Bytes()
+}
+
+func TestDispatch(t *testing.T) {
+	s := testServer(t)
+
+	executable := []byte("executable")
+	name := fmt.Sprintf("%x", md5.Sum(executable))
+
+	workspace := path.Join(s.Builds, "job1")
+	if err := os.Mkdir(workspace, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Builder{
+		Workspace: workspace,
+		Root:      s.Builds,
+		Build:     &Build{Name: "example.com/x"},
+	}
+
+	type outcome struct {
+		name string
+		err  error
+	}
+
+	done := make(chan outcome)
+	go func() {
+		name, err := s.dispatch("job1", b)
+		done <- outcome{name, err}
+	}()
+
+	w := &WorkerInfo{Name: "w1", GOOS: runtime.GOOS, GOARCH: runtime.GOARCH, Go: []string{s.Go}, Slots: 1}
+	var result *Job
+	for result == nil {
+		var ready chan struct{}
+		if result, ready = s.take(w); result == nil {
+			<-ready
+		}
+	}
+
+	j, err := s.assigned(result.ID, "w1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.write(j, strings.NewReader("building\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	uploads := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{".sbom.json", []byte("{}"), false},
+		{"other.sbom.json", []byte("{}"), false},
+		{name + ".sbom.json", []byte("{}"), false},
+		{"../state.db", []byte("{}"), false},
+		{name + ".gz", compress(t, []byte("other")), false},
+		{name + ".gz", compress(t, executable), true},
+		{name + ".gz", compress(t, executable), false},
+		{"0123456789abcdef0123456789abcdef.sbom.json", []byte("{}"), false},
+		{name + ".sbom.json", []byte("{}"), true},
+	}
+
+	for i, u := range uploads {
+		if err := s.upload(j, u.name, bytes.NewReader(u.data)); (err == nil) != u.ok {
+			t.Errorf("upload %d of %s = %v", i, u.name, err)
+		}
+	}
+
+	j.done <- &JobResult{Name: name, Identity: "identity", Toolchain: "go1.22.1"}
+
+	o := <-done
+	if o.err != nil || o.name != name {
+		t.Fatalf("dispatch = %q, %v, want %q", o.name, o.err, name)
+	}
+
+	for _, filename := range []string{name + ".gz", name + ".sbom.json", name + ".build"} {
+		if _, err := os.Stat(path.Join(s.Builds, filename)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if data, _ := ioutil.ReadFile(path.Join(s.Builds, name+".build")); !strings.Contains(string(data), "building") {
+		t.Errorf("log of the worker wasn't kept: %s", data)
+	}
+
+	if b.Identity != "identity" || b.Toolchain != "go1.22.1" {
+		t.Errorf("builder has identity %q and toolchain %q", b.Identity, b.Toolchain)
+	}
+
+	// the log of a completed build is left alone
+	if err = s.write(j, strings.NewReader("late\n")); err == nil {
+		t.Error("log of a completed build was written")
+	}
+
+	s.call(func() {
+		if len(s.workers["w1"].Running) != 0 || len(s.jobs) != 0 || len(s.queue) != 0 {
+			t.Errorf("worker still runs %v", s.workers["w1"].Running)
+		}
+	})
+}